@@ -3,35 +3,198 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"time"
 )
 
 var errTweetTooLong = errors.New("tweet is too long, twitter API is going to complain")
+var errBadMedia = errors.New("tweet has missing or unsupported media attached")
 
-func BatchUpdate(ctx context.Context, sqs SQS, tweetSource TweetProvider, username string) error {
+func BatchUpdate(ctx context.Context, sqs SQS, media *MediaLoader, args *BatchUpdateArgs) error {
 	logger, ok := ctx.Value(STSContextKey("logger")).(*log.Logger)
 	if !ok {
 		return NoLoggerInContext()
 	}
-	tweets, err := tweetSource.All()
+	tweets, err := args.tweetSource.All()
 	if err != nil {
 		return err
 	}
 
-	logger.Printf("Found %d tweets in %s.\n", len(tweets), tweetSource.Name())
+	if args.format != nil && args.format.templateData != nil {
+		logger.Printf("Rendered %d tweets in %s from %d rows of data.\n", len(tweets), args.tweetSource.Name(), len(args.format.templateData))
+	} else {
+		logger.Printf("Found %d tweets in %s.\n", len(tweets), args.tweetSource.Name())
+	}
 
 	err = nil
+	expanded := make([]*Envelope, 0, len(tweets))
 	for i, tweet := range tweets {
-		// I'm finding that sending tweets that get _close_ to the 280 character limit get rejected from the API, even
-		// though they're totally absolutely unequivocally less than 280 characters.
-		if len(tweet) > 220 {
-			log.Printf("tweet %d is too long (length: %d; text: %s). please edit and rerun batch-update", i, len(tweet), tweet)
+		if len(tweet.Media) > 0 {
+			if _, mediaErr := media.LoadAll(ctx, tweet.Media); mediaErr != nil {
+				log.Printf("tweet %d has bad media: %s. please fix and rerun batch-update", i, mediaErr)
+				err = errBadMedia
+			}
+		}
+		if tweetLength(tweet.Text) <= MAX_TWEET_LENGTH {
+			expanded = append(expanded, tweet)
+			continue
+		}
+		if !args.splitLong {
+			log.Printf("tweet %d is too long (length: %d; text: %s). please edit and rerun batch-update, or pass --split-long", i, tweetLength(tweet.Text), tweet.Text)
 			err = errTweetTooLong
+			continue
+		}
+		parts, splitErr := splitTweet(tweet)
+		if splitErr != nil {
+			log.Printf("tweet %d is too long and can't be split: %s. please edit and rerun batch-update", i, splitErr)
+			err = errTweetTooLong
+			continue
+		}
+		logger.Printf("Split tweet %d into a thread of %d parts.\n", i, len(parts))
+		expanded = append(expanded, parts...)
+	}
+	if err != nil {
+		return err
+	}
+	renumberThreads(expanded)
+
+	bodies, err := EncodeEnvelopes(expanded)
+	if err != nil {
+		return err
+	}
+	dedupIDs := make([]string, len(bodies))
+	for i, body := range bodies {
+		dedupIDs[i] = messageDeduplicationID(body, args.user)
+	}
+	if args.ledger != nil {
+		expanded, dedupIDs, err = skipEnqueued(logger, args.ledger, expanded, dedupIDs)
+		if err != nil {
+			return err
+		}
+		if len(expanded) == 0 {
+			logger.Printf("Every tweet has already been enqueued, according to %s.\n", args.ledger.Name())
+			return nil
+		}
+		// Threads the ledger knew about have their old IDs back.
+		bodies, err = EncodeEnvelopes(expanded)
+		if err != nil {
+			return err
+		}
+	}
+
+	result, err := sqs.SendAll(ctx, bodies, dedupIDs, args.user)
+	if result == nil {
+		return err
+	}
+	logger.Printf("Enqueued %d of %d tweets.\n", len(result.Enqueued), len(bodies))
+	for _, i := range result.FailedIndexes() {
+		logger.Printf("[batch_update]: Tweet %d was not enqueued: %s. Text: %s\n", i, result.Failed[i], expanded[i].Text)
+	}
+	for _, i := range result.Reordered {
+		logger.Printf("[batch_update]: Tweet %d was enqueued after tweets that come later in the batch, so it will be posted after them. Text: %s\n", i, expanded[i].Text)
+	}
+	if args.ledger != nil && !args.dryRun {
+		now := time.Now().UTC()
+		entries := make([]*LedgerEntry, 0, len(result.Enqueued))
+		for _, i := range result.Enqueued {
+			entry := &LedgerEntry{DedupID: dedupIDs[i], Group: args.user, Text: expanded[i].Text, EnqueuedAt: now}
+			if expanded[i].Thread != nil {
+				entry.ThreadID = expanded[i].Thread.ID
+			}
+			entries = append(entries, entry)
+		}
+		if ledgerErr := args.ledger.Record(entries); ledgerErr != nil {
+			logger.Printf("[batch_update]: Could not record the enqueued tweets in %s: %s. Rerunning this batch will enqueue them again.\n", args.ledger.Name(), ledgerErr)
+			if err == nil {
+				err = ledgerErr
+			}
 		}
 	}
 	if err != nil {
 		return err
 	}
+	return result.Err()
+}
+
+// skipEnqueued drops the tweets that the ledger says have already been
+// enqueued, along with their deduplication IDs. Thread IDs are new every run,
+// so the parts of a thread that are still to be enqueued take the ID its
+// enqueued parts were recorded with, and carry on the same thread.
+func skipEnqueued(logger *log.Logger, ledger EnqueueLedger, tweets []*Envelope, dedupIDs []string) ([]*Envelope, []string, error) {
+	enqueued, err := ledger.Enqueued(dedupIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(enqueued) == 0 {
+		return tweets, dedupIDs, nil
+	}
+
+	// this run's thread ID -> the one recorded in the ledger
+	threadIDs := make(map[string]string)
+	for i, id := range dedupIDs {
+		if entry, ok := enqueued[id]; ok && entry.ThreadID != "" && tweets[i].Thread != nil {
+			threadIDs[tweets[i].Thread.ID] = entry.ThreadID
+		}
+	}
+
+	keptTweets := make([]*Envelope, 0, len(tweets))
+	keptIDs := make([]string, 0, len(dedupIDs))
+	for i, id := range dedupIDs {
+		if _, ok := enqueued[id]; ok {
+			logger.Printf("[batch_update]: Tweet %d was already enqueued. Skipping it. Text: %s\n", i, tweets[i].Text)
+			continue
+		}
+		tweet := tweets[i]
+		if tweet.Thread != nil {
+			if threadID, ok := threadIDs[tweet.Thread.ID]; ok {
+				thread := *tweet.Thread
+				thread.ID = threadID
+				tweet.Thread = &thread
+			}
+		}
+		keptTweets = append(keptTweets, tweet)
+		keptIDs = append(keptIDs, id)
+	}
+	return keptTweets, keptIDs, nil
+}
+
+// splitTweet splits an over-long tweet into a numbered thread. If the tweet
+// was already part of a thread, the parts take its place in that thread;
+// otherwise they form a thread of their own. Media and the reply target stay
+// with the first part.
+func splitTweet(tweet *Envelope) ([]*Envelope, error) {
+	texts, err := splitText(tweet.Text, MAX_TWEET_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]*Envelope, len(texts))
+	names := make([]string, len(texts))
+	for i, text := range texts {
+		part := *tweet
+		part.Text = text
+		if i > 0 {
+			part.Media = nil
+			part.ReplyTo = ""
+		}
+		if tweet.IdempotencyKey != "" {
+			part.IdempotencyKey = fmt.Sprintf("%s-%d", tweet.IdempotencyKey, i+1)
+		}
+		parts[i] = &part
+		names[i] = "split"
+	}
 
-	return sqs.SendAll(tweets, username)
+	if tweet.Thread != nil {
+		// renumberThreads fixes up the indexes once the whole batch is
+		// expanded.
+		for _, part := range parts {
+			part.Thread = &ThreadRef{ID: tweet.Thread.ID}
+		}
+		return parts, nil
+	}
+	if err := assignThreads(parts, names); err != nil {
+		return nil, err
+	}
+	return parts, nil
 }
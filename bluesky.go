@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_BLUESKY_HOST = "https://bsky.social"
+
+type BlueskyConfig struct {
+	host        string
+	handle      string
+	appPassword string
+}
+
+// Bluesky publishes posts over the AT protocol's XRPC endpoints, logging in
+// with an app password.
+type Bluesky struct {
+	host        string
+	handle      string
+	appPassword string
+	httpClient  *http.Client
+
+	lock    sync.Mutex
+	session *blueskySession
+}
+
+func NewBluesky(conf *BlueskyConfig) (*Bluesky, error) {
+	if conf == nil || conf.handle == "" || conf.appPassword == "" {
+		return nil, errors.New("The bluesky backend requires a handle and an app password.")
+	}
+	host := conf.host
+	if host == "" {
+		host = DEFAULT_BLUESKY_HOST
+	}
+	return &Bluesky{
+		host:        strings.TrimRight(host, "/"),
+		handle:      conf.handle,
+		appPassword: conf.appPassword,
+		httpClient:  newHTTPClient(),
+	}, nil
+}
+
+type blueskySession struct {
+	AccessJwt string `json:"accessJwt"`
+	DID       string `json:"did"`
+}
+
+type blueskyRecordRef struct {
+	URI string `json:"uri"`
+	CID string `json:"cid"`
+}
+
+type blueskyReplyRef struct {
+	Root   *blueskyRecordRef `json:"root"`
+	Parent *blueskyRecordRef `json:"parent"`
+}
+
+type blueskyPostRecord struct {
+	URI   string `json:"uri"`
+	CID   string `json:"cid"`
+	Value struct {
+		Reply *blueskyReplyRef `json:"reply"`
+	} `json:"value"`
+}
+
+func (this *Bluesky) xrpc(method string) string {
+	return this.host + "/xrpc/" + method
+}
+
+// login returns the current session, creating one if necessary.
+func (this *Bluesky) login(ctx context.Context, refresh bool) (*blueskySession, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.session != nil && !refresh {
+		return this.session, nil
+	}
+
+	log.Printf("[bluesky]: Creating a session for %s.\n", this.handle)
+	session := &blueskySession{}
+	err := doJSON(
+		ctx,
+		this.httpClient,
+		http.MethodPost,
+		this.xrpc("com.atproto.server.createSession"),
+		nil,
+		map[string]string{"identifier": this.handle, "password": this.appPassword},
+		session,
+	)
+	if err != nil {
+		return nil, err
+	}
+	this.session = session
+	return session, nil
+}
+
+// replyTo builds the reply reference for a post replying to the post at uri.
+// Bluesky needs both the immediate parent and the root of the thread, so this
+// looks the parent up to find out whether it's a reply itself.
+func (this *Bluesky) replyTo(ctx context.Context, uri string) (*blueskyReplyRef, error) {
+	// at://<repo>/<collection>/<rkey>
+	parts := strings.Split(strings.TrimPrefix(uri, "at://"), "/")
+	if !strings.HasPrefix(uri, "at://") || len(parts) != 3 {
+		return nil, Permanent(fmt.Errorf("Cannot reply to %q: not an AT URI.", uri))
+	}
+
+	query := url.Values{}
+	query.Set("repo", parts[0])
+	query.Set("collection", parts[1])
+	query.Set("rkey", parts[2])
+
+	parent := &blueskyPostRecord{}
+	err := doJSON(ctx, this.httpClient, http.MethodGet, this.xrpc("com.atproto.repo.getRecord")+"?"+query.Encode(), nil, nil, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	parentRef := &blueskyRecordRef{URI: parent.URI, CID: parent.CID}
+	reply := &blueskyReplyRef{Root: parentRef, Parent: parentRef}
+	if parent.Value.Reply != nil && parent.Value.Reply.Root != nil {
+		reply.Root = parent.Value.Reply.Root
+	}
+	return reply, nil
+}
+
+func (this *Bluesky) Publish(ctx context.Context, post *Post) (*PublishedPost, error) {
+	log.Printf("[bluesky]: Posting as %s: %s\n", this.handle, post.Text)
+	record := map[string]interface{}{
+		"$type":     "app.bsky.feed.post",
+		"text":      post.Text,
+		"createdAt": time.Now().UTC().Format(time.RFC3339),
+	}
+	if post.InReplyTo != "" {
+		reply, err := this.replyTo(ctx, post.InReplyTo)
+		if err != nil {
+			return nil, err
+		}
+		record["reply"] = reply
+	}
+	if len(post.Media) > 0 {
+		images := make([]map[string]interface{}, len(post.Media))
+		for i, media := range post.Media {
+			blob, err := this.uploadBlob(ctx, media)
+			if err != nil {
+				return nil, err
+			}
+			images[i] = map[string]interface{}{"alt": media.AltText, "image": blob}
+		}
+		record["embed"] = map[string]interface{}{
+			"$type":  "app.bsky.embed.images",
+			"images": images,
+		}
+	}
+
+	ref := &blueskyRecordRef{}
+	for attempt := 0; attempt < 2; attempt++ {
+		session, err := this.login(ctx, attempt > 0)
+		if err != nil {
+			return nil, err
+		}
+
+		err = doJSON(
+			ctx,
+			this.httpClient,
+			http.MethodPost,
+			this.xrpc("com.atproto.repo.createRecord"),
+			map[string]string{"Authorization": "Bearer " + session.AccessJwt},
+			map[string]interface{}{
+				"repo":       session.DID,
+				"collection": "app.bsky.feed.post",
+				"record":     record,
+			},
+			ref,
+		)
+
+		// Access tokens are short-lived, so an expired one is worth exactly
+		// one fresh login before giving up.
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	return &PublishedPost{ID: ref.URI, Text: post.Text}, nil
+}
+
+// uploadBlob uploads an image and returns the blob reference to embed in a
+// post.
+func (this *Bluesky) uploadBlob(ctx context.Context, media *Media) (json.RawMessage, error) {
+	if media.Category == MEDIA_CATEGORY_VIDEO {
+		return nil, Permanent(fmt.Errorf("%s: the bluesky backend only supports images.", media.Source))
+	}
+
+	log.Printf("[bluesky]: Uploading %s (%d bytes).\n", media.Source, media.Size)
+	session, err := this.login(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := media.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	req, err := http.NewRequest(http.MethodPost, this.xrpc("com.atproto.repo.uploadBlob"), reader)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = media.Size
+	req.Header.Set("Authorization", "Bearer "+session.AccessJwt)
+	req.Header.Set("Content-Type", media.MimeType)
+
+	resp, err := this.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	uploaded := struct {
+		Blob json.RawMessage `json:"blob"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&uploaded); err != nil {
+		return nil, err
+	}
+	return uploaded.Blob, nil
+}
+
+func (this *Bluesky) Name() string {
+	return BACKEND_BLUESKY
+}
@@ -2,21 +2,35 @@ package main
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/urfave/cli/v2"
-	"golang.org/x/sys/unix"
 )
 
 type RunArgs struct {
 	sqs             *SQSConfig
-	twitter         *TwitterCreds
+	publisher       *PublisherConfig
+	destinations    string
+	groups          string
+	deliveryState   string
+	threadState     string
 	calibrationRate int
+	deadLetter      *DeadLetterConfig
+	failureJournal  string
+	historyFile     string
+	mediaDir        string
+	skipQueueAge    bool
 }
 
 func getSQSConfig(c *cli.Context) *SQSConfig {
 	return &SQSConfig{
 		queueName: c.Value("queue").(string),
 		region:    c.Value("region").(string),
+		// Only defined for the commands that receive messages.
+		waitTimeSeconds:   int64(c.Int("wait-time")),
+		prefetch:          int64(c.Int("prefetch")),
+		visibilityTimeout: int64(c.Int("visibility-timeout")),
 	}
 }
 
@@ -29,51 +43,228 @@ func ParseRunArgs(c *cli.Context) (*RunArgs, error) {
 		accessSecret:   c.Value("twitter-access-secret").(string),
 	}
 
+	publisherConfig := &PublisherConfig{
+		backend: c.Value("backend").(string),
+		twitter: twitterCreds,
+		mastodon: &MastodonConfig{
+			server:      c.Value("mastodon-server").(string),
+			accessToken: c.Value("mastodon-token").(string),
+		},
+		bluesky: &BlueskyConfig{
+			host:        c.Value("bluesky-host").(string),
+			handle:      c.Value("bluesky-handle").(string),
+			appPassword: c.Value("bluesky-app-password").(string),
+		},
+		webhook: &WebhookConfig{
+			url: c.Value("webhook-url").(string),
+		},
+	}
+
+	if c.IsSet("backend") && c.IsSet("destinations") {
+		return nil, fmt.Errorf("Cannot use both --backend and --destinations.")
+	}
+
 	calibrationRate := c.Value("calibration-rate").(int)
 
 	if calibrationRate < 0 {
 		return nil, fmt.Errorf("Calibration Rate cannot be negative. Got %d.", calibrationRate)
 	}
 
+	deadLetterConfig := &DeadLetterConfig{
+		queueName: c.Value("dead-letter-queue").(string),
+		region:    sqsConfig.region,
+		filename:  c.Value("dead-letter-file").(string),
+	}
+	if deadLetterConfig.queueName != "" && deadLetterConfig.filename != "" {
+		return nil, fmt.Errorf("Cannot use both --dead-letter-queue and --dead-letter-file.")
+	}
+
 	return &RunArgs{
 		sqs:             sqsConfig,
-		twitter:         twitterCreds,
+		publisher:       publisherConfig,
+		destinations:    c.Value("destinations").(string),
+		groups:          c.Value("groups").(string),
+		deliveryState:   c.Value("delivery-state").(string),
+		threadState:     c.Value("thread-state").(string),
 		calibrationRate: calibrationRate,
+		deadLetter:      deadLetterConfig,
+		failureJournal:  c.Value("failure-journal").(string),
+		historyFile:     c.Value("history-file").(string),
+		mediaDir:        c.Value("media-dir").(string),
+		skipQueueAge:    c.Bool("skip-queue-age"),
 	}, nil
 }
 
 type BatchUpdateArgs struct {
-	sqs       *SQSConfig
-	user      string
-	filename  string
-	delimiter string
+	sqs         *SQSConfig
+	user        string
+	tweetSource TweetProvider
+	format      *TweetFormat
+	mediaDir    string
+	splitLong   bool
+	dryRun      bool
+	// What has already been enqueued, or nil to enqueue everything.
+	ledger EnqueueLedger
 }
 
 func ParseBatchUpdateArgs(c *cli.Context) (*BatchUpdateArgs, error) {
 	sqsConfig := getSQSConfig(c)
 
 	user := c.Value("user").(string)
-	filename := c.Value("file").(string)
-	delimiter := c.Value("delimiter").(string)
+	source := c.Value("file").(string)
+	mediaDir := c.Value("media-dir").(string)
+	splitLong := c.Value("split-long").(bool)
 
-	if err := unix.Access(filename, unix.R_OK); err != nil {
+	format, err := getTweetFormat(c, tweetSourcePath(source))
+	if err != nil {
+		return nil, err
+	}
+	tweetSource, err := NewTweetProvider(source, format, sqsConfig.region)
+	if err != nil {
 		return nil, err
 	}
+	var ledger EnqueueLedger
+	if table := c.Value("ledger-table").(string); table != "" {
+		ledger = NewDynamoDBLedger(table, sqsConfig.region)
+	} else if file := c.Value("ledger-file").(string); file != "" {
+		ledger, err = NewFileLedger(file)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return &BatchUpdateArgs{
-		sqs:       sqsConfig,
-		user:      user,
-		filename:  filename,
-		delimiter: delimiter,
+		sqs:         sqsConfig,
+		user:        user,
+		tweetSource: tweetSource,
+		format:      format,
+		mediaDir:    mediaDir,
+		splitLong:   splitLong,
+		dryRun:      c.Value("dry-run").(bool),
+		ledger:      ledger,
+	}, nil
+}
+
+type LintArgs struct {
+	tweetSource TweetProvider
+	format      *TweetFormat
+	historyFile string
+	asJSON      bool
+}
+
+func ParseLintArgs(c *cli.Context) (*LintArgs, error) {
+	source := c.Value("file").(string)
+
+	format, err := getTweetFormat(c, tweetSourcePath(source))
+	if err != nil {
+		return nil, err
+	}
+	tweetSource, err := NewTweetProvider(source, format, c.Value("region").(string))
+	if err != nil {
+		return nil, err
+	}
+	return &LintArgs{
+		tweetSource: tweetSource,
+		format:      format,
+		historyFile: c.Value("history-file").(string),
+		asJSON:      c.Value("json").(bool),
+	}, nil
+}
+
+type FeedSyncArgs struct {
+	sqs          *SQSConfig
+	user         string
+	url          string
+	template     string
+	state        string
+	interval     time.Duration
+	skipExisting bool
+}
+
+func ParseFeedSyncArgs(c *cli.Context) (*FeedSyncArgs, error) {
+	interval := c.Value("interval").(time.Duration)
+	if interval < 0 {
+		return nil, fmt.Errorf("Interval cannot be negative. Got %s.", interval)
+	}
+	return &FeedSyncArgs{
+		sqs:          getSQSConfig(c),
+		user:         c.Value("user").(string),
+		url:          c.Value("url").(string),
+		template:     c.Value("template").(string),
+		state:        c.Value("state").(string),
+		interval:     interval,
+		skipExisting: c.Value("skip-existing").(bool),
 	}, nil
 }
 
 type PurgeArgs struct {
-	sqs *SQSConfig
+	sqs    *SQSConfig
+	dryRun bool
 }
 
 func ParsePurgeArgs(c *cli.Context) (*PurgeArgs, error) {
 	sqsConfig := getSQSConfig(c)
+	dryRun := c.Value("dry-run").(bool)
+	if dryRun {
+		// Prefetched messages would stay hidden in the buffer.
+		sqsConfig.prefetch = 1
+	}
 	return &PurgeArgs{
-		sqs: sqsConfig,
+		sqs:    sqsConfig,
+		dryRun: dryRun,
+	}, nil
+}
+
+type FailuresListArgs struct {
+	journal         string
+	includeReplayed bool
+}
+
+func ParseFailuresListArgs(c *cli.Context) (*FailuresListArgs, error) {
+	return &FailuresListArgs{
+		// Defined on the parent `failures` command, so look it up through
+		// the context lineage rather than with c.Value.
+		journal:         c.String("failure-journal"),
+		includeReplayed: c.Value("all").(bool),
+	}, nil
+}
+
+type FailuresReplayArgs struct {
+	sqs     *SQSConfig
+	journal string
+	ids     []int
+	user    string
+}
+
+func ParseFailuresReplayArgs(c *cli.Context) (*FailuresReplayArgs, error) {
+	sqsConfig := getSQSConfig(c)
+
+	// --id is required, so there's always at least one.
+	return &FailuresReplayArgs{
+		sqs:     sqsConfig,
+		journal: c.String("failure-journal"),
+		ids:     c.IntSlice("id"),
+		user:    c.Value("user").(string),
 	}, nil
 }
+
+func getTweetFormat(c *cli.Context, filename string) (*TweetFormat, error) {
+	columns := make(map[string]string)
+	for _, mapping := range c.StringSlice("column") {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Bad column mapping %q. Expected <field>=<column header>.", mapping)
+		}
+		columns[parts[0]] = parts[1]
+	}
+	format, err := NewTweetFormat(c.Value("format").(string), filename, c.Value("delimiter").(string), columns)
+	if err != nil {
+		return nil, err
+	}
+	if dataFile := c.String("data"); dataFile != "" {
+		format.templateData, err = loadTemplateData(dataFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return format, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// The fields a CSV column can be mapped to. By default, each is read from the
+// column with the same header. Columns holding lists (media, alt_text, tags)
+// separate their items with CSV_LIST_SEPARATOR; alt_text's items line up with
+// media's.
+var csvFields = map[string]bool{
+	"text":       true,
+	"not_before": true,
+	"not_after":  true,
+	"media":      true,
+	"alt_text":   true,
+	"thread":     true,
+	"reply_to":   true,
+	"account":    true,
+	"tags":       true,
+}
+
+const CSV_LIST_SEPARATOR = "|"
+
+func csvFieldNames() []string {
+	names := make([]string, 0, len(csvFields))
+	for field := range csvFields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readCSV reads one tweet per row. The first row must be a header. columns
+// overrides which column each field is read from.
+func readCSV(reader io.Reader, name string, columns map[string]string, data []map[string]interface{}) ([]*Envelope, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	header, err := csvReader.Read()
+	if err == io.EOF {
+		return []*Envelope{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	headerIndexes := make(map[string]int)
+	for i, column := range header {
+		if i == 0 {
+			column = strings.TrimPrefix(column, "\uFEFF")
+		}
+		headerIndexes[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	indexes := make(map[string]int)
+	for field := range csvFields {
+		column := field
+		if mapped, ok := columns[field]; ok {
+			column = mapped
+		}
+		if i, ok := headerIndexes[strings.ToLower(strings.TrimSpace(column))]; ok {
+			indexes[field] = i
+		} else if _, ok := columns[field]; ok {
+			return nil, fmt.Errorf("%s: no column %q for %s.", name, column, field)
+		}
+	}
+	if _, ok := indexes["text"]; !ok {
+		return nil, fmt.Errorf("%s: no text column. Name one with --column text=<header>.", name)
+	}
+
+	records := []*tweetRecord{}
+	locations := []string{}
+	for row := 2; ; row++ {
+		values, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+
+		value := func(field string) string {
+			i, ok := indexes[field]
+			if !ok || i >= len(values) {
+				return ""
+			}
+			return strings.TrimSpace(values[i])
+		}
+		list := func(field string) []string {
+			if value(field) == "" {
+				return nil
+			}
+			items := strings.Split(value(field), CSV_LIST_SEPARATOR)
+			for i := range items {
+				items[i] = strings.TrimSpace(items[i])
+			}
+			return items
+		}
+
+		record := &tweetRecord{
+			Text:      value("text"),
+			NotBefore: value("not_before"),
+			NotAfter:  value("not_after"),
+			Thread:    value("thread"),
+			ReplyTo:   value("reply_to"),
+			Account:   value("account"),
+			Tags:      list("tags"),
+		}
+		altTexts := list("alt_text")
+		for i, source := range list("media") {
+			media := &recordMedia{Source: source}
+			if i < len(altTexts) {
+				media.AltText = altTexts[i]
+			}
+			record.Media = append(record.Media, media)
+		}
+		records = append(records, record)
+		locations = append(locations, fmt.Sprintf("%s: row %d", name, row))
+	}
+	return collectRecords(records, locations, name, data)
+}
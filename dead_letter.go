@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// DeadLetterConfig describes where messages that can never be posted are sent.
+// At most one of queueName and filename may be set.
+type DeadLetterConfig struct {
+	queueName string
+	region    string
+	filename  string
+}
+
+// DeadLetterQueue is a destination for messages that the publishing API has
+// permanently rejected. Once a message has been Put, it is safe to delete it
+// from the main queue.
+type DeadLetterQueue interface {
+	Put(context.Context, *sqs.Message, error) error
+	Name() string
+}
+
+// DeadLetterRecord is what gets written to a dead-letter destination: the
+// original message, plus why we gave up on it.
+type DeadLetterRecord struct {
+	MessageID     string    `json:"message_id"`
+	Body          string    `json:"body"`
+	SentTimestamp string    `json:"sent_timestamp,omitempty"`
+	Reason        string    `json:"reason"`
+	FailedAt      time.Time `json:"failed_at"`
+}
+
+func newDeadLetterRecord(message *sqs.Message, reason error) *DeadLetterRecord {
+	record := &DeadLetterRecord{
+		Reason:   reason.Error(),
+		FailedAt: time.Now().UTC(),
+	}
+	if message.MessageId != nil {
+		record.MessageID = *message.MessageId
+	}
+	if message.Body != nil {
+		record.Body = *message.Body
+	}
+	if sentTimestamp, ok := message.Attributes["SentTimestamp"]; ok && sentTimestamp != nil {
+		record.SentTimestamp = *sentTimestamp
+	}
+	return record
+}
+
+// NewDeadLetterQueue builds the dead-letter destination described by conf. It
+// returns a nil DeadLetterQueue if none is configured.
+func NewDeadLetterQueue(conf *DeadLetterConfig) (DeadLetterQueue, error) {
+	switch {
+	case conf == nil || (conf.queueName == "" && conf.filename == ""):
+		return nil, nil
+	case conf.queueName != "" && conf.filename != "":
+		return nil, errors.New("Only one of a dead-letter queue or a dead-letter file may be configured.")
+	case conf.filename != "":
+		return &FileDeadLetterQueue{filename: conf.filename}, nil
+	}
+
+	queue, err := NewSQS(&SQSConfig{queueName: conf.queueName, region: conf.region})
+	if err != nil {
+		return nil, err
+	}
+	return &SQSDeadLetterQueue{sqs: queue, name: conf.queueName}, nil
+}
+
+// FileDeadLetterQueue appends one JSON-encoded DeadLetterRecord per line to a
+// local file.
+type FileDeadLetterQueue struct {
+	filename string
+}
+
+func (this *FileDeadLetterQueue) Put(ctx context.Context, message *sqs.Message, reason error) error {
+	line, err := json.Marshal(newDeadLetterRecord(message, reason))
+	if err != nil {
+		return err
+	}
+
+	return appendLine(this.filename, line)
+}
+
+func (this *FileDeadLetterQueue) Name() string {
+	return this.filename
+}
+
+// SQSDeadLetterQueue sends a JSON-encoded DeadLetterRecord to a second queue.
+// If the original message belonged to a message group, the record is sent to
+// the same group.
+type SQSDeadLetterQueue struct {
+	sqs  SQS
+	name string
+}
+
+func (this *SQSDeadLetterQueue) Put(ctx context.Context, message *sqs.Message, reason error) error {
+	body, err := json.Marshal(newDeadLetterRecord(message, reason))
+	if err != nil {
+		return err
+	}
+
+	group := "dead-letter"
+	if groupID, ok := message.Attributes["MessageGroupId"]; ok && groupID != nil {
+		group = *groupID
+	}
+	result, err := this.sqs.SendAll(ctx, []string{string(body)}, nil, group)
+	if err != nil {
+		return err
+	}
+	return result.Err()
+}
+
+func (this *SQSDeadLetterQueue) Name() string {
+	return this.name
+}
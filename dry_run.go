@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// DryRunSQS wraps an SQS, passing reads through but only printing what each
+// write would have done. Received messages are made visible again straight
+// away, so that looking at the queue doesn't hide anything from other
+// receivers.
+type DryRunSQS struct {
+	sqs SQS
+	out io.Writer
+}
+
+func NewDryRunSQS(sqsAPI SQS) *DryRunSQS {
+	return &DryRunSQS{sqs: sqsAPI, out: os.Stdout}
+}
+
+func (this *DryRunSQS) GetQueueAttributes(input *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	return this.sqs.GetQueueAttributes(input)
+}
+
+func (this *DryRunSQS) Receive(ctx context.Context) (*sqs.Message, error) {
+	return this.peek(this.sqs.Receive(ctx))
+}
+
+func (this *DryRunSQS) ReceiveNow(ctx context.Context) (*sqs.Message, error) {
+	return this.peek(this.sqs.ReceiveNow(ctx))
+}
+
+func (this *DryRunSQS) ReceivePicking(ctx context.Context, pick GroupPicker) (*sqs.Message, error) {
+	return this.peek(this.sqs.ReceivePicking(ctx, pick))
+}
+
+// peek releases a message as soon as it's received, through the wrapped SQS,
+// so that it's no longer outstanding either. On a FIFO queue, that means the
+// same message is received again next, rather than the one behind it.
+func (this *DryRunSQS) peek(message *sqs.Message, err error) (*sqs.Message, error) {
+	if err != nil || message == nil {
+		return message, err
+	}
+	if err := this.sqs.ChangeVisibility(message.ReceiptHandle, 0); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (this *DryRunSQS) DeleteMessage(receiptHandle *string) error {
+	fmt.Fprintf(this.out, "[dry run] Would delete message %s.\n", aws.StringValue(receiptHandle))
+	return nil
+}
+
+func (this *DryRunSQS) IsFIFO() bool {
+	return this.sqs.IsFIFO()
+}
+
+func (this *DryRunSQS) Close() {
+	this.sqs.Close()
+}
+
+// KeepInFlight does nothing, since the message was already released when it
+// was received.
+func (this *DryRunSQS) KeepInFlight(receiptHandle *string) func() {
+	return func() {}
+}
+
+func (this *DryRunSQS) ChangeVisibility(receiptHandle *string, timeoutSeconds int64) error {
+	fmt.Fprintf(this.out, "[dry run] Would change the visibility timeout of message %s to %d seconds.\n", aws.StringValue(receiptHandle), timeoutSeconds)
+	return nil
+}
+
+// SendAll prints the batches that would be sent, entry by entry. Entries
+// without an explicit deduplication ID are deduplicated by SQS on the SHA-256
+// of their body, so that's what's shown for them. Standard queues don't
+// deduplicate at all, so their entries show the sequence number instead.
+func (this *DryRunSQS) SendAll(ctx context.Context, messages, dedupIDs []string, group string) (*SendResult, error) {
+	batches := sendBatches(messages, dedupIDs, group, this.sqs.IsFIFO())
+	fmt.Fprintf(this.out, "[dry run] Would send %d messages in %d batches.\n", len(messages), len(batches))
+	for i, entries := range batches {
+		fmt.Fprintf(this.out, "Batch %d:\n", i+1)
+		for _, entry := range entries {
+			if !this.sqs.IsFIFO() {
+				fmt.Fprintf(
+					this.out,
+					"  [%s] group: %s, sequence: %s\n    %s\n",
+					aws.StringValue(entry.Id),
+					group,
+					aws.StringValue(entry.MessageAttributes[SEQUENCE_ATTRIBUTE].StringValue),
+					aws.StringValue(entry.MessageBody),
+				)
+				continue
+			}
+			dedupID := aws.StringValue(entry.MessageDeduplicationId)
+			if dedupID == "" {
+				hash := sha256.Sum256([]byte(aws.StringValue(entry.MessageBody)))
+				dedupID = hex.EncodeToString(hash[:]) + " (content-based)"
+			}
+			fmt.Fprintf(
+				this.out,
+				"  [%s] group: %s, dedup id: %s\n    %s\n",
+				aws.StringValue(entry.Id),
+				aws.StringValue(entry.MessageGroupId),
+				dedupID,
+				aws.StringValue(entry.MessageBody),
+			)
+		}
+	}
+	result := newSendResult()
+	for i := range messages {
+		result.Enqueued = append(result.Enqueued, i)
+	}
+	return result, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+type FakeTweetProvider struct {
+	tweets []*Envelope
+}
+
+func (this *FakeTweetProvider) All() ([]*Envelope, error) {
+	return this.tweets, nil
+}
+
+func (this *FakeTweetProvider) Name() string {
+	return "fake"
+}
+
+func TestDryRunBatchUpdate(t *testing.T) {
+	tweets := []*Envelope{}
+	for i := 0; i < 12; i++ {
+		tweets = append(tweets, NewEnvelope(fmt.Sprintf("tweet %d", i)))
+	}
+	fakeSQS := &FakeSQS{}
+	var out bytes.Buffer
+	dryRun := &DryRunSQS{sqs: fakeSQS, out: &out}
+
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+	err := BatchUpdate(ctx, dryRun, NewMediaLoader("", ""), &BatchUpdateArgs{user: "me", tweetSource: &FakeTweetProvider{tweets: tweets}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fakeSQS.sent) != 0 {
+		t.Errorf("Expected nothing to be sent but got %v.", fakeSQS.sent)
+	}
+	output := out.String()
+	for _, expected := range []string{"Would send 12 messages in 2 batches.", "Batch 2:", "[11] group: me, dedup id: ", `"text":"tweet 11"`} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected the output to contain %q but got:\n%s", expected, output)
+		}
+	}
+
+	if err := dryRun.DeleteMessage(aws.String("handle")); err != nil {
+		t.Fatal(err)
+	}
+	if len(fakeSQS.deleted) != 0 {
+		t.Errorf("Expected nothing to be deleted but got %v.", fakeSQS.deleted)
+	}
+}
+
+func TestDryRunReceiveReleasesMessages(t *testing.T) {
+	client := &FakeSQSClient{received: []*sqs.Message{groupMessage("a1", "a", "")}}
+	sqsImpl := newSQSImpl(client, "", true, &SQSConfig{prefetch: 1})
+	var out bytes.Buffer
+	dryRun := &DryRunSQS{sqs: sqsImpl, out: &out}
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+
+	received, err := dryRun.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handle := aws.StringValue(received.ReceiptHandle); handle != "a1" {
+		t.Errorf("Expected a1 but got %s.", handle)
+	}
+	dryRun.KeepInFlight(received.ReceiptHandle)()
+	if err := dryRun.DeleteMessage(received.ReceiptHandle); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []int64{0}; !reflect.DeepEqual(client.visibilityTimeouts, expected) {
+		t.Errorf("Expected visibility timeouts %v but got %v.", expected, client.visibilityTimeouts)
+	}
+	if len(sqsImpl.outstanding) != 0 || len(sqsImpl.heartbeats) != 0 {
+		t.Errorf("Expected nothing outstanding or in flight but got %v and %v.", sqsImpl.outstanding, sqsImpl.heartbeats)
+	}
+	// The group isn't blocked by the message that was looked at.
+	client.received = []*sqs.Message{groupMessage("a1", "a", "")}
+	if received, err := dryRun.ReceiveNow(ctx); err != nil || received == nil {
+		t.Errorf("Expected a1 again but got %v (%v).", received, err)
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	testTables := []struct {
+		input    string
+		expected bool
+	}{
+		{"yes\n", true},
+		{"no\n", false},
+		{"maybe\nYES\n", true},
+		{"", false},
+	}
+
+	for _, test := range testTables {
+		if answer := confirm(bufio.NewReader(strings.NewReader(test.input)), "?"); answer != test.expected {
+			t.Errorf("Expected %v for %q but got %v.", test.expected, test.input, answer)
+		}
+	}
+}
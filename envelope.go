@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ENVELOPE_VERSION is the newest envelope format this version of sts can
+// read, and the one it writes.
+const ENVELOPE_VERSION = 1
+
+// MediaRef points at a media file to attach to a post.
+type MediaRef struct {
+	// Source is either an s3://bucket/key URL or a local path.
+	Source  string `json:"source"`
+	AltText string `json:"alt_text,omitempty"`
+}
+
+// Envelope is the body of every message sts puts on the queue: the text to
+// post, plus everything we know about how and when to post it.
+//
+// Messages enqueued by older versions of sts have a bare string as their body.
+// DecodeEnvelope treats those as an envelope with just Text set, and a Version
+// of 0.
+type Envelope struct {
+	Version int         `json:"v"`
+	Text    string      `json:"text"`
+	Media   []*MediaRef `json:"media,omitempty"`
+	// ReplyTo is the backend-specific ID of the post this one replies to.
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Account restricts publishing to the destination with this name.
+	Account string `json:"account,omitempty"`
+	// The post is held back until NotBefore, and dropped if it hasn't gone out
+	// by NotAfter. Either may be nil.
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	Thread    *ThreadRef `json:"thread,omitempty"`
+	// IdempotencyKey identifies the post across retries and re-enqueues. If
+	// it's empty, the SQS message ID is used instead.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+func NewEnvelope(text string) *Envelope {
+	return &Envelope{Version: ENVELOPE_VERSION, Text: text}
+}
+
+func (this *Envelope) Encode() (string, error) {
+	bytes, err := json.Marshal(this)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// UnsupportedVersionError is returned for envelopes written by a newer version
+// of sts. The envelope is fine; this version just can't read it.
+type UnsupportedVersionError struct {
+	Version int
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("Message envelope version %d is newer than the newest supported version (%d).", e.Version, ENVELOPE_VERSION)
+}
+
+// DecodeEnvelope parses a message body. Anything that isn't a JSON object with
+// a positive "v" field is a legacy plain-text body. Envelopes from a newer
+// version of sts than this one are rejected rather than guessed at.
+func DecodeEnvelope(body string) (*Envelope, error) {
+	if !strings.HasPrefix(strings.TrimSpace(body), "{") {
+		return &Envelope{Version: 0, Text: body}, nil
+	}
+
+	var probe struct {
+		Version *int `json:"v"`
+	}
+	if err := json.Unmarshal([]byte(body), &probe); err != nil || probe.Version == nil || *probe.Version < 1 {
+		return &Envelope{Version: 0, Text: body}, nil
+	}
+	if *probe.Version > ENVELOPE_VERSION {
+		return nil, &UnsupportedVersionError{Version: *probe.Version}
+	}
+
+	envelope := &Envelope{}
+	if err := json.Unmarshal([]byte(body), envelope); err != nil {
+		return nil, fmt.Errorf("Malformed version %d message envelope: %s", *probe.Version, err)
+	}
+	return envelope, nil
+}
+
+// Post builds the post to publish for this envelope. defaultKey is used as the
+// post's key if the envelope doesn't carry an idempotency key of its own.
+func (this *Envelope) Post(defaultKey string) *Post {
+	key := this.IdempotencyKey
+	if key == "" {
+		key = defaultKey
+	}
+	return &Post{
+		Key:       key,
+		Text:      this.Text,
+		InReplyTo: this.ReplyTo,
+		Account:   this.Account,
+		Tags:      this.Tags,
+		Thread:    this.Thread,
+	}
+}
+
+// EncodeEnvelopes encodes each envelope, in order.
+func EncodeEnvelopes(envelopes []*Envelope) ([]string, error) {
+	bodies := make([]string, len(envelopes))
+	for i, envelope := range envelopes {
+		body, err := envelope.Encode()
+		if err != nil {
+			return nil, err
+		}
+		bodies[i] = body
+	}
+	return bodies, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecodeEnvelope(t *testing.T) {
+	testTables := []struct {
+		body            string
+		shouldError     bool
+		expectedVersion int
+		expectedText    string
+	}{
+		{body: "just a legacy tweet", expectedVersion: 0, expectedText: "just a legacy tweet"},
+		{body: "{not json at all", expectedVersion: 0, expectedText: "{not json at all"},
+		{body: `{"text": "json, but not an envelope"}`, expectedVersion: 0, expectedText: `{"text": "json, but not an envelope"}`},
+		{body: `{"v": 1, "text": "hello", "reply_to": "123"}`, expectedVersion: 1, expectedText: "hello"},
+		{body: `{"v": 99, "text": "from the future"}`, shouldError: true},
+		{body: `{"v": 1, "text": 5}`, shouldError: true},
+	}
+
+	for _, test := range testTables {
+		envelope, err := DecodeEnvelope(test.body)
+		if test.shouldError {
+			if err == nil {
+				t.Errorf("Expected an error decoding %s but got none.", test.body)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error decoding %s but got %s.", test.body, err)
+			continue
+		}
+		if envelope.Version != test.expectedVersion || envelope.Text != test.expectedText {
+			t.Errorf("Decoding %s: expected version %d and text %q, but got %+v.", test.body, test.expectedVersion, test.expectedText, envelope)
+		}
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	notBefore := time.Date(2020, 2, 3, 9, 0, 0, 0, time.UTC)
+	envelope := NewEnvelope("hello")
+	envelope.ReplyTo = "123"
+	envelope.Account = "main"
+	envelope.NotBefore = &notBefore
+	envelope.Tags = []string{"launch"}
+	envelope.Media = []*MediaRef{{Source: "s3://bucket/cat.png", AltText: "a cat"}}
+
+	body, err := envelope.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeEnvelope(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Text != "hello" || decoded.ReplyTo != "123" || decoded.Account != "main" ||
+		!decoded.NotBefore.Equal(notBefore) || len(decoded.Tags) != 1 || len(decoded.Media) != 1 {
+		t.Errorf("Envelope did not survive a round trip: %s", body)
+	}
+
+	post := decoded.Post("message-id")
+	if post.Key != "message-id" || post.InReplyTo != "123" {
+		t.Errorf("Unexpected post: %+v", post)
+	}
+	decoded.IdempotencyKey = "idem"
+	if decoded.Post("message-id").Key != "idem" {
+		t.Errorf("Expected the idempotency key to take precedence over the message ID.")
+	}
+}
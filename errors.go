@@ -5,3 +5,26 @@ import (
 )
 
 func NoLoggerInContext() error { return errors.New("No logger found in context.") }
+
+// PermanentError marks a failure that retrying will never fix, such as a tweet
+// that Twitter rejects for being too long or a duplicate.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// Permanent wraps err in a PermanentError. It returns nil if err is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err, or any error it wraps, is a PermanentError.
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
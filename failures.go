@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// FailureRecord is a single entry in the failure journal: one failed attempt
+// to post one message.
+type FailureRecord struct {
+	ID            int        `json:"id"`
+	MessageID     string     `json:"message_id"`
+	Group         string     `json:"group,omitempty"`
+	Body          string     `json:"body"`
+	SentTimestamp string     `json:"sent_timestamp,omitempty"`
+	Error         string     `json:"error"`
+	Attempts      int        `json:"attempts"`
+	FailedAt      time.Time  `json:"failed_at"`
+	ReplayedAt    *time.Time `json:"replayed_at,omitempty"`
+}
+
+// FailureJournal is a durable, local record of every message whose post
+// failed, so that the text is never lost even if the message later expires
+// from the queue.
+//
+// The journal is a file of JSON-encoded FailureRecords, one per line.
+type FailureJournal struct {
+	filename string
+	lock     sync.Mutex
+	// The ID of the next record, or 0 until the journal has been read.
+	nextID int
+}
+
+func NewFailureJournal(filename string) (*FailureJournal, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	return &FailureJournal{filename: filename}, nil
+}
+
+// Record appends a failure for message to the journal.
+func (this *FailureJournal) Record(message *sqs.Message, reason error) (*FailureRecord, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.nextID == 0 {
+		records, err := this.read()
+		if err != nil {
+			return nil, err
+		}
+		this.nextID = len(records) + 1
+	}
+
+	record := &FailureRecord{
+		ID:       this.nextID,
+		Error:    reason.Error(),
+		Attempts: 1,
+		FailedAt: time.Now().UTC(),
+	}
+	if message.MessageId != nil {
+		record.MessageID = *message.MessageId
+	}
+	if message.Body != nil {
+		record.Body = *message.Body
+	}
+	if group, ok := message.Attributes["MessageGroupId"]; ok && group != nil {
+		record.Group = *group
+	}
+	if sentTimestamp, ok := message.Attributes["SentTimestamp"]; ok && sentTimestamp != nil {
+		record.SentTimestamp = *sentTimestamp
+	}
+	if receiveCount, ok := message.Attributes["ApproximateReceiveCount"]; ok && receiveCount != nil {
+		if attempts, err := strconv.Atoi(*receiveCount); err == nil {
+			record.Attempts = attempts
+		}
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := appendLine(this.filename, line); err != nil {
+		return nil, err
+	}
+	this.nextID++
+	return record, nil
+}
+
+// List returns every record in the journal, oldest first.
+func (this *FailureJournal) List() ([]*FailureRecord, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.read()
+}
+
+// MarkReplayed stamps the records with the given IDs as replayed, so that
+// they aren't accidentally re-enqueued twice.
+func (this *FailureJournal) MarkReplayed(ids []int) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	records, err := this.read()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, id := range ids {
+		if id < 1 || id > len(records) {
+			return fmt.Errorf("No failure with id %d.", id)
+		}
+		records[id-1].ReplayedAt = &now
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomically(this.filename, buf.Bytes())
+}
+
+func (this *FailureJournal) read() ([]*FailureRecord, error) {
+	file, err := os.Open(this.filename)
+	if os.IsNotExist(err) {
+		return []*FailureRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := make([]*FailureRecord, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := &FailureRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", this.filename, line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// ListFailures prints the journal, optionally including entries that have
+// already been replayed.
+func ListFailures(ctx context.Context, journal *FailureJournal, includeReplayed bool) error {
+	logger, ok := ctx.Value(STSContextKey("logger")).(*log.Logger)
+	if !ok {
+		return NoLoggerInContext()
+	}
+
+	records, err := journal.List()
+	if err != nil {
+		return err
+	}
+
+	shown := 0
+	for _, record := range records {
+		if record.ReplayedAt != nil && !includeReplayed {
+			continue
+		}
+		shown++
+
+		status := "pending"
+		if record.ReplayedAt != nil {
+			status = "replayed at " + record.ReplayedAt.Format(time.RFC3339)
+		}
+		fmt.Printf(
+			"[%d] %s (message %s, group %q, attempts: %d, %s)\n    error: %s\n    %s\n",
+			record.ID,
+			record.FailedAt.Format(time.RFC3339),
+			record.MessageID,
+			record.Group,
+			record.Attempts,
+			status,
+			record.Error,
+			record.Body,
+		)
+	}
+	logger.Printf("Listed %d of %d failures in %s.\n", shown, len(records), journal.filename)
+	return nil
+}
+
+// ReplayFailures re-enqueues the selected journal entries. Each entry goes
+// back to its original message group, unless group is non-empty, in which
+// case everything is sent to that group instead.
+func ReplayFailures(ctx context.Context, journal *FailureJournal, sqsAPI SQS, ids []int, group string) error {
+	logger, ok := ctx.Value(STSContextKey("logger")).(*log.Logger)
+	if !ok {
+		return NoLoggerInContext()
+	}
+
+	records, err := journal.List()
+	if err != nil {
+		return err
+	}
+
+	selected := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if id < 1 || id > len(records) {
+			return fmt.Errorf("No failure with id %d.", id)
+		}
+		selected[id] = true
+	}
+
+	// Preserve journal order within each group, so its tweets go out in the
+	// order they were first enqueued.
+	groups := make([]string, 0)
+	bodiesByGroup := make(map[string][]string)
+	idsByGroup := make(map[string][]int)
+	for _, record := range records {
+		if !selected[record.ID] {
+			continue
+		}
+		if record.ReplayedAt != nil {
+			logger.Printf("Failure %d was already replayed at %s. Replaying it again.\n", record.ID, record.ReplayedAt.Format(time.RFC3339))
+		}
+
+		recordGroup := group
+		if recordGroup == "" {
+			recordGroup = record.Group
+		}
+		if recordGroup == "" {
+			return fmt.Errorf("Failure %d has no message group recorded. Pass --user to choose one.", record.ID)
+		}
+		if _, ok := bodiesByGroup[recordGroup]; !ok {
+			groups = append(groups, recordGroup)
+		}
+		bodiesByGroup[recordGroup] = append(bodiesByGroup[recordGroup], record.Body)
+		idsByGroup[recordGroup] = append(idsByGroup[recordGroup], record.ID)
+	}
+
+	// Every replay is a new attempt, so it mustn't be deduplicated against
+	// the original, or an earlier replay.
+	replayedAt := time.Now().UnixNano()
+	for _, g := range groups {
+		logger.Printf("Replaying %d failures to group %s.\n", len(bodiesByGroup[g]), g)
+		dedupIDs := make([]string, 0, len(idsByGroup[g]))
+		for _, id := range idsByGroup[g] {
+			dedupIDs = append(dedupIDs, fmt.Sprintf("replay-%d-%d", id, replayedAt))
+		}
+		result, err := sqsAPI.SendAll(ctx, bodiesByGroup[g], dedupIDs, g)
+		if result == nil {
+			return err
+		}
+		// Only mark what actually made it back onto the queue, so the rest
+		// can be replayed again.
+		replayed := make([]int, 0, len(result.Enqueued))
+		for _, i := range result.Enqueued {
+			replayed = append(replayed, idsByGroup[g][i])
+		}
+		if markErr := journal.MarkReplayed(replayed); markErr != nil {
+			return markErr
+		}
+		for _, i := range result.FailedIndexes() {
+			logger.Printf("Failure %d was not replayed: %s\n", idsByGroup[g][i], result.Failed[i])
+		}
+		if err != nil {
+			return err
+		}
+		if err := result.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
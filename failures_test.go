@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestFailureJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sts-failures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	journal, err := NewFailureJournal(filepath.Join(dir, "nested", "failures.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := []*sqs.Message{
+		{
+			MessageId: aws.String("a"),
+			Body:      aws.String("first"),
+			Attributes: map[string]*string{
+				"MessageGroupId":          aws.String("alice"),
+				"ApproximateReceiveCount": aws.String("3"),
+			},
+		},
+		{
+			MessageId:  aws.String("b"),
+			Body:       aws.String("second"),
+			Attributes: map[string]*string{"MessageGroupId": aws.String("bob")},
+		},
+	}
+	for _, message := range messages {
+		if _, err := journal.Record(message, errors.New("boom")); err != nil {
+			t.Fatalf("Expected no error recording a failure but got %s.", err)
+		}
+	}
+
+	records, err := journal.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records but got %d.", len(records))
+	}
+	if records[0].ID != 1 || records[0].Body != "first" || records[0].Attempts != 3 || records[0].Group != "alice" {
+		t.Errorf("Unexpected first record: %+v", records[0])
+	}
+	if records[1].ID != 2 || records[1].Attempts != 1 {
+		t.Errorf("Unexpected second record: %+v", records[1])
+	}
+
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+	sqsAPI := &FakeSQS{}
+	if err := ReplayFailures(ctx, journal, sqsAPI, []int{2}, ""); err != nil {
+		t.Fatalf("Expected no error replaying but got %s.", err)
+	}
+	if len(sqsAPI.sent["bob"]) != 1 || sqsAPI.sent["bob"][0] != "second" {
+		t.Errorf("Expected failure 2 to be replayed to its original group, but sent %v.", sqsAPI.sent)
+	}
+
+	records, err = journal.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[0].ReplayedAt != nil || records[1].ReplayedAt == nil {
+		t.Errorf("Expected only failure 2 to be marked replayed.")
+	}
+
+	if err := ReplayFailures(ctx, journal, sqsAPI, []int{3}, ""); err == nil {
+		t.Errorf("Expected an error replaying an unknown failure.")
+	}
+}
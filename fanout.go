@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DestinationConfig is one entry in a destinations file. Secrets are never
+// stored in the destinations file itself; they are read from files in
+// CredentialsDir, laid out the same way as the default .twitter, .mastodon and
+// .bluesky directories.
+type DestinationConfig struct {
+	Name    string `json:"name"`
+	Backend string `json:"backend"`
+	// Optional destinations are attempted, but a failure to publish to them
+	// doesn't hold up deleting the message.
+	Optional       bool   `json:"optional"`
+	CredentialsDir string `json:"credentials_dir"`
+	// Server is the Mastodon server, or the Bluesky PDS.
+	Server string `json:"server"`
+	// URL is where the webhook backend POSTs to.
+	URL string `json:"url"`
+}
+
+// Destination is a named, configured Publisher.
+type Destination struct {
+	name      string
+	publisher Publisher
+	required  bool
+}
+
+func readSecret(dir, name string) (string, error) {
+	bytes, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bytes)), nil
+}
+
+func newDestination(conf *DestinationConfig, baseDir string) (*Destination, error) {
+	if conf.Name == "" {
+		return nil, errors.New("Every destination needs a name.")
+	}
+
+	credentialsDir := conf.CredentialsDir
+	if credentialsDir != "" && !filepath.IsAbs(credentialsDir) {
+		credentialsDir = filepath.Join(baseDir, credentialsDir)
+	}
+
+	publisherConfig := &PublisherConfig{backend: conf.Backend}
+	var secrets map[string]*string
+	switch conf.Backend {
+	case BACKEND_TWITTER:
+		creds := &TwitterCreds{}
+		publisherConfig.twitter = creds
+		secrets = map[string]*string{
+			"key":             &creds.consumerKey,
+			"consumer-secret": &creds.consumerSecret,
+			"token":           &creds.accessToken,
+			"access-secret":   &creds.accessSecret,
+		}
+	case BACKEND_MASTODON:
+		publisherConfig.mastodon = &MastodonConfig{server: conf.Server}
+		secrets = map[string]*string{"token": &publisherConfig.mastodon.accessToken}
+	case BACKEND_BLUESKY:
+		publisherConfig.bluesky = &BlueskyConfig{host: conf.Server}
+		secrets = map[string]*string{
+			"handle":       &publisherConfig.bluesky.handle,
+			"app-password": &publisherConfig.bluesky.appPassword,
+		}
+	case BACKEND_WEBHOOK:
+		publisherConfig.webhook = &WebhookConfig{url: conf.URL}
+	}
+
+	for name, value := range secrets {
+		secret, err := readSecret(credentialsDir, name)
+		if err != nil {
+			return nil, fmt.Errorf("Reading credentials for destination %s: %s", conf.Name, err)
+		}
+		*value = secret
+	}
+
+	publisher, err := NewPublisher(publisherConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Destination %s: %s", conf.Name, err)
+	}
+	return &Destination{name: conf.Name, publisher: publisher, required: !conf.Optional}, nil
+}
+
+// LoadDestinations reads a JSON array of DestinationConfigs from filename.
+// Relative credentials directories are resolved against the directory the
+// file lives in.
+func LoadDestinations(filename string) ([]*Destination, error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make([]*DestinationConfig, 0)
+	if err := json.Unmarshal(bytes, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("%s does not define any destinations.", filename)
+	}
+
+	destinations := make([]*Destination, 0, len(configs))
+	seen := make(map[string]bool, len(configs))
+	required := 0
+	for _, conf := range configs {
+		if seen[conf.Name] {
+			return nil, fmt.Errorf("Destination %s is defined more than once.", conf.Name)
+		}
+		seen[conf.Name] = true
+
+		destination, err := newDestination(conf, filepath.Dir(filename))
+		if err != nil {
+			return nil, err
+		}
+		if destination.required {
+			required++
+		}
+		destinations = append(destinations, destination)
+	}
+	if required == 0 {
+		return nil, fmt.Errorf("%s needs at least one destination that isn't optional.", filename)
+	}
+	return destinations, nil
+}
+
+// DeliveryState remembers which destinations each in-progress post has
+// already been published to, keyed by Post.Key. It is persisted to a JSON file
+// after every change so that a restart doesn't re-publish to destinations that
+// have already succeeded.
+type DeliveryState struct {
+	filename string
+	lock     sync.Mutex
+	// post key -> destination name -> published ID
+	deliveries map[string]map[string]string
+}
+
+func NewDeliveryState(filename string) (*DeliveryState, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+
+	state := &DeliveryState{
+		filename:   filename,
+		deliveries: make(map[string]map[string]string),
+	}
+	bytes, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, &state.deliveries); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return state, nil
+}
+
+// Delivered returns the ID a post was published to destination with, if it
+// has been.
+func (this *DeliveryState) Delivered(key, destination string) (string, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	id, ok := this.deliveries[key][destination]
+	return id, ok
+}
+
+func (this *DeliveryState) MarkDelivered(key, destination, id string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, ok := this.deliveries[key]; !ok {
+		this.deliveries[key] = make(map[string]string)
+	}
+	this.deliveries[key][destination] = id
+	return this.save()
+}
+
+// Forget drops everything known about key, once the post is done with.
+func (this *DeliveryState) Forget(key string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, ok := this.deliveries[key]; !ok {
+		return nil
+	}
+	delete(this.deliveries, key)
+	return this.save()
+}
+
+func (this *DeliveryState) save() error {
+	bytes, err := json.Marshal(this.deliveries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(this.filename, bytes)
+}
+
+// FanOut is a Publisher that publishes each post to several destinations. A
+// publish only succeeds once every required destination has accepted the post.
+// If some fail, the error is returned so the message is retried, and the retry
+// only goes to the destinations that haven't succeeded yet.
+type FanOut struct {
+	destinations []*Destination
+	state        *DeliveryState
+}
+
+func NewFanOut(destinations []*Destination, state *DeliveryState) *FanOut {
+	return &FanOut{destinations: destinations, state: state}
+}
+
+func (this *FanOut) Publish(ctx context.Context, post *Post) (*PublishedPost, error) {
+	destinations := this.destinations
+	if post.Account != "" {
+		destinations = nil
+		for _, destination := range this.destinations {
+			if destination.name == post.Account {
+				destinations = []*Destination{destination}
+				break
+			}
+		}
+		if destinations == nil {
+			return nil, Permanent(fmt.Errorf("No destination named %q.", post.Account))
+		}
+	}
+
+	var result *PublishedPost
+	failures := make([]string, 0)
+	allPermanent := true
+
+	for _, destination := range destinations {
+		// A post addressed to one account must go there, even if that
+		// destination is otherwise optional.
+		required := destination.required || post.Account != ""
+
+		if post.Key != "" {
+			if id, ok := this.state.Delivered(post.Key, destination.name); ok {
+				log.Printf("[fanout]: Already published %s to %s as %s. Skipping.\n", post.Key, destination.name, id)
+				if result == nil && required {
+					result = &PublishedPost{ID: id, Text: post.Text}
+				}
+				continue
+			}
+		}
+
+		published, err := destination.publisher.Publish(ctx, post)
+		if err != nil {
+			log.Printf("[fanout]: Failed to publish to %s: %s\n", destination.name, err)
+			if !required {
+				continue
+			}
+			failures = append(failures, fmt.Sprintf("%s: %s", destination.name, err))
+			allPermanent = allPermanent && IsPermanent(err)
+			continue
+		}
+
+		if post.Key != "" {
+			if err := this.state.MarkDelivered(post.Key, destination.name, published.ID); err != nil {
+				// Carry on: the post did go out, and the worst case is
+				// publishing it to this destination again after a restart.
+				log.Printf("[fanout]: Could not record delivery to %s: %s\n", destination.name, err)
+			}
+		}
+		if result == nil && required {
+			result = published
+		}
+	}
+
+	if len(failures) > 0 {
+		err := fmt.Errorf("Failed to publish to %d required destination(s): %s", len(failures), strings.Join(failures, "; "))
+		if !allPermanent {
+			return nil, err
+		}
+		// Nothing will ever retry this post, so there's no point
+		// remembering where it did get delivered.
+		if post.Key != "" {
+			if err := this.state.Forget(post.Key); err != nil {
+				log.Printf("[fanout]: Could not clear delivery state for %s: %s\n", post.Key, err)
+			}
+		}
+		return nil, Permanent(err)
+	}
+
+	if post.Key != "" {
+		if err := this.state.Forget(post.Key); err != nil {
+			log.Printf("[fanout]: Could not clear delivery state for %s: %s\n", post.Key, err)
+		}
+	}
+	return result, nil
+}
+
+func (this *FanOut) Name() string {
+	names := make([]string, len(this.destinations))
+	for i, destination := range this.destinations {
+		names[i] = destination.name
+	}
+	return "fanout(" + strings.Join(names, ",") + ")"
+}
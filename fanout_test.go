@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// FlakyPublisher fails its first `failures` publishes, then succeeds.
+type FlakyPublisher struct {
+	FakePublisher
+	failures int
+	err      error
+	calls    int
+}
+
+func (this *FlakyPublisher) Publish(ctx context.Context, post *Post) (*PublishedPost, error) {
+	this.calls++
+	if this.calls <= this.failures {
+		return nil, this.err
+	}
+	return this.FakePublisher.Publish(ctx, post)
+}
+
+func TestFanOutRetriesOnlyFailedDestinations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sts-fanout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state, err := NewDeliveryState(filepath.Join(dir, "deliveries.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	primary := &FlakyPublisher{}
+	secondary := &FlakyPublisher{failures: 1, err: errors.New("timeout")}
+	optional := &FlakyPublisher{failures: 100, err: errors.New("down")}
+	fanOut := NewFanOut(
+		[]*Destination{
+			{name: "primary", publisher: primary, required: true},
+			{name: "secondary", publisher: secondary, required: true},
+			{name: "optional", publisher: optional, required: false},
+		},
+		state,
+	)
+
+	post := &Post{Key: "message-1", Text: "hello"}
+	if _, err := fanOut.Publish(context.Background(), post); err == nil {
+		t.Fatalf("Expected an error while a required destination is failing.")
+	} else if IsPermanent(err) {
+		t.Errorf("Expected a transient failure to be retryable, but got a permanent error.")
+	}
+
+	// Simulate a restart between attempts.
+	state, err = NewDeliveryState(filepath.Join(dir, "deliveries.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fanOut.state = state
+	if _, ok := state.Delivered("message-1", "primary"); !ok {
+		t.Errorf("Expected the delivery to primary to survive a restart.")
+	}
+
+	published, err := fanOut.Publish(context.Background(), post)
+	if err != nil {
+		t.Fatalf("Expected the retry to succeed but got %s.", err)
+	}
+	if published.ID != "1" {
+		t.Errorf("Expected the primary destination's ID but got %s.", published.ID)
+	}
+	if len(primary.posts) != 1 {
+		t.Errorf("Expected primary to be published to once, but it was published to %d times.", len(primary.posts))
+	}
+	if len(secondary.posts) != 1 {
+		t.Errorf("Expected secondary to be published to once, but it was published to %d times.", len(secondary.posts))
+	}
+	if _, ok := state.Delivered("message-1", "primary"); ok {
+		t.Errorf("Expected delivery state to be cleared once every required destination succeeded.")
+	}
+}
+
+func TestFanOutPermanentFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sts-fanout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state, err := NewDeliveryState(filepath.Join(dir, "deliveries.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fanOut := NewFanOut(
+		[]*Destination{
+			{name: "ok", publisher: &FakePublisher{}, required: true},
+			{name: "rejects", publisher: &FakePublisher{err: Permanent(errors.New("too long"))}, required: true},
+		},
+		state,
+	)
+
+	_, err = fanOut.Publish(context.Background(), &Post{Key: "message-1", Text: "hello"})
+	if !IsPermanent(err) {
+		t.Errorf("Expected a permanent error when every failing destination failed permanently, but got %v.", err)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const DEFAULT_FEED_TEMPLATE = "{{.Title}} {{.Link}}"
+
+// FeedItem is an entry from an RSS or Atom feed, as seen by tweet templates.
+type FeedItem struct {
+	GUID       string
+	Title      string
+	Link       string
+	Summary    string
+	Author     string
+	Categories []string
+	Published  time.Time
+}
+
+type rssDocument struct {
+	Channel struct {
+		Items []struct {
+			GUID        string   `xml:"guid"`
+			Title       string   `xml:"title"`
+			Link        string   `xml:"link"`
+			Description string   `xml:"description"`
+			Author      string   `xml:"author"`
+			Creator     string   `xml:"http://purl.org/dc/elements/1.1/ creator"`
+			Categories  []string `xml:"category"`
+			PubDate     string   `xml:"pubDate"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+type atomDocument struct {
+	Entries []struct {
+		ID    string `xml:"id"`
+		Title string `xml:"title"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Summary string `xml:"summary"`
+		Content string `xml:"content"`
+		Author  struct {
+			Name string `xml:"name"`
+		} `xml:"author"`
+		Categories []struct {
+			Term string `xml:"term,attr"`
+		} `xml:"category"`
+		Published string `xml:"published"`
+		Updated   string `xml:"updated"`
+	} `xml:"entry"`
+}
+
+// parseFeedTime accepts the date formats RSS and Atom feeds use in practice.
+// Unparseable dates come back as the zero time.
+func parseFeedTime(value string) time.Time {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{time.RFC3339, time.RFC1123Z, time.RFC1123, "Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parseFeed reads an RSS 2.0 or Atom feed, and returns its items oldest first.
+// Items without a GUID are identified by their link, or failing that, their
+// title.
+func parseFeed(data []byte) ([]*FeedItem, error) {
+	var root struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	items := []*FeedItem{}
+	switch root.XMLName.Local {
+	case "rss":
+		doc := &rssDocument{}
+		if err := xml.Unmarshal(data, doc); err != nil {
+			return nil, err
+		}
+		for _, entry := range doc.Channel.Items {
+			item := &FeedItem{
+				GUID:       strings.TrimSpace(entry.GUID),
+				Title:      strings.TrimSpace(entry.Title),
+				Link:       strings.TrimSpace(entry.Link),
+				Summary:    strings.TrimSpace(entry.Description),
+				Author:     strings.TrimSpace(entry.Author),
+				Categories: entry.Categories,
+				Published:  parseFeedTime(entry.PubDate),
+			}
+			if item.Author == "" {
+				item.Author = strings.TrimSpace(entry.Creator)
+			}
+			items = append(items, item)
+		}
+	case "feed":
+		doc := &atomDocument{}
+		if err := xml.Unmarshal(data, doc); err != nil {
+			return nil, err
+		}
+		for _, entry := range doc.Entries {
+			item := &FeedItem{
+				GUID:      strings.TrimSpace(entry.ID),
+				Title:     strings.TrimSpace(entry.Title),
+				Summary:   strings.TrimSpace(entry.Summary),
+				Author:    strings.TrimSpace(entry.Author.Name),
+				Published: parseFeedTime(entry.Published),
+			}
+			if item.Summary == "" {
+				item.Summary = strings.TrimSpace(entry.Content)
+			}
+			if item.Published.IsZero() {
+				item.Published = parseFeedTime(entry.Updated)
+			}
+			for _, link := range entry.Links {
+				if link.Rel == "" || link.Rel == "alternate" {
+					item.Link = strings.TrimSpace(link.Href)
+					break
+				}
+			}
+			for _, category := range entry.Categories {
+				item.Categories = append(item.Categories, category.Term)
+			}
+			items = append(items, item)
+		}
+	default:
+		return nil, fmt.Errorf("Expected an RSS or Atom feed, but the document is <%s>.", root.XMLName.Local)
+	}
+
+	for _, item := range items {
+		if item.GUID == "" {
+			item.GUID = item.Link
+		}
+		if item.GUID == "" {
+			item.GUID = item.Title
+		}
+	}
+	// Feeds usually list the newest items first, but post them in the order
+	// they were published.
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Published.Before(items[j].Published)
+	})
+	return items, nil
+}
+
+// FeedState remembers the GUIDs of the feed items that have been enqueued, so
+// that each is only tweeted once. It is persisted to a JSON file after every
+// change.
+type FeedState struct {
+	filename string
+	lock     sync.Mutex
+	// GUID -> when it was enqueued
+	seen map[string]time.Time
+	// Whether the feed has been checked before: the state is saved after
+	// the first check, even if the feed was empty.
+	checked bool
+}
+
+func NewFeedState(filename string) (*FeedState, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+
+	state := &FeedState{
+		filename: filename,
+		seen:     make(map[string]time.Time),
+	}
+	bytes, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, &state.seen); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	state.checked = true
+	return state, nil
+}
+
+// Checked reports whether the feed has been checked before.
+func (this *FeedState) Checked() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.checked
+}
+
+func (this *FeedState) Seen(guid string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	_, ok := this.seen[guid]
+	return ok
+}
+
+func (this *FeedState) MarkSeen(guids []string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if len(guids) == 0 && this.checked {
+		return nil
+	}
+	now := time.Now().UTC()
+	for _, guid := range guids {
+		this.seen[guid] = now
+	}
+
+	bytes, err := json.Marshal(this.seen)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(this.filename, bytes); err != nil {
+		return err
+	}
+	this.checked = true
+	return nil
+}
+
+// FeedTweetProvider turns the items of a feed that haven't been enqueued yet
+// into tweets, by rendering each through a template. Items only count as
+// enqueued once MarkEnqueued is called, so tweets that SendAll fails to
+// enqueue are retried on the next sync. So are items that render to a tweet
+// that's too long, until the template is fixed.
+type FeedTweetProvider struct {
+	httpClient *http.Client
+	url        string
+	template   *template.Template
+	state      *FeedState
+
+	// GUIDs of the items handled by the last call to All, including those
+	// skipped because they rendered to nothing.
+	pending []string
+	// GUID of the item behind each tweet returned by the last call to All.
+	tweetGUIDs []string
+	// GUIDs of the items the last call to All left out for being too long.
+	tooLong []string
+}
+
+func NewFeedTweetProvider(url, tweetTemplate string, state *FeedState) (*FeedTweetProvider, error) {
+	tmpl, err := template.New("tweet").Funcs(templateFuncs).Parse(tweetTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("Bad tweet template: %s", err)
+	}
+	return &FeedTweetProvider{
+		httpClient: newHTTPClient(),
+		url:        url,
+		template:   tmpl,
+		state:      state,
+	}, nil
+}
+
+func (this *FeedTweetProvider) fetch() ([]*FeedItem, error) {
+	resp, err := this.httpClient.Get(this.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, fmt.Errorf("%s: %s", this.url, err)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16*1024*1024))
+	if err != nil {
+		return nil, err
+	}
+	items, err := parseFeed(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", this.url, err)
+	}
+	return items, nil
+}
+
+func (this *FeedTweetProvider) All() ([]*Envelope, error) {
+	log.Printf("Fetching feed %s.\n", this.url)
+	items, err := this.fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	this.pending = nil
+	this.tweetGUIDs = nil
+	this.tooLong = nil
+	tweets := []*Envelope{}
+	for _, item := range items {
+		if this.state.Seen(item.GUID) {
+			continue
+		}
+		var text bytes.Buffer
+		if err := this.template.Execute(&text, item); err != nil {
+			return nil, fmt.Errorf("Could not render %s: %s", item.GUID, err)
+		}
+
+		tweet := NewEnvelope(strings.TrimSpace(text.String()))
+		if length := tweetLength(tweet.Text); length > MAX_TWEET_LENGTH {
+			// Leave it for the next sync rather than lose it. It's reported
+			// as a failure until the template shortens it.
+			log.Printf("[feed]: %s rendered to a tweet that is too long (length: %d; limit: %d): %s\n", item.GUID, length, MAX_TWEET_LENGTH, tweet.Text)
+			this.tooLong = append(this.tooLong, item.GUID)
+			continue
+		}
+		this.pending = append(this.pending, item.GUID)
+		if tweet.Text == "" {
+			log.Printf("[feed]: %s rendered to an empty tweet. Skipping it.\n", item.GUID)
+			continue
+		}
+		hash := sha256.Sum256([]byte(item.GUID))
+		tweet.IdempotencyKey = "feed-" + hex.EncodeToString(hash[:])[:32]
+		tweets = append(tweets, tweet)
+		this.tweetGUIDs = append(this.tweetGUIDs, item.GUID)
+	}
+	log.Printf("Found %d new items in %s.\n", len(this.pending), this.url)
+	return tweets, nil
+}
+
+// MarkEnqueued records the items handled by the last call to All as done,
+// apart from those whose tweets are in failed (by index), which are tried
+// again on the next sync.
+func (this *FeedTweetProvider) MarkEnqueued(failed map[int]string) error {
+	retry := make(map[string]bool, len(failed))
+	for i := range failed {
+		retry[this.tweetGUIDs[i]] = true
+	}
+	done := make([]string, 0, len(this.pending))
+	for _, guid := range this.pending {
+		if !retry[guid] {
+			done = append(done, guid)
+		}
+	}
+	err := this.state.MarkSeen(done)
+	if err == nil {
+		this.pending = nil
+		this.tweetGUIDs = nil
+	}
+	return err
+}
+
+// SkipAll records every item seen by the last call to All as done, without
+// enqueueing any of them.
+func (this *FeedTweetProvider) SkipAll() error {
+	err := this.state.MarkSeen(append(append([]string{}, this.pending...), this.tooLong...))
+	if err == nil {
+		this.pending = nil
+		this.tweetGUIDs = nil
+		this.tooLong = nil
+	}
+	return err
+}
+
+// TooLong is an error if the last call to All left out any items for being
+// too long, or nil.
+func (this *FeedTweetProvider) TooLong() error {
+	if len(this.tooLong) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d feed items rendered to tweets that are too long. Shorten them in the template, with truncate for example.", len(this.tooLong))
+}
+
+func (this *FeedTweetProvider) Name() string {
+	return this.url
+}
+
+// FeedSync enqueues the new items in a feed. With an interval of zero it syncs
+// once; otherwise it syncs every interval until ctx is cancelled, carrying on
+// through failures. If skipExisting is set and the feed has never been checked
+// before, the first successful sync only records what's already in the feed,
+// without enqueueing it.
+func FeedSync(ctx context.Context, sqs SQS, feed *FeedTweetProvider, username string, interval time.Duration, skipExisting bool) error {
+	logger, ok := ctx.Value(STSContextKey("logger")).(*log.Logger)
+	if !ok {
+		return NoLoggerInContext()
+	}
+
+	skipExisting = skipExisting && !feed.state.Checked()
+	syncOnce := func() error {
+		tweets, err := feed.All()
+		if err != nil {
+			return err
+		}
+		if skipExisting {
+			logger.Printf("[feed]: Skipping the %d items already in the feed.\n", len(feed.pending)+len(feed.tooLong))
+			if err := feed.SkipAll(); err != nil {
+				return err
+			}
+			skipExisting = false
+			return nil
+		}
+		if len(tweets) == 0 {
+			if err := feed.MarkEnqueued(nil); err != nil {
+				return err
+			}
+			return feed.TooLong()
+		}
+		bodies, err := EncodeEnvelopes(tweets)
+		if err != nil {
+			return err
+		}
+		result, err := sqs.SendAll(ctx, bodies, nil, username)
+		if result == nil {
+			return err
+		}
+		logger.Printf("[feed]: Enqueued %d of %d tweets.\n", len(result.Enqueued), len(tweets))
+		if markErr := feed.MarkEnqueued(result.Failed); markErr != nil {
+			return markErr
+		}
+		if err != nil {
+			return err
+		}
+		if err := result.Err(); err != nil {
+			return err
+		}
+		return feed.TooLong()
+	}
+
+	for {
+		err := syncOnce()
+		if interval == 0 {
+			return err
+		}
+		if err != nil {
+			logger.Printf("[feed]: Sync failed, trying again in %s: %s\n", interval, err)
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testRSS = `<?xml version="1.0"?>
+<rss version="2.0"><channel>
+  <item><title>Second</title><link>https://example.com/2</link><guid>2</guid><pubDate>Tue, 04 Feb 2020 09:00:00 +0000</pubDate></item>
+  <item><title>First</title><link>https://example.com/1</link><pubDate>Mon, 03 Feb 2020 09:00:00 +0000</pubDate></item>
+</channel></rss>`
+
+const testAtom = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <entry>
+    <id>urn:1</id><title>Atom entry</title>
+    <link rel="self" href="https://example.com/self"/>
+    <link href="https://example.com/atom"/>
+    <category term="news"/>
+    <updated>2020-02-03T09:00:00Z</updated>
+  </entry>
+</feed>`
+
+func TestParseFeed(t *testing.T) {
+	items, err := parseFeed([]byte(testRSS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Title != "First" || items[1].Title != "Second" {
+		t.Fatalf("Expected First then Second but got %+v.", items)
+	}
+	if items[0].GUID != "https://example.com/1" || items[1].GUID != "2" {
+		t.Errorf("Expected GUIDs https://example.com/1 and 2 but got %s and %s.", items[0].GUID, items[1].GUID)
+	}
+
+	items, err = parseFeed([]byte(testAtom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("Expected 1 item but got %d.", len(items))
+	}
+	item := items[0]
+	if item.GUID != "urn:1" || item.Link != "https://example.com/atom" || item.Published.IsZero() || len(item.Categories) != 1 {
+		t.Errorf("Expected the atom entry to be parsed but got %+v.", item)
+	}
+
+	if _, err := parseFeed([]byte("<html></html>")); err == nil {
+		t.Errorf("Expected an error parsing HTML but got none.")
+	}
+}
+
+func TestFeedSync(t *testing.T) {
+	feed := testRSS
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, feed)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sts-feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state, err := NewFeedState(filepath.Join(dir, "feed.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewFeedTweetProvider(server.URL, "{{.Title}}: {{.Link}}", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+	sqsAPI := &FakeSQS{}
+	if err := FeedSync(ctx, sqsAPI, provider, "me", 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(sqsAPI.sent["me"]) != 2 || !strings.Contains(sqsAPI.sent["me"][0], "First: https://example.com/1") {
+		t.Fatalf("Expected both items to be enqueued, oldest first, but got %q.", sqsAPI.sent["me"])
+	}
+
+	// A new item appears; only it should be enqueued, even after reloading
+	// the state.
+	feed = strings.Replace(testRSS, "<channel>", "<channel><item><title>Third</title><guid>3</guid></item>", 1)
+	state, err = NewFeedState(filepath.Join(dir, "feed.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.state = state
+	sqsAPI = &FakeSQS{}
+	if err := FeedSync(ctx, sqsAPI, provider, "me", 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(sqsAPI.sent["me"]) != 1 || !strings.Contains(sqsAPI.sent["me"][0], "Third") {
+		t.Errorf("Expected only the new item to be enqueued but got %q.", sqsAPI.sent["me"])
+	}
+}
+
+func TestFeedSyncSkipsExistingOnlyTheFirstTime(t *testing.T) {
+	feed := testRSS
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, feed)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sts-feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+
+	// Each sync is a fresh process, as when run from cron.
+	syncOnce := func() *FakeSQS {
+		state, err := NewFeedState(filepath.Join(dir, "feed.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		provider, err := NewFeedTweetProvider(server.URL, "{{.Title}}: {{.Link}}", state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sqsAPI := &FakeSQS{}
+		if err := FeedSync(ctx, sqsAPI, provider, "me", 0, true); err != nil {
+			t.Fatal(err)
+		}
+		return sqsAPI
+	}
+
+	if sqsAPI := syncOnce(); len(sqsAPI.sent["me"]) != 0 {
+		t.Errorf("Expected the existing items to be skipped but got %q.", sqsAPI.sent["me"])
+	}
+	feed = strings.Replace(testRSS, "<channel>", "<channel><item><title>Third</title><guid>3</guid></item>", 1)
+	if sqsAPI := syncOnce(); len(sqsAPI.sent["me"]) != 1 || !strings.Contains(sqsAPI.sent["me"][0], "Third") {
+		t.Errorf("Expected only the new item to be enqueued but got %q.", sqsAPI.sent["me"])
+	}
+}
+
+func TestFeedSyncKeepsItemsThatAreTooLong(t *testing.T) {
+	feed := strings.Replace(testRSS, "<title>Second</title>", "<title>"+strings.Repeat("a", MAX_TWEET_LENGTH)+"</title>", 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, feed)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sts-feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state, err := NewFeedState(filepath.Join(dir, "feed.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewFeedTweetProvider(server.URL, "{{.Title}}: {{.Link}}", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+	sqsAPI := &FakeSQS{}
+	if err := FeedSync(ctx, sqsAPI, provider, "me", 0, false); err == nil {
+		t.Errorf("Expected an error for the item that is too long but got none.")
+	}
+	if len(sqsAPI.sent["me"]) != 1 {
+		t.Errorf("Expected the other item to be enqueued but got %q.", sqsAPI.sent["me"])
+	}
+	if state.Seen("2") {
+		t.Errorf("Expected the item that is too long to be left for the next sync.")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// appendLine appends line, plus a trailing newline, to filename, creating it
+// if necessary. The write is synced to disk before returning, so callers can
+// safely discard their own copy of the data afterwards.
+func appendLine(filename string, line []byte) error {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeFileAtomically replaces the contents of filename with data by writing
+// to a temporary file alongside it and renaming that into place, so that a
+// crash halfway through can't leave a truncated file behind.
+func writeFileAtomically(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -7,5 +7,6 @@ require (
 	github.com/dghubble/go-twitter v0.0.0-20190719072343-39e5462e111f
 	github.com/dghubble/oauth1 v0.6.0
 	github.com/urfave/cli/v2 v2.1.1
-	golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5
+	golang.org/x/text v0.13.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// GroupConfig is one entry in a groups file. Groups are what batch-update
+// calls users: each batch is enqueued to the message group named by --user.
+type GroupConfig struct {
+	Group string `json:"group"`
+	// Weight is the group's share of posts relative to the others, when more
+	// than one has tweets waiting. Defaults to 1.
+	Weight int `json:"weight"`
+	// Account is the destination that the group's tweets are posted to,
+	// unless a tweet names one itself. Empty means every destination.
+	Account string `json:"account"`
+}
+
+// LoadGroups reads a JSON array of GroupConfigs from filename.
+func LoadGroups(filename string) ([]*GroupConfig, error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make([]*GroupConfig, 0)
+	if err := json.Unmarshal(bytes, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	seen := make(map[string]bool, len(configs))
+	for _, conf := range configs {
+		if conf.Group == "" {
+			return nil, fmt.Errorf("%s: Every group needs a name.", filename)
+		}
+		if seen[conf.Group] {
+			return nil, fmt.Errorf("%s: Group %s is defined more than once.", filename, conf.Group)
+		}
+		seen[conf.Group] = true
+		if conf.Weight < 0 {
+			return nil, fmt.Errorf("%s: Group %s has a negative weight.", filename, conf.Group)
+		}
+		if conf.Weight == 0 {
+			conf.Weight = 1
+		}
+	}
+	return configs, nil
+}
+
+// GroupScheduler decides which message group to post from next, so that one
+// big batch can't starve everyone else sharing the queue. It's a weighted fair
+// queue: every group has a virtual time that advances by 1/weight each time
+// it's served, and the ready group furthest behind goes next. Groups that had
+// nothing waiting don't build up credit while they were idle.
+type GroupScheduler struct {
+	lock    sync.Mutex
+	configs map[string]*GroupConfig
+	// group -> virtual time its next post starts at
+	next  map[string]float64
+	clock float64
+	// group -> how many posts it has been picked for
+	picked map[string]int
+	// group -> how many of its messages were waiting when it was last
+	// seen. Only counts what's been received, so at most the prefetch.
+	waiting map[string]int
+}
+
+func NewGroupScheduler(configs []*GroupConfig) *GroupScheduler {
+	scheduler := &GroupScheduler{
+		configs: make(map[string]*GroupConfig, len(configs)),
+		next:    make(map[string]float64),
+		picked:  make(map[string]int),
+		waiting: make(map[string]int),
+	}
+	for _, conf := range configs {
+		scheduler.configs[conf.Group] = conf
+	}
+	return scheduler
+}
+
+// Shared reports whether more than one group is configured, and so whether
+// there's any point picking between them. Otherwise, messages are posted in
+// the order they're received.
+func (this *GroupScheduler) Shared() bool {
+	return len(this.configs) > 1
+}
+
+func (this *GroupScheduler) weight(group string) int {
+	if conf, ok := this.configs[group]; ok && conf.Weight > 0 {
+		return conf.Weight
+	}
+	return 1
+}
+
+// Account is the destination to post the group's tweets to, or "" for all of
+// them.
+func (this *GroupScheduler) Account(group string) string {
+	if conf, ok := this.configs[group]; ok {
+		return conf.Account
+	}
+	return ""
+}
+
+// CheckAccounts makes sure every account the groups are routed to is one of
+// the named destinations. Without any destinations (a single --backend),
+// groups can't be routed at all.
+func (this *GroupScheduler) CheckAccounts(destinations []*Destination) error {
+	names := make(map[string]bool, len(destinations))
+	for _, destination := range destinations {
+		names[destination.name] = true
+	}
+	for _, conf := range this.configs {
+		if conf.Account == "" {
+			continue
+		}
+		if len(destinations) == 0 {
+			return fmt.Errorf("Group %s is routed to %s, which needs --destinations.", conf.Group, conf.Account)
+		}
+		if !names[conf.Account] {
+			return fmt.Errorf("Group %s is routed to %s, but there's no destination by that name.", conf.Group, conf.Account)
+		}
+	}
+	return nil
+}
+
+// Pick chooses which of the ready groups to post from next. Ties go to the
+// group that comes first in ready.
+func (this *GroupScheduler) Pick(ready []string) string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.pick(ready)
+}
+
+// PickWaiting is Pick, also recording how many messages each group has
+// waiting, for Describe.
+func (this *GroupScheduler) PickWaiting(ready []string, waiting map[string]int) string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.waiting = waiting
+	return this.pick(ready)
+}
+
+// pick must be called with the lock held.
+func (this *GroupScheduler) pick(ready []string) string {
+	if len(ready) == 0 {
+		return ""
+	}
+	best := ""
+	var bestStart float64
+	for i, group := range ready {
+		start := this.next[group]
+		if start < this.clock {
+			start = this.clock
+		}
+		if i == 0 || start < bestStart {
+			best = group
+			bestStart = start
+		}
+	}
+
+	this.clock = bestStart
+	this.next[best] = bestStart + 1/float64(this.weight(best))
+	this.picked[best]++
+	return best
+}
+
+// Describe summarises the ready groups for the log.
+func (this *GroupScheduler) Describe(ready []string) string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	sorted := append([]string{}, ready...)
+	sort.Strings(sorted)
+	parts := make([]string, len(sorted))
+	for i, group := range sorted {
+		parts[i] = fmt.Sprintf("%s (weight %d, %d waiting, posted %d)", group, this.weight(group), this.waiting[group], this.picked[group])
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestGroupSchedulerPick(t *testing.T) {
+	testTables := []struct {
+		configs  []*GroupConfig
+		rounds   [][]string
+		expected map[string]int
+	}{
+		{
+			// Equal weights alternate.
+			nil,
+			repeatRounds([]string{"alice", "bob"}, 10),
+			map[string]int{"alice": 5, "bob": 5},
+		},
+		{
+			// A weight of 2 gets twice the posts.
+			[]*GroupConfig{{Group: "alice", Weight: 2}},
+			repeatRounds([]string{"alice", "bob"}, 30),
+			map[string]int{"alice": 20, "bob": 10},
+		},
+		{
+			// Bob doesn't get to catch up on the turns he had nothing ready
+			// for.
+			nil,
+			append(repeatRounds([]string{"alice"}, 10), repeatRounds([]string{"alice", "bob"}, 4)...),
+			map[string]int{"alice": 12, "bob": 2},
+		},
+	}
+
+	for _, test := range testTables {
+		scheduler := NewGroupScheduler(test.configs)
+		picked := make(map[string]int)
+		for _, ready := range test.rounds {
+			picked[scheduler.Pick(ready)]++
+		}
+		for group, count := range test.expected {
+			if picked[group] != count {
+				t.Errorf("Expected %s to be picked %d times but got %d.", group, count, picked[group])
+			}
+		}
+	}
+}
+
+func repeatRounds(ready []string, n int) [][]string {
+	rounds := make([][]string, n)
+	for i := range rounds {
+		rounds[i] = ready
+	}
+	return rounds
+}
+
+func TestLoadGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sts-groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testTables := []struct {
+		contents    string
+		shouldError bool
+	}{
+		{`[{"group": "alice", "weight": 2, "account": "alice"}, {"group": "bob"}]`, false},
+		{`[{"group": "alice"}, {"group": "alice"}]`, true},
+		{`[{"weight": 2}]`, true},
+		{`[{"group": "alice", "weight": -1}]`, true},
+	}
+
+	for _, test := range testTables {
+		filename := filepath.Join(dir, "groups.json")
+		if err := ioutil.WriteFile(filename, []byte(test.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		configs, err := LoadGroups(filename)
+		if (err != nil) != test.shouldError {
+			t.Errorf("Expected error: %v for %s but got %v.", test.shouldError, test.contents, err)
+			continue
+		}
+		for _, conf := range configs {
+			if conf.Weight < 1 {
+				t.Errorf("Expected a default weight of 1 for %s but got %d.", conf.Group, conf.Weight)
+			}
+		}
+	}
+}
+
+func TestTweetPicksGroupAndRoutesAccount(t *testing.T) {
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+	message := func(group, text string) *sqs.Message {
+		return &sqs.Message{
+			MessageId:     aws.String(text),
+			Body:          aws.String(text),
+			ReceiptHandle: aws.String(text),
+			Attributes:    map[string]*string{"MessageGroupId": aws.String(group)},
+		}
+	}
+	scheduler := NewGroupScheduler([]*GroupConfig{{Group: "alice", Weight: 1}, {Group: "bob", Weight: 1, Account: "bob-account"}})
+	// Alice has already had a turn, so it's Bob's.
+	scheduler.Pick([]string{"alice"})
+
+	sqsAPI := &FakeSQS{queue: []*sqs.Message{message("alice", "from alice"), message("bob", "from bob")}}
+	publisher := &FakePublisher{}
+	if _, err := (&Service{groups: scheduler}).Tweet(ctx, publisher, sqsAPI); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(publisher.posts) != 1 || publisher.posts[0].Text != "from bob" {
+		t.Fatalf("Expected Bob's tweet to be posted but got %v.", publisher.posts)
+	}
+	if account := publisher.posts[0].Account; account != "bob-account" {
+		t.Errorf("Expected the post to go to bob-account but got %q.", account)
+	}
+	// Alice's tweet was never taken off the queue, so it needn't be put back.
+	if len(sqsAPI.visibilityChanges) != 0 {
+		t.Errorf("Expected no visibility changes but got %v.", sqsAPI.visibilityChanges)
+	}
+	if len(sqsAPI.queue) != 1 || aws.StringValue(sqsAPI.queue[0].Body) != "from alice" {
+		t.Errorf("Expected Alice's tweet to still be queued but got %v.", sqsAPI.queue)
+	}
+	if describe := scheduler.Describe([]string{"alice", "bob"}); describe != "alice (weight 1, 1 waiting, posted 1), bob (weight 1, 1 waiting, posted 1)" {
+		t.Errorf("Expected both groups to have 1 waiting but got %s.", describe)
+	}
+}
+
+func TestTweetDoesNotPickWithoutSharedGroups(t *testing.T) {
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+	message := &sqs.Message{
+		MessageId:     aws.String("hi"),
+		Body:          aws.String("hi"),
+		ReceiptHandle: aws.String("hi"),
+		Attributes:    map[string]*string{"MessageGroupId": aws.String("alice")},
+	}
+	scheduler := NewGroupScheduler([]*GroupConfig{{Group: "alice", Account: "alice-account"}})
+
+	sqsAPI := &FakeSQS{queue: []*sqs.Message{message}}
+	publisher := &FakePublisher{}
+	if _, err := (&Service{groups: scheduler}).Tweet(ctx, publisher, sqsAPI); err != nil {
+		t.Fatal(err)
+	}
+	if describe := scheduler.Describe([]string{"alice"}); describe != "alice (weight 1, 0 waiting, posted 0)" {
+		t.Errorf("Expected alice not to be picked but got %s.", describe)
+	}
+	if len(publisher.posts) != 1 || publisher.posts[0].Account != "alice-account" {
+		t.Errorf("Expected the post to go to alice-account but got %v.", publisher.posts)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// HistoryRecord is a single entry in the post history: one post that went
+// out.
+type HistoryRecord struct {
+	Text        string    `json:"text"`
+	Destination string    `json:"destination"`
+	PostID      string    `json:"post_id"`
+	PostedAt    time.Time `json:"posted_at"`
+}
+
+// PostHistory is a local record of everything the daemon has posted, so that
+// batches can be checked for tweets that already went out before they're
+// enqueued (Twitter rejects exact duplicates).
+//
+// The history is a file of JSON-encoded HistoryRecords, one per line.
+type PostHistory struct {
+	filename string
+	lock     sync.Mutex
+}
+
+func NewPostHistory(filename string) (*PostHistory, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	return &PostHistory{filename: filename}, nil
+}
+
+func (this *PostHistory) Record(text, destination, postID string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	line, err := json.Marshal(&HistoryRecord{
+		Text:        text,
+		Destination: destination,
+		PostID:      postID,
+		PostedAt:    time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return appendLine(this.filename, line)
+}
+
+// Posted returns the normalized text of everything in the history.
+func (this *PostHistory) Posted() (map[string]bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	posted := make(map[string]bool)
+	file, err := os.Open(this.filename)
+	if os.IsNotExist(err) {
+		return posted, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := &HistoryRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", this.filename, line, err)
+		}
+		posted[normalizeText(record.Text)] = true
+	}
+	return posted, scanner.Err()
+}
+
+// normalizeText reduces text to the form used to compare tweets for
+// duplicates: NFC-normalized, with runs of whitespace collapsed.
+func normalizeText(text string) string {
+	return strings.Join(strings.Fields(norm.NFC.String(text)), " ")
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// The most keys DynamoDB accepts in one BatchGetItem, and the most items in
+// one BatchWriteItem.
+const (
+	DYNAMODB_MAX_BATCH_GET   = 100
+	DYNAMODB_MAX_BATCH_WRITE = 25
+)
+
+// How long to wait before asking DynamoDB again for what it left unprocessed.
+var dynamoDBRetrier = &ExponentialRetrier{
+	initialDelayMillis: 100,
+	maxDelayMillis:     5000,
+	maxAttempts:        8,
+	description:        "finish a DynamoDB batch request",
+}
+
+// LedgerEntry is a tweet that batch-update enqueued, identified by its
+// deduplication ID.
+type LedgerEntry struct {
+	DedupID string `json:"dedup_id"`
+	Group   string `json:"group"`
+	Text    string `json:"text"`
+	// The ID of the thread the tweet was enqueued in, if any, so that the
+	// rest of the thread can be enqueued under the same ID later.
+	ThreadID   string    `json:"thread_id,omitempty"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+}
+
+// EnqueueLedger remembers which tweets have been enqueued, for longer than
+// SQS's five minute deduplication window, so that re-running a batch only
+// enqueues what didn't make it the first time.
+type EnqueueLedger interface {
+	// Enqueued returns the entries recorded for any of dedupIDs, by
+	// deduplication ID.
+	Enqueued(dedupIDs []string) (map[string]*LedgerEntry, error)
+	Record(entries []*LedgerEntry) error
+	Name() string
+}
+
+// FileLedger is an EnqueueLedger kept in a local file of JSON-encoded
+// LedgerEntries, one per line.
+type FileLedger struct {
+	filename string
+	lock     sync.Mutex
+}
+
+func NewFileLedger(filename string) (*FileLedger, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	return &FileLedger{filename: filename}, nil
+}
+
+func (this *FileLedger) Enqueued(dedupIDs []string) (map[string]*LedgerEntry, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	wanted := make(map[string]bool, len(dedupIDs))
+	for _, id := range dedupIDs {
+		wanted[id] = true
+	}
+	enqueued := make(map[string]*LedgerEntry)
+	file, err := os.Open(this.filename)
+	if os.IsNotExist(err) {
+		return enqueued, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		entry := &LedgerEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", this.filename, line, err)
+		}
+		if wanted[entry.DedupID] {
+			enqueued[entry.DedupID] = entry
+		}
+	}
+	return enqueued, scanner.Err()
+}
+
+func (this *FileLedger) Record(entries []*LedgerEntry) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := appendLine(this.filename, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *FileLedger) Name() string {
+	return this.filename
+}
+
+// DynamoDBLedger is an EnqueueLedger kept in a DynamoDB table, so it can be
+// shared by everyone enqueueing to the same queue. The table's partition key
+// must be a string attribute named dedup_id.
+type DynamoDBLedger struct {
+	dynamoDB dynamodbiface.DynamoDBAPI
+	table    string
+}
+
+func NewDynamoDBLedger(table, region string) *DynamoDBLedger {
+	sess := session.Must(session.NewSession())
+	return &DynamoDBLedger{
+		dynamoDB: dynamodb.New(sess, &aws.Config{Region: aws.String(region)}),
+		table:    table,
+	}
+}
+
+func (this *DynamoDBLedger) Enqueued(dedupIDs []string) (map[string]*LedgerEntry, error) {
+	enqueued := make(map[string]*LedgerEntry)
+	for start := 0; start < len(dedupIDs); start += DYNAMODB_MAX_BATCH_GET {
+		end := start + DYNAMODB_MAX_BATCH_GET
+		if end > len(dedupIDs) {
+			end = len(dedupIDs)
+		}
+		keys := make([]map[string]*dynamodb.AttributeValue, 0, end-start)
+		for _, id := range dedupIDs[start:end] {
+			keys = append(keys, map[string]*dynamodb.AttributeValue{
+				"dedup_id": {S: aws.String(id)},
+			})
+		}
+
+		request := map[string]*dynamodb.KeysAndAttributes{
+			this.table: {Keys: keys, ProjectionExpression: aws.String("dedup_id, thread_id")},
+		}
+		// DynamoDB may not get through every key at once. Ask again for the
+		// ones it left.
+		for attempt := 0; len(request) > 0; attempt++ {
+			if attempt >= dynamoDBRetrier.MaxAttempts() {
+				return nil, fmt.Errorf("DynamoDB left keys in %s unprocessed after %d attempts.", this.table, attempt)
+			}
+			if attempt > 0 {
+				time.Sleep(time.Duration(dynamoDBRetrier.NextDelayMillis(attempt-1)) * time.Millisecond)
+			}
+			output, err := this.dynamoDB.BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: request})
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range output.Responses[this.table] {
+				id, ok := item["dedup_id"]
+				if !ok {
+					continue
+				}
+				entry := &LedgerEntry{DedupID: aws.StringValue(id.S)}
+				if threadID, ok := item["thread_id"]; ok {
+					entry.ThreadID = aws.StringValue(threadID.S)
+				}
+				enqueued[entry.DedupID] = entry
+			}
+			request = output.UnprocessedKeys
+		}
+	}
+	return enqueued, nil
+}
+
+func (this *DynamoDBLedger) Record(entries []*LedgerEntry) error {
+	for start := 0; start < len(entries); start += DYNAMODB_MAX_BATCH_WRITE {
+		end := start + DYNAMODB_MAX_BATCH_WRITE
+		if end > len(entries) {
+			end = len(entries)
+		}
+		writes := make([]*dynamodb.WriteRequest, 0, end-start)
+		for _, entry := range entries[start:end] {
+			writes = append(writes, &dynamodb.WriteRequest{
+				PutRequest: &dynamodb.PutRequest{
+					Item: map[string]*dynamodb.AttributeValue{
+						"dedup_id":    {S: aws.String(entry.DedupID)},
+						"group":       {S: aws.String(entry.Group)},
+						"text":        {S: aws.String(entry.Text)},
+						"enqueued_at": {S: aws.String(entry.EnqueuedAt.Format(time.RFC3339))},
+					},
+				},
+			})
+			if entry.ThreadID != "" {
+				writes[len(writes)-1].PutRequest.Item["thread_id"] = &dynamodb.AttributeValue{S: aws.String(entry.ThreadID)}
+			}
+		}
+
+		request := map[string][]*dynamodb.WriteRequest{this.table: writes}
+		for attempt := 0; len(request) > 0; attempt++ {
+			if attempt >= dynamoDBRetrier.MaxAttempts() {
+				return fmt.Errorf("DynamoDB left writes to %s unprocessed after %d attempts.", this.table, attempt)
+			}
+			if attempt > 0 {
+				time.Sleep(time.Duration(dynamoDBRetrier.NextDelayMillis(attempt-1)) * time.Millisecond)
+			}
+			output, err := this.dynamoDB.BatchWriteItem(&dynamodb.BatchWriteItemInput{RequestItems: request})
+			if err != nil {
+				return err
+			}
+			request = output.UnprocessedItems
+		}
+	}
+	return nil
+}
+
+func (this *DynamoDBLedger) Name() string {
+	return "dynamodb:" + this.table
+}
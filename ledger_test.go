@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// FakeDynamoDB stores items by dedup_id, and leaves the last key of every
+// request unprocessed the first time it sees it.
+type FakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	items    map[string]map[string]*dynamodb.AttributeValue
+	deferred map[string]bool
+}
+
+func (this *FakeDynamoDB) deferOnce(id string) bool {
+	if this.deferred == nil {
+		this.deferred = make(map[string]bool)
+	}
+	if this.deferred[id] {
+		return false
+	}
+	this.deferred[id] = true
+	return true
+}
+
+func (this *FakeDynamoDB) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	output := &dynamodb.BatchGetItemOutput{Responses: make(map[string][]map[string]*dynamodb.AttributeValue)}
+	for table, request := range input.RequestItems {
+		for i, key := range request.Keys {
+			id := aws.StringValue(key["dedup_id"].S)
+			if i == len(request.Keys)-1 && this.deferOnce("get-"+id) {
+				output.UnprocessedKeys = map[string]*dynamodb.KeysAndAttributes{table: {Keys: request.Keys[i:]}}
+				break
+			}
+			if item, ok := this.items[id]; ok {
+				output.Responses[table] = append(output.Responses[table], item)
+			}
+		}
+	}
+	return output, nil
+}
+
+func (this *FakeDynamoDB) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	if this.items == nil {
+		this.items = make(map[string]map[string]*dynamodb.AttributeValue)
+	}
+	output := &dynamodb.BatchWriteItemOutput{}
+	for table, writes := range input.RequestItems {
+		for i, write := range writes {
+			id := aws.StringValue(write.PutRequest.Item["dedup_id"].S)
+			if i == len(writes)-1 && this.deferOnce("put-"+id) {
+				output.UnprocessedItems = map[string][]*dynamodb.WriteRequest{table: writes[i:]}
+				break
+			}
+			this.items[id] = write.PutRequest.Item
+		}
+	}
+	return output, nil
+}
+
+func TestLedgers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sts-ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileLedger, err := NewFileLedger(filepath.Join(dir, ".sts", "ledger.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledgers := []EnqueueLedger{
+		fileLedger,
+		&DynamoDBLedger{dynamoDB: &FakeDynamoDB{}, table: "ledger"},
+	}
+
+	now := time.Now().UTC()
+	for _, ledger := range ledgers {
+		enqueued, err := ledger.Enqueued([]string{"a", "b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(enqueued) != 0 {
+			t.Errorf("Expected an empty ledger but got %v from %s.", enqueued, ledger.Name())
+		}
+
+		entries := []*LedgerEntry{
+			{DedupID: "a", Group: "me", Text: "first", EnqueuedAt: now},
+			{DedupID: "c", Group: "me", Text: "third", ThreadID: "launch-1", EnqueuedAt: now},
+		}
+		if err := ledger.Record(entries); err != nil {
+			t.Fatal(err)
+		}
+
+		enqueued, err = ledger.Enqueued([]string{"a", "b", "c"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		threadIDs := make(map[string]string)
+		for id, entry := range enqueued {
+			threadIDs[id] = entry.ThreadID
+		}
+		if expected := map[string]string{"a": "", "c": "launch-1"}; !reflect.DeepEqual(threadIDs, expected) {
+			t.Errorf("Expected %v but got %v from %s.", expected, threadIDs, ledger.Name())
+		}
+	}
+}
+
+func TestBatchUpdateSkipsEnqueuedTweets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sts-ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ledger, err := NewFileLedger(filepath.Join(dir, "ledger.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+	args := &BatchUpdateArgs{user: "me", ledger: ledger}
+
+	args.tweetSource = &FakeTweetProvider{tweets: []*Envelope{NewEnvelope("one"), NewEnvelope("two")}}
+	if err := BatchUpdate(ctx, &FakeSQS{}, NewMediaLoader("", ""), args); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same tweets again, give or take some whitespace, plus a new one.
+	fakeSQS := &FakeSQS{}
+	args.tweetSource = &FakeTweetProvider{tweets: []*Envelope{NewEnvelope("one "), NewEnvelope("two"), NewEnvelope("three")}}
+	if err := BatchUpdate(ctx, fakeSQS, NewMediaLoader("", ""), args); err != nil {
+		t.Fatal(err)
+	}
+	if len(fakeSQS.sent["me"]) != 1 {
+		t.Fatalf("Expected 1 tweet to be sent but got %v.", fakeSQS.sent["me"])
+	}
+	if tweet, err := DecodeEnvelope(fakeSQS.sent["me"][0]); err != nil || tweet.Text != "three" {
+		t.Errorf("Expected \"three\" to be sent but got %v (%v).", fakeSQS.sent["me"][0], err)
+	}
+}
+
+func TestBatchUpdateFinishesThreadsUnderTheirOldID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sts-ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ledger, err := NewFileLedger(filepath.Join(dir, "ledger.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+	args := &BatchUpdateArgs{user: "me", ledger: ledger}
+	thread := func() []*Envelope {
+		tweets := []*Envelope{NewEnvelope("one"), NewEnvelope("two")}
+		if err := assignThreads(tweets, []string{"launch", "launch"}); err != nil {
+			t.Fatal(err)
+		}
+		return tweets
+	}
+
+	// The second part doesn't make it the first time.
+	first := thread()
+	second, err := first[1].Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	args.tweetSource = &FakeTweetProvider{tweets: first}
+	if err := BatchUpdate(ctx, &FakeSQS{rejectSend: map[string]string{second: "ServiceUnavailable: slow down"}}, NewMediaLoader("", ""), args); err == nil {
+		t.Fatal("Expected an error but got none.")
+	}
+
+	fakeSQS := &FakeSQS{}
+	args.tweetSource = &FakeTweetProvider{tweets: thread()}
+	if err := BatchUpdate(ctx, fakeSQS, NewMediaLoader("", ""), args); err != nil {
+		t.Fatal(err)
+	}
+	if len(fakeSQS.sent["me"]) != 1 {
+		t.Fatalf("Expected 1 tweet to be sent but got %v.", fakeSQS.sent["me"])
+	}
+	tweet, err := DecodeEnvelope(fakeSQS.sent["me"][0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tweet.Text != "two" || tweet.Thread.ID != first[0].Thread.ID || tweet.Thread.Index != 1 {
+		t.Errorf("Expected part 2 of thread %s but got %v.", first[0].Thread.ID, tweet)
+	}
+}
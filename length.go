@@ -0,0 +1,191 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Twitter doesn't count characters, it weighs them: most Latin-script
+// characters (and some punctuation) weigh 1, everything else, including CJK
+// and emoji, weighs 2, and a tweet may weigh at most 280. This follows the v3
+// configuration of twitter-text, which is what the API enforces.
+const (
+	MAX_TWEET_LENGTH = 280
+
+	TWEET_LENGTH_SCALE          = 100
+	TWEET_LENGTH_DEFAULT_WEIGHT = 200
+	// Every URL is shortened to a t.co link, whatever its actual length.
+	TWEET_LENGTH_URL_LENGTH = 23
+)
+
+type weightedRange struct {
+	start, end rune
+	weight     int
+}
+
+var tweetLengthRanges = []weightedRange{
+	{0, 4351, 100},
+	{8192, 8205, 100},
+	{8208, 8223, 100},
+	{8242, 8247, 100},
+}
+
+// Twitter links URLs with a scheme, as well as bare domains under the common
+// top-level domains. Trailing punctuation is left out of the link.
+var tweetURLPattern = regexp.MustCompile(
+	`(?i)\b(?:https?://[^\s<>"]+|(?:www\.)?(?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+(?:com|org|net|io|co|dev|app|ly|me|edu|gov|info|biz|us|uk|ca|de|fr|jp)\b(?:/[^\s<>"]*)?)`,
+)
+
+func findURLs(text string) [][]int {
+	spans := tweetURLPattern.FindAllStringIndex(text, -1)
+	for _, span := range spans {
+		for span[1] > span[0] && strings.ContainsRune(`.,;:!?'")]`, rune(text[span[1]-1])) {
+			span[1]--
+		}
+	}
+	return spans
+}
+
+// tweetLength returns the length Twitter will count text as.
+func tweetLength(text string) int {
+	text = norm.NFC.String(text)
+	urls := findURLs(text)
+
+	weighted := 0
+	for i := 0; i < len(text); {
+		if len(urls) > 0 && i == urls[0][0] {
+			weighted += TWEET_LENGTH_URL_LENGTH * TWEET_LENGTH_SCALE
+			i = urls[0][1]
+			urls = urls[1:]
+			continue
+		}
+		if n := emojiLength(text[i:]); n > 0 {
+			// An emoji counts the same however many code points it takes.
+			weighted += TWEET_LENGTH_DEFAULT_WEIGHT
+			i += n
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(text[i:])
+		weighted += runeWeight(r)
+		i += size
+	}
+	return weighted / TWEET_LENGTH_SCALE
+}
+
+func runeWeight(r rune) int {
+	for _, weighted := range tweetLengthRanges {
+		if r >= weighted.start && r <= weighted.end {
+			return weighted.weight
+		}
+	}
+	return TWEET_LENGTH_DEFAULT_WEIGHT
+}
+
+func isEmojiBase(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF:
+		return true
+	case r >= 0x2300 && r <= 0x23FF, r >= 0x2600 && r <= 0x27BF, r >= 0x2B00 && r <= 0x2BFF:
+		return true
+	}
+	return false
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// isEmojiModifier reports whether r attaches to the emoji before it: variation
+// selectors, skin tones, the keycap mark, and tag characters.
+func isEmojiModifier(r rune) bool {
+	switch {
+	case r == 0xFE0F, r == 0x20E3:
+		return true
+	case r >= 0x1F3FB && r <= 0x1F3FF:
+		return true
+	case r >= 0xE0020 && r <= 0xE007F:
+		return true
+	}
+	return false
+}
+
+// emojiLength returns the number of bytes taken by the emoji that text starts
+// with, including any modifiers and zero-width-joined parts, or 0 if text
+// doesn't start with one.
+func emojiLength(text string) int {
+	r, size := utf8.DecodeRuneInString(text)
+	switch {
+	case isRegionalIndicator(r):
+		// Flags are pairs of regional indicators.
+		if next, nextSize := utf8.DecodeRuneInString(text[size:]); isRegionalIndicator(next) {
+			return size + nextSize
+		}
+		return size
+	case strings.ContainsRune("0123456789#*", r):
+		// Keycaps are only emoji with the keycap mark.
+		rest := text[size:]
+		if strings.HasPrefix(rest, "\uFE0F") {
+			rest = rest[len("\uFE0F"):]
+		}
+		if !strings.HasPrefix(rest, "\u20E3") {
+			return 0
+		}
+		return len(text) - len(rest) + len("\u20E3")
+	case r == 0xA9 || r == 0xAE:
+		// © and ® are only emoji with the emoji variation selector.
+		if !strings.HasPrefix(text[size:], "\uFE0F") {
+			return 0
+		}
+	case !isEmojiBase(r):
+		return 0
+	}
+
+	i := size
+	for i < len(text) {
+		next, nextSize := utf8.DecodeRuneInString(text[i:])
+		if isEmojiModifier(next) {
+			i += nextSize
+			continue
+		}
+		if next == 0x200D {
+			joined, joinedSize := utf8.DecodeRuneInString(text[i+nextSize:])
+			if isEmojiBase(joined) {
+				i += nextSize + joinedSize
+				continue
+			}
+		}
+		break
+	}
+	return i
+}
+
+// truncateTweet shortens text to at most limit, as counted by tweetLength,
+// ending it with an ellipsis if anything had to be cut. It cuts between words
+// where it can.
+func truncateTweet(limit int, text string) string {
+	text = strings.TrimSpace(text)
+	if tweetLength(text) <= limit {
+		return text
+	}
+
+	const ellipsis = "…"
+	fits := 0
+	fitsAtSpace := 0
+	for i, r := range text {
+		if tweetLength(text[:i]+ellipsis) > limit {
+			break
+		}
+		fits = i
+		if unicode.IsSpace(r) {
+			fitsAtSpace = i
+		}
+	}
+	if fitsAtSpace > 0 {
+		fits = fitsAtSpace
+	}
+	return strings.TrimSpace(text[:fits]) + ellipsis
+}
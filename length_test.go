@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTweetLength(t *testing.T) {
+	testTables := []struct {
+		text     string
+		expected int
+	}{
+		{text: "", expected: 0},
+		{text: "hello world", expected: 11},
+		{text: "héllo", expected: 5},
+		// Decomposed, this is six code points; normalized, it's five.
+		{text: "he\u0301llo", expected: 5},
+		{text: "こんにちは", expected: 10},
+		{text: "hi 👋", expected: 5},
+		{text: "👍🏽", expected: 2},
+		{text: "👩\u200D👩\u200D👧\u200D👦", expected: 2},
+		{text: "🇺🇸", expected: 2},
+		{text: "#\uFE0F\u20E3 1", expected: 4},
+		{text: "see https://example.com/" + strings.Repeat("a", 100), expected: 4 + TWEET_LENGTH_URL_LENGTH},
+		{text: "see example.com.", expected: 4 + TWEET_LENGTH_URL_LENGTH + 1},
+		{text: strings.Repeat("a", MAX_TWEET_LENGTH), expected: MAX_TWEET_LENGTH},
+	}
+
+	for _, test := range testTables {
+		length := tweetLength(test.text)
+		if length != test.expected {
+			t.Errorf("Expected %q to have length %d but got %d.", test.text, test.expected, length)
+		}
+	}
+}
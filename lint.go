@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+const (
+	LINT_ERROR   = "error"
+	LINT_WARNING = "warning"
+)
+
+var errLintFailed = errors.New("lint found problems that would stop tweets from being posted")
+
+// LintIssue is one problem with one tweet. Errors are problems that would get
+// the tweet rejected; warnings are things that are probably mistakes. Problems
+// with entries that never became tweets have an Index of -1, and a Location
+// instead.
+type LintIssue struct {
+	Index    int    `json:"index"`
+	Location string `json:"location,omitempty"`
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	Message  string `json:"message"`
+	Text     string `json:"text"`
+}
+
+type LintReport struct {
+	Source string       `json:"source"`
+	Tweets int          `json:"tweets"`
+	Errors int          `json:"errors"`
+	Issues []*LintIssue `json:"issues"`
+}
+
+// Lint checks every tweet in tweetSource without enqueueing anything, and
+// reports the problems it finds, either as text or as JSON. history may be nil,
+// in which case tweets aren't checked against what's already been posted. It
+// returns an error if any problem would stop a tweet from being posted. format
+// must be the one tweetSource parses with.
+func Lint(ctx context.Context, tweetSource TweetProvider, format *TweetFormat, history *PostHistory, asJSON bool) error {
+	logger, ok := ctx.Value(STSContextKey("logger")).(*log.Logger)
+	if !ok {
+		return NoLoggerInContext()
+	}
+	tweets, err := tweetSource.All()
+	if err != nil {
+		return err
+	}
+
+	posted := map[string]bool{}
+	if history != nil {
+		posted, err = history.Posted()
+		if err != nil {
+			return err
+		}
+	}
+
+	report := &LintReport{
+		Source: tweetSource.Name(),
+		Tweets: len(tweets),
+		Issues: append(lintEmptyEntries(format.EmptyEntries()), lintTweets(tweets, format.delimiter, posted)...),
+	}
+	for _, issue := range report.Issues {
+		if issue.Severity == LINT_ERROR {
+			report.Errors++
+		}
+	}
+
+	if asJSON {
+		bytes, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+	} else {
+		for _, issue := range report.Issues {
+			where := fmt.Sprint(issue.Index)
+			if issue.Location != "" {
+				where = issue.Location
+			}
+			fmt.Printf("[%s] %s: %s (%s)\n    %s\n", where, issue.Severity, issue.Message, issue.Check, issue.Text)
+		}
+		logger.Printf("Checked %d tweets in %s; found %d problems, %d of them errors.\n", report.Tweets, report.Source, len(report.Issues), report.Errors)
+	}
+
+	if report.Errors > 0 {
+		return errLintFailed
+	}
+	return nil
+}
+
+// lintEmptyEntries warns about each empty entry, at the locations the format
+// found them. They're skipped rather than rejected, but two delimiters in a row
+// usually mean a tweet was deleted or pasted in the wrong place.
+func lintEmptyEntries(locations []string) []*LintIssue {
+	issues := []*LintIssue{}
+	for _, location := range locations {
+		issues = append(issues, &LintIssue{
+			Index:    -1,
+			Location: location,
+			Severity: LINT_WARNING,
+			Check:    "empty",
+			Message:  "Entry is empty, so it will be skipped.",
+		})
+	}
+	return issues
+}
+
+func lintTweets(tweets []*Envelope, delimiter string, posted map[string]bool) []*LintIssue {
+	issues := []*LintIssue{}
+	report := func(i int, severity, check, format string, args ...interface{}) {
+		issues = append(issues, &LintIssue{
+			Index:    i,
+			Severity: severity,
+			Check:    check,
+			Message:  fmt.Sprintf(format, args...),
+			Text:     tweets[i].Text,
+		})
+	}
+
+	seen := make(map[string]int)
+	for i, tweet := range tweets {
+		// Providers skip or reject entries with neither text nor media, so
+		// this is a media-only tweet, with no text to check.
+		text := normalizeText(tweet.Text)
+		if text == "" {
+			continue
+		}
+
+		if length := tweetLength(tweet.Text); length > MAX_TWEET_LENGTH {
+			report(i, LINT_ERROR, "length", "Tweet is too long (length: %d; limit: %d).", length, MAX_TWEET_LENGTH)
+		}
+		if first, ok := seen[text]; ok {
+			report(i, LINT_ERROR, "duplicate", "Tweet is the same as tweet %d.", first)
+		} else {
+			seen[text] = i
+		}
+		if posted[text] {
+			report(i, LINT_ERROR, "history", "Tweet has already been posted.")
+		}
+
+		for _, word := range strings.Fields(tweet.Text) {
+			if problem := checkURL(word); problem != "" {
+				report(i, LINT_ERROR, "url", "%q is not a valid URL: %s", word, problem)
+			}
+			if problem := checkEntity(word); problem != "" {
+				report(i, LINT_WARNING, "entity", "%q %s", word, problem)
+			}
+		}
+
+		if line := delimiterArtifact(tweet.Text, delimiter); line != "" {
+			report(i, LINT_WARNING, "delimiter", "Line %q looks like part of a delimiter.", line)
+		}
+	}
+	return issues
+}
+
+// checkURL returns what's wrong with word, if it's meant to be a URL.
+func checkURL(word string) string {
+	word = strings.TrimRight(word, `.,;:!?'")]`)
+	lower := strings.ToLower(word)
+	if !strings.Contains(lower, "://") && !strings.HasPrefix(lower, "www.") && !strings.HasPrefix(lower, "http:") && !strings.HasPrefix(lower, "https:") {
+		return ""
+	}
+	if strings.HasPrefix(lower, "www.") {
+		word = "https://" + word
+	}
+
+	u, err := url.Parse(word)
+	if err != nil {
+		return err.Error()
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Sprintf("scheme %q won't be linked", u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return "it has no host"
+	}
+	if !strings.Contains(host, ".") || strings.HasPrefix(host, ".") || strings.HasSuffix(host, ".") || strings.Contains(host, "..") {
+		return fmt.Sprintf("host %q isn't a domain name", host)
+	}
+	return ""
+}
+
+// checkEntity returns what's wrong with word, if it's meant to be a mention or
+// a hashtag.
+func checkEntity(word string) string {
+	if !strings.HasPrefix(word, "@") && !strings.HasPrefix(word, "#") {
+		return ""
+	}
+	kind := "mention"
+	if word[0] == '#' {
+		kind = "hashtag"
+	}
+
+	// Only the leading run of word characters gets linked; "@someone's" is
+	// still a mention of @someone.
+	name := []rune{}
+	for _, r := range word[1:] {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			break
+		}
+		name = append(name, r)
+	}
+	if len(name) == 0 {
+		return fmt.Sprintf("is a %s without a name.", kind)
+	}
+	if kind == "hashtag" && strings.TrimFunc(string(name), unicode.IsDigit) == "" {
+		return "won't be linked as a hashtag: hashtags can't be all digits."
+	}
+	return ""
+}
+
+// delimiterArtifact returns the first line of text that is made up only of
+// characters from the delimiter, which usually means a delimiter was mistyped
+// and two tweets ran together.
+func delimiterArtifact(text, delimiter string) string {
+	delimiter = strings.TrimSpace(delimiter)
+	if delimiter == "" {
+		return ""
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < 3 {
+			continue
+		}
+		if strings.Trim(line, delimiter) == "" {
+			return line
+		}
+	}
+	return ""
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLintTweets(t *testing.T) {
+	testTables := []struct {
+		text     string
+		media    bool
+		expected []string
+	}{
+		{text: "all good @someone #tag https://example.com/path.", expected: []string{}},
+		{text: "@someone's tweet", expected: []string{}},
+		{text: "", media: true, expected: []string{}},
+		{text: strings.Repeat("a", MAX_TWEET_LENGTH+1), expected: []string{"length"}},
+		{text: "already posted", expected: []string{"history"}},
+		{text: "see htps://example.com", expected: []string{"url"}},
+		{text: "see https://example", expected: []string{"url"}},
+		{text: "see www..com", expected: []string{"url"}},
+		{text: "hi @ there", expected: []string{"entity"}},
+		{text: "#2020 was a year", expected: []string{"entity"}},
+		{text: "one\n=========\ntwo", expected: []string{"delimiter"}},
+	}
+
+	for _, test := range testTables {
+		envelope := NewEnvelope(test.text)
+		if test.media {
+			envelope.Media = []*MediaRef{{Source: "a.png"}}
+		}
+		issues := lintTweets([]*Envelope{envelope}, "====================\n", map[string]bool{"already posted": true})
+		checks := []string{}
+		for _, issue := range issues {
+			checks = append(checks, issue.Check)
+		}
+		if strings.Join(checks, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Expected %q to fail %v but got %v.", test.text, test.expected, checks)
+		}
+	}
+}
+
+func TestLintTweetsFindsDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sts-lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	history, err := NewPostHistory(filepath.Join(dir, "history.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := history.Record("went  out\nalready", "twitter", "1"); err != nil {
+		t.Fatal(err)
+	}
+	posted, err := history.Posted()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tweets := []*Envelope{NewEnvelope("hello"), NewEnvelope("hello "), NewEnvelope("went out already")}
+	issues := lintTweets(tweets, "", posted)
+	if len(issues) != 2 {
+		t.Fatalf("Expected 2 issues but got %d.", len(issues))
+	}
+	if issues[0].Check != "duplicate" || issues[0].Index != 1 {
+		t.Errorf("Expected tweet 1 to be a duplicate but got %+v.", issues[0])
+	}
+	if issues[1].Check != "history" || issues[1].Index != 2 {
+		t.Errorf("Expected tweet 2 to already be posted but got %+v.", issues[1])
+	}
+}
+
+func TestLintReportsEmptyEntries(t *testing.T) {
+	testTables := []struct {
+		format   string
+		input    string
+		expected []string
+	}{
+		{format: FORMAT_DELIMITED, input: "one\n---\ntwo\n---\n", expected: []string{}},
+		{format: FORMAT_DELIMITED, input: "one\n---\n---\ntwo\n", expected: []string{"test:3"}},
+		{format: FORMAT_DELIMITED, input: "one\n---\n  \n---\ntwo\n", expected: []string{"test:4"}},
+		{format: FORMAT_MARKDOWN, input: "one\n---\n---\ntwo\n", expected: []string{"test:3"}},
+		{format: FORMAT_MARKDOWN, input: "one\n---\n## Later\n---\ntwo\n", expected: []string{}},
+		{format: FORMAT_MARKDOWN, input: "- one\n\n- two\n", expected: []string{}},
+	}
+
+	for _, test := range testTables {
+		format, err := NewTweetFormat(test.format, "", "---\n", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := format.Parse(strings.NewReader(test.input), "test"); err != nil {
+			t.Errorf("Expected no error parsing %q but got %s.", test.input, err)
+			continue
+		}
+		locations := []string{}
+		for _, issue := range lintEmptyEntries(format.EmptyEntries()) {
+			if issue.Check != "empty" || issue.Severity != LINT_WARNING {
+				t.Errorf("Expected an empty entry warning but got %+v.", issue)
+			}
+			locations = append(locations, issue.Location)
+		}
+		if strings.Join(locations, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Expected empty entries in %q at %v but got %v.", test.input, test.expected, locations)
+		}
+	}
+}
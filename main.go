@@ -4,7 +4,9 @@ import (
 	"context"
 	"log"
 	"os"
+	"os/signal"
 	"path"
+	"syscall"
 
 	"github.com/urfave/cli/v2"
 )
@@ -20,6 +22,27 @@ func getLogger() *log.Logger {
 	return logger
 }
 
+// withShutdownSignals returns a copy of ctx that is cancelled the first time
+// the process receives SIGINT or SIGTERM. A second signal is left to the
+// default handler, so an impatient operator can still kill the process.
+func withShutdownSignals(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			log.Printf("Received %s. Shutting down once in-flight work is done.\n", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
 func main() {
 	workDir, err := os.Getwd()
 	if err != nil {
@@ -64,11 +87,104 @@ func main() {
 						Usage:    "",
 						FilePath: path.Join(workDir, ".twitter", "access-secret"),
 					},
+					&cli.StringFlag{
+						Name:  "backend",
+						Usage: "Where to publish tweets: twitter, mastodon, bluesky, or webhook.",
+						Value: BACKEND_TWITTER,
+					},
+					&cli.StringFlag{
+						Name:  "mastodon-server",
+						Usage: "Base URL of the Mastodon-compatible server, e.g. https://mastodon.social.",
+					},
+					&cli.StringFlag{
+						Name:     "mastodon-token",
+						Usage:    "",
+						FilePath: path.Join(workDir, ".mastodon", "token"),
+					},
+					&cli.StringFlag{
+						Name:  "bluesky-host",
+						Usage: "Base URL of the Bluesky PDS.",
+						Value: DEFAULT_BLUESKY_HOST,
+					},
+					&cli.StringFlag{
+						Name:     "bluesky-handle",
+						Usage:    "",
+						FilePath: path.Join(workDir, ".bluesky", "handle"),
+					},
+					&cli.StringFlag{
+						Name:     "bluesky-app-password",
+						Usage:    "",
+						FilePath: path.Join(workDir, ".bluesky", "app-password"),
+					},
+					&cli.StringFlag{
+						Name:  "webhook-url",
+						Usage: "URL to POST tweets to when using the webhook backend.",
+					},
+					&cli.StringFlag{
+						Name:  "destinations",
+						Usage: "JSON file listing several destinations to publish every tweet to, instead of a single --backend.",
+					},
+					&cli.StringFlag{
+						Name:  "groups",
+						Usage: "JSON file giving each message group (batch-update --user) a weight, and optionally the destination its tweets go to. With more than one group, the next message of each group is received before picking which one to post. Unpicked messages are received again about once per tweet, which counts towards a redrive policy's maxReceiveCount.",
+					},
+					&cli.StringFlag{
+						Name:  "delivery-state",
+						Usage: "Local file tracking which destinations each tweet has been published to.",
+						Value: path.Join(workDir, ".sts", "deliveries.json"),
+					},
+					&cli.StringFlag{
+						Name:  "thread-state",
+						Usage: "Local file tracking the last posted tweet of each thread.",
+						Value: path.Join(workDir, ".sts", "threads.json"),
+					},
+					&cli.IntFlag{
+						Name:  "wait-time",
+						Usage: "How long (in seconds, up to 20) to wait for a message to arrive when the queue is empty.",
+						Value: MAX_WAIT_TIME,
+					},
+					&cli.IntFlag{
+						Name:  "prefetch",
+						Usage: "How many messages (up to 10) to receive from the queue at once. Messages that aren't posted within half the visibility timeout are released and received again, which counts towards a redrive policy, so only raise this when tweets go out faster than that.",
+						Value: 1,
+					},
+					&cli.IntFlag{
+						Name:  "visibility-timeout",
+						Usage: "How long (in seconds) a received message stays hidden from other receivers. It's extended for as long as the message is being worked on. 0 means the queue's own visibility timeout.",
+						Value: DEFAULT_VISIBILITY_TIMEOUT,
+					},
 					&cli.IntFlag{
 						Name:  "calibration-rate",
 						Usage: "How often (in seconds), to update tweeting rate.",
 						Value: 600,
 					},
+					&cli.BoolFlag{
+						Name:  "skip-queue-age",
+						Usage: "Don't look up how long the oldest message has been waiting (from the queue's ApproximateAgeOfOldestMessage metric in CloudWatch) when calibrating. Every message is assumed to have the whole retention period left.",
+					},
+					&cli.StringFlag{
+						Name:  "dead-letter-queue",
+						Usage: "SQS queue (in the same region) to move permanently rejected tweets to.",
+					},
+					&cli.StringFlag{
+						Name:  "dead-letter-file",
+						Usage: "Local file to append permanently rejected tweets to, one JSON object per line.",
+					},
+					&cli.StringFlag{
+						Name:  "failure-journal",
+						Usage: "Local file to record every failed post in.",
+						Value: path.Join(workDir, ".sts", "failures.jsonl"),
+					},
+					&cli.StringFlag{
+						Name:  "history-file",
+						Usage: "Local file to record every successful post in. The lint command checks batches against it for duplicates.",
+						Value: path.Join(workDir, ".sts", "history.jsonl"),
+					},
+					&cli.StringFlag{
+						Name:  "media-dir",
+						Usage: "Directory that relative media paths are resolved against.",
+						Value: workDir,
+					},
 				},
 				Action: func(c *cli.Context) error {
 					args, err := ParseRunArgs(c)
@@ -79,16 +195,77 @@ func main() {
 
 					log.Println("Initializing API components.")
 
-					twitter := NewTwitter(args.twitter)
+					threads, err := NewThreadState(args.threadState)
+					if err != nil {
+						return err
+					}
+
+					var groupConfigs []*GroupConfig
+					if args.groups != "" {
+						groupConfigs, err = LoadGroups(args.groups)
+						if err != nil {
+							return err
+						}
+					}
+					groups := NewGroupScheduler(groupConfigs)
+
+					var publisher Publisher
+					if args.destinations != "" {
+						destinations, err := LoadDestinations(args.destinations)
+						if err != nil {
+							return err
+						}
+						if err := groups.CheckAccounts(destinations); err != nil {
+							return err
+						}
+						for _, destination := range destinations {
+							destination.publisher = NewThreader(destination.publisher, destination.name, threads)
+						}
+						state, err := NewDeliveryState(args.deliveryState)
+						if err != nil {
+							return err
+						}
+						publisher = NewFanOut(destinations, state)
+					} else {
+						if err := groups.CheckAccounts(nil); err != nil {
+							return err
+						}
+						single, err := NewPublisher(args.publisher)
+						if err != nil {
+							return err
+						}
+						publisher = NewThreader(single, single.Name(), threads)
+					}
 					sqs, err := NewSQS(args.sqs)
 					if err != nil {
 						return err
 					}
+					defer sqs.Close()
+					retention, err := queueRetention(sqs)
+					if err != nil {
+						return err
+					}
+					if err := threads.Prune(retention); err != nil {
+						return err
+					}
+					deadLetters, err := NewDeadLetterQueue(args.deadLetter)
+					if err != nil {
+						return err
+					}
+					failures, err := NewFailureJournal(args.failureJournal)
+					if err != nil {
+						return err
+					}
+					history, err := NewPostHistory(args.historyFile)
+					if err != nil {
+						return err
+					}
 
 					log.Println("Running forever ....")
 
-					ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
-					return NewService(args).RunForever(ctx, twitter, sqs)
+					ctx, cancel := withShutdownSignals(context.WithValue(context.Background(), STSContextKey("logger"), getLogger()))
+					defer cancel()
+					return NewService(args, deadLetters, failures, history, groups).RunForever(ctx, publisher, sqs)
 				},
 			},
 			{
@@ -103,13 +280,49 @@ func main() {
 					&cli.StringFlag{
 						Name:     "file",
 						Aliases:  []string{"f"},
+						Usage:    "Where to read tweets from: a local path, - for stdin, an s3://bucket/key URL, or an http(s):// URL.",
 						Required: true,
 					},
 					&cli.StringFlag{
 						Name:    "delimiter",
 						Aliases: []string{"d"},
+						Usage:   "Line that separates tweets in the delimited format.",
 						Value:   "====================\n",
 					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Format of --file: delimited, csv, jsonl, yaml, or markdown. By default, this is worked out from the file extension.",
+						Value: FORMAT_AUTO,
+					},
+					&cli.StringSliceFlag{
+						Name:  "column",
+						Usage: "For CSV files, a <field>=<column header> mapping, e.g. text=Copy. By default each field is read from the column of the same name.",
+					},
+					&cli.StringFlag{
+						Name:  "media-dir",
+						Usage: "Directory that relative media paths are resolved against. Should match the daemon's --media-dir.",
+						Value: workDir,
+					},
+					&cli.StringFlag{
+						Name:  "data",
+						Usage: "CSV or JSON file of rows to fill the tweets in with. Each tweet, directives included, is treated as a Go template, and rendered once per row.",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Check the batch and show the messages that would be sent, without sending them.",
+					},
+					&cli.StringFlag{
+						Name:  "ledger-file",
+						Usage: "Local file recording what has been enqueued, so that re-running a batch skips the tweets that already made it. Without this or --ledger-table, every tweet is enqueued.",
+					},
+					&cli.StringFlag{
+						Name:  "ledger-table",
+						Usage: "DynamoDB table (in the same region) to record what has been enqueued in, instead of --ledger-file. Its partition key must be a string named dedup_id.",
+					},
+					&cli.BoolFlag{
+						Name:  "split-long",
+						Usage: "Split tweets that are too long into a numbered thread, instead of rejecting the batch.",
+					},
 					&cli.StringFlag{
 						Name:     "region",
 						Aliases:  []string{"r"},
@@ -135,18 +348,164 @@ func main() {
 						return err
 					}
 
-					tweetSource := &FileTweetProvider{
-						filename:  args.filename,
-						delimiter: args.delimiter,
+					if args.dryRun {
+						sqs = NewDryRunSQS(sqs)
 					}
+
 					ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
-					return BatchUpdate(ctx, sqs, tweetSource, args.user)
+					media := NewMediaLoader(args.mediaDir, args.sqs.region)
+					return BatchUpdate(ctx, sqs, media, args)
+				},
+			},
+			{
+				Name:  "lint",
+				Usage: "Check a batch of tweets without adding them to the queue.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "file",
+						Aliases:  []string{"f"},
+						Usage:    "Where to read tweets from: a local path, - for stdin, an s3://bucket/key URL, or an http(s):// URL.",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "delimiter",
+						Aliases: []string{"d"},
+						Usage:   "Line that separates tweets in the delimited format.",
+						Value:   "====================\n",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Format of --file: delimited, csv, jsonl, yaml, or markdown. By default, this is worked out from the file extension.",
+						Value: FORMAT_AUTO,
+					},
+					&cli.StringSliceFlag{
+						Name:  "column",
+						Usage: "For CSV files, a <field>=<column header> mapping, e.g. text=Copy. By default each field is read from the column of the same name.",
+					},
+					&cli.StringFlag{
+						Name:  "history-file",
+						Usage: "The daemon's --history-file. Tweets that have already been posted are reported as duplicates.",
+						Value: path.Join(workDir, ".sts", "history.jsonl"),
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the report as JSON.",
+					},
+					&cli.StringFlag{
+						Name:    "region",
+						Aliases: []string{"r"},
+						Usage:   "AWS region of the bucket, if --file is an s3:// URL.",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					args, err := ParseLintArgs(c)
+					if err != nil {
+						return err
+					}
+
+					history, err := NewPostHistory(args.historyFile)
+					if err != nil {
+						return err
+					}
+
+					ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+					return Lint(ctx, args.tweetSource, args.format, history, args.asJSON)
+				},
+			},
+			{
+				Name:  "feed-sync",
+				Usage: "Add new items from an RSS or Atom feed to the queue.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "url",
+						Usage:    "URL of the feed.",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "template",
+						Usage: "Go template each feed item is rendered through to make its tweet. Items have .Title, .Link, .Summary, .Author, .Categories and .Published.",
+						Value: DEFAULT_FEED_TEMPLATE,
+					},
+					&cli.StringFlag{
+						Name:  "state",
+						Usage: "Local file that records which feed items have been enqueued.",
+						Value: path.Join(workDir, ".sts", "feed.json"),
+					},
+					&cli.DurationFlag{
+						Name:  "interval",
+						Usage: "How often to check the feed. By default, it's checked once.",
+					},
+					&cli.BoolFlag{
+						Name:  "skip-existing",
+						Usage: "Don't enqueue the items already in the feed the first time it's checked, only ones added after that.",
+					},
+					&cli.StringFlag{
+						Name:     "user",
+						Aliases:  []string{"u"},
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "region",
+						Aliases:  []string{"r"},
+						Usage:    "",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "queue",
+						Aliases:  []string{"q"},
+						Usage:    "",
+						Required: true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					args, err := ParseFeedSyncArgs(c)
+					if err != nil {
+						return err
+					}
+
+					state, err := NewFeedState(args.state)
+					if err != nil {
+						return err
+					}
+					feed, err := NewFeedTweetProvider(args.url, args.template, state)
+					if err != nil {
+						return err
+					}
+
+					log.Println("Initializing API components.")
+					sqs, err := NewSQS(args.sqs)
+					if err != nil {
+						return err
+					}
+
+					ctx, cancel := withShutdownSignals(context.WithValue(context.Background(), STSContextKey("logger"), getLogger()))
+					defer cancel()
+					return FeedSync(ctx, sqs, feed, args.user, args.interval, args.skipExisting)
 				},
 			},
 			{
 				Name:  "purge",
 				Usage: "Delete messages from the queue.",
 				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Show which messages would be deleted, without deleting them. Each message is made visible again as soon as it's received, so on a FIFO queue only the first message of each group is shown.",
+					},
+					&cli.IntFlag{
+						Name:  "wait-time",
+						Usage: "How long (in seconds, up to 20) to wait for a message to arrive when the queue is empty.",
+						Value: MAX_WAIT_TIME,
+					},
+					&cli.IntFlag{
+						Name:  "prefetch",
+						Usage: "How many messages (up to 10) to receive from the queue at once. Messages received ahead stay hidden from other receivers while the purge waits for an answer.",
+						Value: 1,
+					},
+					&cli.IntFlag{
+						Name:  "visibility-timeout",
+						Usage: "How long (in seconds) a received message stays hidden from other receivers. It's extended for as long as the message is being worked on. 0 means the queue's own visibility timeout.",
+						Value: DEFAULT_VISIBILITY_TIMEOUT,
+					},
 					&cli.StringFlag{
 						Name:     "region",
 						Aliases:  []string{"r"},
@@ -171,11 +530,101 @@ func main() {
 					if err != nil {
 						return err
 					}
+					defer sqs.Close()
+
+					if args.dryRun {
+						sqs = NewDryRunSQS(sqs)
+					}
 
 					ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
 					return Purge(ctx, sqs)
 				},
 			},
+			{
+				Name:  "failures",
+				Usage: "Inspect and replay tweets that failed to post.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "failure-journal",
+						Usage: "Local file that failed posts are recorded in.",
+						Value: path.Join(workDir, ".sts", "failures.jsonl"),
+					},
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "List recorded failures.",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "all",
+								Usage: "Include failures that have already been replayed.",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							args, err := ParseFailuresListArgs(c)
+							if err != nil {
+								return err
+							}
+
+							journal, err := NewFailureJournal(args.journal)
+							if err != nil {
+								return err
+							}
+
+							ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+							return ListFailures(ctx, journal, args.includeReplayed)
+						},
+					},
+					{
+						Name:  "replay",
+						Usage: "Re-enqueue recorded failures.",
+						Flags: []cli.Flag{
+							&cli.IntSliceFlag{
+								Name:     "id",
+								Usage:    "ID of a failure to replay, as shown by `failures list`. May be repeated.",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:    "user",
+								Aliases: []string{"u"},
+								Usage:   "Message group to replay into. Defaults to each failure's original group.",
+							},
+							&cli.StringFlag{
+								Name:     "region",
+								Aliases:  []string{"r"},
+								Usage:    "",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "queue",
+								Aliases:  []string{"q"},
+								Usage:    "",
+								Required: true,
+							},
+						},
+						Action: func(c *cli.Context) error {
+							args, err := ParseFailuresReplayArgs(c)
+							if err != nil {
+								return err
+							}
+
+							journal, err := NewFailureJournal(args.journal)
+							if err != nil {
+								return err
+							}
+
+							log.Println("Initializing API components.")
+							sqs, err := NewSQS(args.sqs)
+							if err != nil {
+								return err
+							}
+
+							ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+							return ReplayFailures(ctx, journal, sqs, args.ids, args.user)
+						},
+					},
+				},
+			},
 		},
 	}
 
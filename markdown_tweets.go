@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+var (
+	markdownHeading  = regexp.MustCompile(`^#{1,6}(\s|$)`)
+	markdownListItem = regexp.MustCompile(`^(?:[-*+]|\d+[.)])\s+`)
+)
+
+// readMarkdown reads tweets from a Markdown document. If the document is
+// divided into sections by "---" lines, each section is a tweet. Otherwise,
+// each top-level list item is a tweet, and lines indented under an item
+// continue it. Headings are ignored either way, so they can be used to
+// organize the document. Entries can start with the same directive lines as
+// delimited files. It also returns where each empty section ended, as
+// name:line.
+func readMarkdown(reader io.Reader, name string, data []map[string]interface{}) ([]*Envelope, []string, error) {
+	// Which layout the document uses isn't known until it's all been read.
+	lines := []string{}
+	sectioned := false
+	lineReader := newLineReader(reader, name)
+	for {
+		line, ok, err := lineReader.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			break
+		}
+		if line == MARKDOWN_SECTION_BREAK {
+			sectioned = true
+		}
+		lines = append(lines, line)
+	}
+
+	entries := newEntryCollector(name, data)
+	inItem := false
+	for i, line := range lines {
+		number := i + 1
+		switch {
+		case markdownHeading.MatchString(line):
+			// A section with only a heading in it is organizing the document,
+			// not a missing tweet.
+			entries.delimited = false
+		case sectioned && line == MARKDOWN_SECTION_BREAK:
+			if err := entries.Delimit(number); err != nil {
+				return nil, nil, err
+			}
+		case sectioned:
+			entries.Add(line, number)
+		case markdownListItem.MatchString(line):
+			if err := entries.Finish(); err != nil {
+				return nil, nil, err
+			}
+			entries.Add(markdownListItem.ReplaceAllString(line, ""), number)
+			inItem = true
+		case strings.TrimSpace(line) == "":
+			entries.Add("", number)
+		case inItem && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")):
+			entries.Add(strings.TrimSpace(line), number)
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: text outside of a list item. Put each tweet in its own list item, or separate them with %q lines.", name, number, MARKDOWN_SECTION_BREAK)
+		}
+	}
+	tweets, err := entries.Result()
+	return tweets, entries.empty, err
+}
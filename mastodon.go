@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	MASTODON_MEDIA_POLL_INTERVAL = 2 * time.Second
+	MASTODON_MEDIA_MAX_POLLS     = 300
+)
+
+type MastodonConfig struct {
+	server      string
+	accessToken string
+}
+
+// Mastodon publishes statuses to any server implementing the Mastodon REST
+// API.
+type Mastodon struct {
+	server      string
+	accessToken string
+	httpClient  *http.Client
+}
+
+func NewMastodon(conf *MastodonConfig) (*Mastodon, error) {
+	if conf == nil || conf.server == "" || conf.accessToken == "" {
+		return nil, errors.New("The mastodon backend requires a server and an access token.")
+	}
+	return &Mastodon{
+		server:      strings.TrimRight(conf.server, "/"),
+		accessToken: conf.accessToken,
+		httpClient:  newHTTPClient(),
+	}, nil
+}
+
+type mastodonStatus struct {
+	ID      string `json:"id"`
+	Content string `json:"content"`
+}
+
+func (this *Mastodon) Publish(ctx context.Context, post *Post) (*PublishedPost, error) {
+	log.Printf("[mastodon]: Posting status to %s: %s\n", this.server, post.Text)
+	params := map[string]interface{}{"status": post.Text}
+	if post.InReplyTo != "" {
+		params["in_reply_to_id"] = post.InReplyTo
+	}
+	if len(post.Media) > 0 {
+		mediaIDs := make([]string, len(post.Media))
+		for i, media := range post.Media {
+			id, err := this.uploadMedia(ctx, media)
+			if err != nil {
+				return nil, err
+			}
+			mediaIDs[i] = id
+		}
+		params["media_ids"] = mediaIDs
+	}
+
+	headers := map[string]string{"Authorization": "Bearer " + this.accessToken}
+	if post.Key != "" {
+		// Mastodon remembers idempotency keys for an hour, which covers
+		// retrying a post whose response got lost.
+		headers["Idempotency-Key"] = post.Key
+	}
+
+	status := &mastodonStatus{}
+	err := doJSON(
+		ctx,
+		this.httpClient,
+		http.MethodPost,
+		this.server+"/api/v1/statuses",
+		headers,
+		params,
+		status,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &PublishedPost{ID: status.ID, Text: post.Text}, nil
+}
+
+type mastodonAttachment struct {
+	ID  string  `json:"id"`
+	URL *string `json:"url"`
+}
+
+// uploadMedia uploads an attachment, waits for the server to finish processing
+// it, and returns its ID.
+func (this *Mastodon) uploadMedia(ctx context.Context, media *Media) (string, error) {
+	log.Printf("[mastodon]: Uploading %s (%d bytes).\n", media.Source, media.Size)
+	reader, err := media.Open()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if media.AltText != "" {
+		writer.WriteField("description", media.AltText)
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, filepath.Base(media.Source)))
+	header.Set("Content-Type", media.MimeType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(part, reader); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, this.server+"/api/v2/media", &body)
+	if err != nil {
+		return "", Permanent(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+this.accessToken)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := this.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return "", err
+	}
+	attachment := &mastodonAttachment{}
+	if err := json.NewDecoder(resp.Body).Decode(attachment); err != nil {
+		return "", err
+	}
+
+	// Large attachments are processed asynchronously; the URL is only filled
+	// in once processing is done, and statuses can't use it before then.
+	for attempt := 0; attachment.URL == nil; attempt++ {
+		if attempt >= MASTODON_MEDIA_MAX_POLLS {
+			return "", fmt.Errorf("Timed out waiting for %s to process %s.", this.server, media.Source)
+		}
+		select {
+		case <-time.After(MASTODON_MEDIA_POLL_INTERVAL):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		err := doJSON(
+			ctx,
+			this.httpClient,
+			http.MethodGet,
+			this.server+"/api/v1/media/"+attachment.ID,
+			map[string]string{"Authorization": "Bearer " + this.accessToken},
+			nil,
+			attachment,
+		)
+		if err != nil {
+			return "", err
+		}
+	}
+	return attachment.ID, nil
+}
+
+func (this *Mastodon) Name() string {
+	return BACKEND_MASTODON
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	MEDIA_CATEGORY_IMAGE = "image"
+	MEDIA_CATEGORY_GIF   = "gif"
+	MEDIA_CATEGORY_VIDEO = "video"
+
+	// A tweet can have up to four images, or a single GIF or video.
+	MAX_IMAGES_PER_POST = 4
+)
+
+type mediaType struct {
+	mimeType string
+	category string
+	maxBytes int64
+}
+
+// Supported media, by file extension, with Twitter's size limits for each.
+var mediaTypes = map[string]*mediaType{
+	".jpg":  {"image/jpeg", MEDIA_CATEGORY_IMAGE, 5 * 1024 * 1024},
+	".jpeg": {"image/jpeg", MEDIA_CATEGORY_IMAGE, 5 * 1024 * 1024},
+	".png":  {"image/png", MEDIA_CATEGORY_IMAGE, 5 * 1024 * 1024},
+	".webp": {"image/webp", MEDIA_CATEGORY_IMAGE, 5 * 1024 * 1024},
+	".gif":  {"image/gif", MEDIA_CATEGORY_GIF, 15 * 1024 * 1024},
+	".mp4":  {"video/mp4", MEDIA_CATEGORY_VIDEO, 512 * 1024 * 1024},
+}
+
+// Media is an attachment that has been located and checked, ready to be
+// uploaded by a Publisher.
+type Media struct {
+	Source   string
+	AltText  string
+	MimeType string
+	Category string
+	Size     int64
+	open     func() (io.ReadCloser, error)
+}
+
+// Open returns the media's contents. Callers must close it.
+func (this *Media) Open() (io.ReadCloser, error) {
+	return this.open()
+}
+
+// MediaLoader resolves MediaRefs, which are either s3://bucket/key URLs or
+// local paths. Relative local paths are resolved against baseDir.
+type MediaLoader struct {
+	baseDir string
+	region  string
+
+	lock     sync.Mutex
+	s3Client s3iface.S3API
+}
+
+func NewMediaLoader(baseDir, region string) *MediaLoader {
+	return &MediaLoader{baseDir: baseDir, region: region}
+}
+
+// Only create an S3 client if some media actually lives in S3.
+func (this *MediaLoader) s3() s3iface.S3API {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.s3Client == nil {
+		sess := session.Must(session.NewSession())
+		this.s3Client = s3.New(sess, &aws.Config{Region: aws.String(this.region)})
+	}
+	return this.s3Client
+}
+
+func parseS3Source(source string) (bucket, key string, ok bool) {
+	if !strings.HasPrefix(source, "s3://") {
+		return "", "", false
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" || len(u.Path) < 2 {
+		return "", "", false
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), true
+}
+
+// Load locates the media a ref points to and checks that it's a supported
+// type and within size limits, without reading its contents. Problems with the
+// media itself are permanent errors.
+func (this *MediaLoader) Load(ctx context.Context, ref *MediaRef) (*Media, error) {
+	ext := strings.ToLower(filepath.Ext(ref.Source))
+	if u, err := url.Parse(ref.Source); err == nil && u.Scheme == "s3" {
+		ext = strings.ToLower(filepath.Ext(u.Path))
+	}
+	kind, ok := mediaTypes[ext]
+	if !ok {
+		return nil, Permanent(fmt.Errorf("%s: unsupported media type %q.", ref.Source, ext))
+	}
+
+	media := &Media{
+		Source:   ref.Source,
+		AltText:  ref.AltText,
+		MimeType: kind.mimeType,
+		Category: kind.category,
+	}
+
+	if bucket, key, ok := parseS3Source(ref.Source); ok {
+		head, err := this.s3().HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: &bucket, Key: &key})
+		if err != nil {
+			if awsErr, ok := err.(awserr.RequestFailure); ok && awsErr.StatusCode() == 404 {
+				return nil, Permanent(fmt.Errorf("%s does not exist.", ref.Source))
+			}
+			return nil, err
+		}
+		media.Size = aws.Int64Value(head.ContentLength)
+		media.open = func() (io.ReadCloser, error) {
+			obj, err := this.s3().GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+			if err != nil {
+				return nil, err
+			}
+			return obj.Body, nil
+		}
+	} else {
+		if strings.Contains(ref.Source, "://") {
+			return nil, Permanent(fmt.Errorf("%s: media must be a local path or an s3:// URL.", ref.Source))
+		}
+		path := ref.Source
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(this.baseDir, path)
+		}
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return nil, Permanent(fmt.Errorf("%s does not exist.", path))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return nil, Permanent(fmt.Errorf("%s is a directory.", path))
+		}
+		media.Size = info.Size()
+		media.open = func() (io.ReadCloser, error) {
+			return os.Open(path)
+		}
+	}
+
+	if media.Size > kind.maxBytes {
+		return nil, Permanent(fmt.Errorf("%s is %d bytes; the limit for %s is %d bytes.", ref.Source, media.Size, kind.mimeType, kind.maxBytes))
+	}
+	return media, nil
+}
+
+// LoadAll loads every ref, and checks that the combination is one a single
+// post can carry.
+func (this *MediaLoader) LoadAll(ctx context.Context, refs []*MediaRef) ([]*Media, error) {
+	media := make([]*Media, 0, len(refs))
+	for _, ref := range refs {
+		m, err := this.Load(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		media = append(media, m)
+	}
+	if err := checkMediaCombination(media); err != nil {
+		return nil, err
+	}
+	return media, nil
+}
+
+func checkMediaCombination(media []*Media) error {
+	images := 0
+	for _, m := range media {
+		if m.Category != MEDIA_CATEGORY_IMAGE {
+			if len(media) > 1 {
+				return Permanent(fmt.Errorf("A %s must be the only media attached to a post.", m.Category))
+			}
+			continue
+		}
+		images++
+	}
+	if images > MAX_IMAGES_PER_POST {
+		return Permanent(fmt.Errorf("A post can have at most %d images; got %d.", MAX_IMAGES_PER_POST, images))
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMediaLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sts-media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]int{
+		"cat.png":   1024,
+		"huge.jpg":  6 * 1024 * 1024,
+		"dance.gif": 1024,
+		"notes.txt": 10,
+	}
+	for name, size := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loader := NewMediaLoader(dir, "us-east-1")
+	testTables := []struct {
+		refs        []*MediaRef
+		shouldError bool
+	}{
+		{refs: []*MediaRef{{Source: "cat.png", AltText: "a cat"}}},
+		{refs: []*MediaRef{{Source: filepath.Join(dir, "cat.png")}}},
+		{refs: []*MediaRef{{Source: "dance.gif"}}},
+		{refs: []*MediaRef{{Source: "missing.png"}}, shouldError: true},
+		{refs: []*MediaRef{{Source: "huge.jpg"}}, shouldError: true},
+		{refs: []*MediaRef{{Source: "notes.txt"}}, shouldError: true},
+		{refs: []*MediaRef{{Source: "https://example.com/cat.png"}}, shouldError: true},
+		{refs: []*MediaRef{{Source: "dance.gif"}, {Source: "cat.png"}}, shouldError: true},
+		{
+			refs: []*MediaRef{
+				{Source: "cat.png"}, {Source: "cat.png"}, {Source: "cat.png"}, {Source: "cat.png"}, {Source: "cat.png"},
+			},
+			shouldError: true,
+		},
+	}
+
+	for _, test := range testTables {
+		media, err := loader.LoadAll(context.Background(), test.refs)
+		if test.shouldError {
+			if err == nil {
+				t.Errorf("Expected an error loading %s but got none.", test.refs[0].Source)
+			} else if !IsPermanent(err) {
+				t.Errorf("Expected bad media to be a permanent error, but got %s.", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error loading %s but got %s.", test.refs[0].Source, err)
+			continue
+		}
+
+		reader, err := media[0].Open()
+		if err != nil {
+			t.Errorf("Could not open %s: %s", media[0].Source, err)
+			continue
+		}
+		contents, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		if int64(len(contents)) != media[0].Size {
+			t.Errorf("Expected %d bytes from %s but read %d.", media[0].Size, media[0].Source, len(contents))
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Post is a single piece of content to publish.
+type Post struct {
+	// Key identifies the post across retries (e.g. its SQS message ID), so
+	// publishers that track delivery can tell a retry from a new post. It may
+	// be empty.
+	Key  string
+	Text string
+	// InReplyTo is the backend-specific ID of the post this one replies to.
+	InReplyTo string
+	// Account, if set, names the only destination this post should go to.
+	Account string
+	Tags    []string
+	Media   []*Media
+	Thread  *ThreadRef
+}
+
+// PublishedPost describes a post after a backend has accepted it.
+type PublishedPost struct {
+	// ID is the backend's identifier for the post, e.g. a tweet ID or an AT
+	// URI.
+	ID   string
+	Text string
+}
+
+// Publisher is a backend that posts can be published to. Errors that can
+// never succeed on retry (a post that's too long, say) are wrapped with
+// Permanent.
+type Publisher interface {
+	Publish(context.Context, *Post) (*PublishedPost, error)
+	Name() string
+}
+
+const (
+	BACKEND_TWITTER  = "twitter"
+	BACKEND_MASTODON = "mastodon"
+	BACKEND_BLUESKY  = "bluesky"
+	BACKEND_WEBHOOK  = "webhook"
+)
+
+// PublisherConfig selects a backend and holds the settings for each of them.
+// Only the settings for the selected backend need to be filled in.
+type PublisherConfig struct {
+	backend  string
+	twitter  *TwitterCreds
+	mastodon *MastodonConfig
+	bluesky  *BlueskyConfig
+	webhook  *WebhookConfig
+}
+
+func NewPublisher(conf *PublisherConfig) (Publisher, error) {
+	switch conf.backend {
+	case BACKEND_TWITTER:
+		return NewTwitter(conf.twitter), nil
+	case BACKEND_MASTODON:
+		return NewMastodon(conf.mastodon)
+	case BACKEND_BLUESKY:
+		return NewBluesky(conf.bluesky)
+	case BACKEND_WEBHOOK:
+		return NewWebhook(conf.webhook)
+	default:
+		return nil, fmt.Errorf("Unknown backend %q.", conf.backend)
+	}
+}
+
+// Every HTTP-based backend gets a client with a timeout, so that a hung
+// request can't hold up shutdown forever.
+func newHTTPClient() *http.Client {
+	return &http.Client{Timeout: 30 * time.Second}
+}
+
+// HTTPError is returned when a backend responds with a non-2xx status.
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+// checkResponse turns a non-2xx response into an HTTPError. Client errors are
+// permanent, except for the ones that explicitly invite a retry.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	err := &HTTPError{StatusCode: resp.StatusCode, Body: string(body)}
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return err
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return Permanent(err)
+	default:
+		return err
+	}
+}
+
+// doJSON sends in (if non-nil) as a JSON request body, and decodes the
+// response into out (if non-nil).
+func doJSON(ctx context.Context, client *http.Client, method, url string, headers map[string]string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return Permanent(err)
+	}
+	req = req.WithContext(ctx)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// redirectTransport sends every request to a test server, regardless of the
+// host it was addressed to.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (this *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = this.target.Scheme
+	req.URL.Host = this.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestTwitterPublish(t *testing.T) {
+	testTables := []struct {
+		status            int
+		response          string
+		shouldError       bool
+		shouldBePermanent bool
+	}{
+		{
+			status:   http.StatusOK,
+			response: `{"id_str": "123", "full_text": "hello"}`,
+		},
+		{
+			status:            http.StatusForbidden,
+			response:          `{"errors": [{"code": 187, "message": "Status is a duplicate."}]}`,
+			shouldError:       true,
+			shouldBePermanent: true,
+		},
+		{
+			status:      http.StatusServiceUnavailable,
+			response:    `{"errors": [{"code": 130, "message": "Over capacity"}]}`,
+			shouldError: true,
+		},
+	}
+
+	for _, test := range testTables {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/1.1/statuses/update.json" {
+				t.Errorf("Unexpected request to %s.", r.URL.Path)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(test.status)
+			fmt.Fprint(w, test.response)
+		}))
+		target, _ := url.Parse(server.URL)
+		httpClient := &http.Client{Transport: &redirectTransport{target}}
+		client := &Twitter{Client: twitter.NewClient(httpClient), httpClient: httpClient}
+
+		published, err := client.Publish(context.Background(), &Post{Text: "hello"})
+		server.Close()
+
+		if test.shouldError {
+			if err == nil {
+				t.Errorf("Expected an error but got none.")
+			} else if IsPermanent(err) != test.shouldBePermanent {
+				t.Errorf("Expected IsPermanent to be %v for %s.", test.shouldBePermanent, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error but got %s.", err)
+			continue
+		}
+		if published.ID != "123" {
+			t.Errorf("Expected tweet id 123 but got %s.", published.ID)
+		}
+	}
+}
+
+func TestTwitterPublishWithMedia(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sts-media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "cat.png"), []byte("not really a png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/1.1/media/upload.json":
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+				r.ParseMultipartForm(1 << 20)
+			} else {
+				r.ParseForm()
+			}
+			command := r.FormValue("command")
+			commands = append(commands, command)
+			switch command {
+			case "INIT":
+				if r.FormValue("media_category") != "tweet_image" || r.FormValue("total_bytes") != "16" {
+					t.Errorf("Unexpected INIT: %v", r.Form)
+				}
+				fmt.Fprint(w, `{"media_id_string": "42"}`)
+			case "FINALIZE":
+				fmt.Fprint(w, `{"media_id_string": "42", "processing_info": {"state": "succeeded"}}`)
+			}
+		case "/1.1/media/metadata/create.json":
+			commands = append(commands, "METADATA")
+		case "/1.1/statuses/update.json":
+			r.ParseForm()
+			if r.FormValue("media_ids") != "42" {
+				t.Errorf("Expected the uploaded media to be attached, but got media_ids=%q.", r.FormValue("media_ids"))
+			}
+			fmt.Fprint(w, `{"id_str": "123", "full_text": "look"}`)
+		default:
+			t.Errorf("Unexpected request to %s.", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	target, _ := url.Parse(server.URL)
+	httpClient := &http.Client{Transport: &redirectTransport{target}}
+	client := &Twitter{Client: twitter.NewClient(httpClient), httpClient: httpClient}
+
+	media, err := NewMediaLoader(dir, "").LoadAll(context.Background(), []*MediaRef{{Source: "cat.png", AltText: "a cat"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Publish(context.Background(), &Post{Text: "look", Media: media}); err != nil {
+		t.Fatalf("Expected no error but got %s.", err)
+	}
+	if strings.Join(commands, ",") != "INIT,APPEND,FINALIZE,METADATA" {
+		t.Errorf("Unexpected upload sequence: %v", commands)
+	}
+}
+
+func TestMastodonPublish(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/statuses" || r.Method != http.MethodPost {
+			t.Errorf("Unexpected request %s %s.", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Expected a bearer token but got %q.", r.Header.Get("Authorization"))
+		}
+
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["status"] == "too long" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprint(w, `{"error": "Validation failed: Text character limit of 500 exceeded"}`)
+			return
+		}
+		fmt.Fprint(w, `{"id": "109", "content": "<p>hello</p>"}`)
+	}))
+	defer server.Close()
+
+	mastodon, err := NewMastodon(&MastodonConfig{server: server.URL + "/", accessToken: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published, err := mastodon.Publish(context.Background(), &Post{Text: "hello"})
+	if err != nil {
+		t.Fatalf("Expected no error but got %s.", err)
+	}
+	if published.ID != "109" {
+		t.Errorf("Expected status id 109 but got %s.", published.ID)
+	}
+
+	_, err = mastodon.Publish(context.Background(), &Post{Text: "too long"})
+	if err == nil || !IsPermanent(err) {
+		t.Errorf("Expected a permanent error for a rejected status but got %v.", err)
+	}
+}
+
+func TestBlueskyPublish(t *testing.T) {
+	sessions := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/xrpc/com.atproto.server.createSession":
+			sessions++
+			fmt.Fprintf(w, `{"accessJwt": "jwt-%d", "did": "did:plc:abc"}`, sessions)
+		case "/xrpc/com.atproto.repo.createRecord":
+			// Pretend the first session has already expired.
+			if r.Header.Get("Authorization") == "Bearer jwt-1" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, `{"error": "ExpiredToken"}`)
+				return
+			}
+
+			body := struct {
+				Repo   string                 `json:"repo"`
+				Record map[string]interface{} `json:"record"`
+			}{}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.Repo != "did:plc:abc" || body.Record["text"] != "hello" {
+				t.Errorf("Unexpected record: %+v", body)
+			}
+			fmt.Fprint(w, `{"uri": "at://did:plc:abc/app.bsky.feed.post/1", "cid": "cid1"}`)
+		default:
+			t.Errorf("Unexpected request to %s.", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	bluesky, err := NewBluesky(&BlueskyConfig{host: server.URL, handle: "me.bsky.social", appPassword: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published, err := bluesky.Publish(context.Background(), &Post{Text: "hello"})
+	if err != nil {
+		t.Fatalf("Expected no error but got %s.", err)
+	}
+	if published.ID != "at://did:plc:abc/app.bsky.feed.post/1" {
+		t.Errorf("Unexpected post id %s.", published.ID)
+	}
+	if sessions != 2 {
+		t.Errorf("Expected an expired session to be refreshed once, but created %d sessions.", sessions)
+	}
+}
+
+func TestWebhookPublish(t *testing.T) {
+	testTables := []struct {
+		status            int
+		response          string
+		expectedID        string
+		shouldError       bool
+		shouldBePermanent bool
+	}{
+		{status: http.StatusOK, response: `{"id": "abc"}`, expectedID: "abc"},
+		{status: http.StatusNoContent, response: ``, expectedID: ""},
+		{status: http.StatusOK, response: `ok`, expectedID: ""},
+		{status: http.StatusBadRequest, shouldError: true, shouldBePermanent: true},
+		{status: http.StatusTooManyRequests, shouldError: true},
+		{status: http.StatusBadGateway, shouldError: true},
+	}
+
+	for _, test := range testTables {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			payload := &webhookPayload{}
+			json.NewDecoder(r.Body).Decode(payload)
+			if payload.Text != "hello" {
+				t.Errorf("Expected the post text in the payload but got %q.", payload.Text)
+			}
+			w.WriteHeader(test.status)
+			fmt.Fprint(w, test.response)
+		}))
+
+		webhook, err := NewWebhook(&WebhookConfig{url: server.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		published, err := webhook.Publish(context.Background(), &Post{Text: "hello"})
+		server.Close()
+
+		if test.shouldError {
+			if err == nil {
+				t.Errorf("Expected an error for HTTP %d but got none.", test.status)
+			} else if IsPermanent(err) != test.shouldBePermanent {
+				t.Errorf("Expected IsPermanent to be %v for %s.", test.shouldBePermanent, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error for HTTP %d but got %s.", test.status, err)
+			continue
+		}
+		if published.ID != test.expectedID {
+			t.Errorf("Expected id %q but got %q.", test.expectedID, published.ID)
+		}
+	}
+}
@@ -4,77 +4,100 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"strings"
 
-	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/aws"
 )
 
+// Purge walks through the queue, asking whether to delete each message. In a
+// dry run, pass a DryRunSQS: messages are released as soon as they're
+// received, and nothing is deleted. The purge ends when a message comes round
+// a second time, which in a dry run of a FIFO queue is right after the first
+// message of each group.
+//
+// On a FIFO queue, keeping a message ends the purge, since nothing behind it
+// can be received until it's gone. On a standard queue, kept messages are
+// skipped, and made visible again once the purge is over.
 func Purge(ctx context.Context, sqsAPI SQS) error {
 	logger, ok := ctx.Value(STSContextKey("logger")).(*log.Logger)
 	if !ok {
 		return NoLoggerInContext()
 	}
 
+	kept := []*string{}
+	defer func() {
+		for _, receiptHandle := range kept {
+			if err := sqsAPI.ChangeVisibility(receiptHandle, 0); err != nil {
+				logger.Printf("Could not make a kept message visible again: %s\n", err)
+			}
+		}
+	}()
+
+	seen := make(map[string]bool)
 	reader := bufio.NewReader(os.Stdin)
-	stop := false
-	for !stop {
+	for {
 		logger.Println("Getting a message from the queue.")
-		childLogger := getLogger()
-		childLogger.SetOutput(ioutil.Discard)
-		childCtx := context.WithValue(ctx, STSContextKey("logger"), childLogger)
-		msg, err := Retry(
-			func() (interface{}, error) {
-				return sqsAPI.Receive(childCtx)
-			},
-			&BasicRetrier{delayMillis: 50, maxAttempts: 500, description: "SQS ReceiveMessage()"},
-		)
+		message, err := sqsAPI.Receive(ctx)
 		if err != nil {
 			return err
 		}
-
-		if msg == nil {
-			continue
+		if message == nil {
+			logger.Println("No more messages in the queue.")
+			return nil
+		}
+		if id := aws.StringValue(message.MessageId); id != "" {
+			if seen[id] {
+				logger.Println("Got a message that was already looked at. Nothing new is left to see.")
+				return nil
+			}
+			seen[id] = true
+		}
+		// Don't let it reappear on the queue while waiting for an answer.
+		stop := sqsAPI.KeepInFlight(message.ReceiptHandle)
+		text := *message.Body
+		if envelope, err := DecodeEnvelope(*message.Body); err == nil {
+			text = envelope.Text
 		}
-		message := msg.(*sqs.Message)
-		for true {
-			fmt.Printf("Next message in queue:\n%s\n=> Purge? [yes/no]: ", *message.Body)
-			text, _ := reader.ReadString('\n')
-			text = strings.ToLower(strings.Replace(text, "\n", "", -1))
 
-			switch text {
-			case "yes":
-				err := sqsAPI.DeleteMessage(message.ReceiptHandle)
-				if err != nil {
-					return err
-				}
-				break
-			case "no":
+		purge := confirm(reader, fmt.Sprintf("Next message in queue:\n%s\n=> Purge?", text))
+		stop()
+		if !purge {
+			if sqsAPI.IsFIFO() {
 				logger.Printf("Not purging. Since queue is FIFO, exiting now.\n")
 				return nil
-			default:
-				fmt.Printf("Was expecting 'yes' or 'no'. Got '%s'.\n", text)
-				continue
 			}
+			logger.Printf("Not purging. Moving on to the next message.\n")
+			kept = append(kept, message.ReceiptHandle)
+			continue
+		}
+		if err := sqsAPI.DeleteMessage(message.ReceiptHandle); err != nil {
+			return err
 		}
 
-		for true {
-			fmt.Printf("Continue? [yes/no]: ")
-			text, _ := reader.ReadString('\n')
-			text = strings.ToLower(strings.Replace(text, "\n", "", -1))
-			switch text {
-			case "yes":
-				break
-			case "no":
-				stop = true
-				break
-			default:
-				fmt.Printf("Was expecting 'yes' or 'no'. Got '%s'.\n", text)
-				continue
-			}
+		if !confirm(reader, "Continue?") {
+			return nil
+		}
+	}
+}
+
+// confirm asks a yes or no question until it gets one of the two.
+func confirm(reader *bufio.Reader, question string) bool {
+	for {
+		fmt.Printf("%s [yes/no]: ", question)
+		text, err := reader.ReadString('\n')
+		text = strings.ToLower(strings.TrimSpace(text))
+		switch text {
+		case "yes":
+			return true
+		case "no":
+			return false
+		}
+		if err != nil {
+			// Nobody's there to answer.
+			return false
 		}
+		fmt.Printf("Was expecting 'yes' or 'no'. Got '%s'.\n", text)
 	}
-	return nil
 }
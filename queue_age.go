@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+// QUEUE_AGE_LOOKBACK is how far back to look for the latest
+// ApproximateAgeOfOldestMessage datapoint. SQS publishes it every minute, but
+// only while the queue is active.
+const QUEUE_AGE_LOOKBACK = 15 * time.Minute
+
+// QueueAge reports how long the oldest message has been waiting on the queue,
+// which is how calibration knows how much of the retention period is left
+// without receiving anything itself.
+type QueueAge interface {
+	// OldestMessageAge returns the age in seconds, and false if it isn't
+	// known.
+	OldestMessageAge(context.Context) (int64, bool, error)
+}
+
+// CloudWatchQueueAge reads the queue's ApproximateAgeOfOldestMessage metric.
+type CloudWatchQueueAge struct {
+	cloudWatch cloudwatchiface.CloudWatchAPI
+	queueName  string
+}
+
+func NewCloudWatchQueueAge(queueName, region string) *CloudWatchQueueAge {
+	sess := session.Must(session.NewSession())
+	return &CloudWatchQueueAge{
+		cloudWatch: cloudwatch.New(sess, &aws.Config{Region: aws.String(region)}),
+		queueName:  queueName,
+	}
+}
+
+func (this *CloudWatchQueueAge) OldestMessageAge(ctx context.Context) (int64, bool, error) {
+	now := time.Now()
+	output, err := this.cloudWatch.GetMetricStatisticsWithContext(ctx, &cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/SQS"),
+		MetricName: aws.String("ApproximateAgeOfOldestMessage"),
+		Dimensions: []*cloudwatch.Dimension{
+			{Name: aws.String("QueueName"), Value: aws.String(this.queueName)},
+		},
+		StartTime:  aws.Time(now.Add(-QUEUE_AGE_LOOKBACK)),
+		EndTime:    aws.Time(now),
+		Period:     aws.Int64(60),
+		Statistics: aws.StringSlice([]string{cloudwatch.StatisticMaximum}),
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	var latest *cloudwatch.Datapoint
+	for _, datapoint := range output.Datapoints {
+		if datapoint.Timestamp == nil || datapoint.Maximum == nil {
+			continue
+		}
+		if latest == nil || datapoint.Timestamp.After(*latest.Timestamp) {
+			latest = datapoint
+		}
+	}
+	if latest == nil {
+		return 0, false, nil
+	}
+	// The datapoint is up to a minute or so old, and so is the message.
+	age := int64(*latest.Maximum) + int64(now.Sub(*latest.Timestamp)/time.Second)
+	return age, true, nil
+}
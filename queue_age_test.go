@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+type FakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	datapoints []*cloudwatch.Datapoint
+}
+
+func (this *FakeCloudWatch) GetMetricStatisticsWithContext(ctx aws.Context, input *cloudwatch.GetMetricStatisticsInput, options ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	return &cloudwatch.GetMetricStatisticsOutput{Datapoints: this.datapoints}, nil
+}
+
+func TestCloudWatchQueueAge(t *testing.T) {
+	now := time.Now()
+	testTables := []struct {
+		datapoints  []*cloudwatch.Datapoint
+		expectedAge int64
+		known       bool
+	}{
+		{
+			// an idle queue has no datapoints
+			datapoints: nil,
+			known:      false,
+		},
+		{
+			// the latest datapoint wins, aged by how old it is itself
+			datapoints: []*cloudwatch.Datapoint{
+				{Timestamp: aws.Time(now.Add(-5 * time.Minute)), Maximum: aws.Float64(900)},
+				{Timestamp: aws.Time(now.Add(-time.Minute)), Maximum: aws.Float64(300)},
+				{Timestamp: aws.Time(now.Add(-3 * time.Minute)), Maximum: aws.Float64(700)},
+			},
+			expectedAge: 360,
+			known:       true,
+		},
+	}
+
+	for _, test := range testTables {
+		queueAge := &CloudWatchQueueAge{cloudWatch: &FakeCloudWatch{datapoints: test.datapoints}, queueName: "tweets"}
+		age, known, err := queueAge.OldestMessageAge(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if known != test.known {
+			t.Errorf("Expected known to be %t but got %t.", test.known, known)
+		}
+		// Allow for the clock moving on while the test runs.
+		if age < test.expectedAge || age > test.expectedAge+1 {
+			t.Errorf("Expected an age of %d but got %d.", test.expectedAge, age)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"time"
 )
@@ -12,6 +13,12 @@ type Retrier interface {
 }
 
 func Retry(f func() (interface{}, error), retrier Retrier) (interface{}, error) {
+	return RetryContext(context.Background(), f, retrier)
+}
+
+// RetryContext behaves like Retry, but gives up early if ctx is cancelled,
+// returning the context's error.
+func RetryContext(ctx context.Context, f func() (interface{}, error), retrier Retrier) (interface{}, error) {
 	log.Printf("[retry]: Attempting to %s for up to %d attempts.\n", retrier.Description(), retrier.MaxAttempts())
 	var err error
 	var res interface{}
@@ -22,7 +29,13 @@ func Retry(f func() (interface{}, error), retrier Retrier) (interface{}, error)
 			log.Printf("[retry]: Got a non-error result on attempt %d.\n", attempt+1)
 			return res, err
 		}
-		time.Sleep(time.Duration(retrier.NextDelayMillis(attempt)) * time.Millisecond)
+
+		select {
+		case <-time.After(time.Duration(retrier.NextDelayMillis(attempt)) * time.Millisecond):
+		case <-ctx.Done():
+			log.Printf("[retry]: Giving up on %s after %d attempts: %s.\n", retrier.Description(), attempt+1, ctx.Err())
+			return nil, ctx.Err()
+		}
 	}
 
 	return nil, err
@@ -45,3 +58,31 @@ func (retrier *BasicRetrier) MaxAttempts() int {
 func (retrier *BasicRetrier) Description() string {
 	return retrier.description
 }
+
+// ExponentialRetrier doubles the delay after every attempt, up to
+// maxDelayMillis.
+type ExponentialRetrier struct {
+	initialDelayMillis int
+	maxDelayMillis     int
+	maxAttempts        int
+	description        string
+}
+
+func (retrier *ExponentialRetrier) NextDelayMillis(attempt int) int {
+	delay := retrier.initialDelayMillis
+	for i := 0; i < attempt && delay < retrier.maxDelayMillis; i++ {
+		delay *= 2
+	}
+	if delay > retrier.maxDelayMillis {
+		return retrier.maxDelayMillis
+	}
+	return delay
+}
+
+func (retrier *ExponentialRetrier) MaxAttempts() int {
+	return retrier.maxAttempts
+}
+
+func (retrier *ExponentialRetrier) Description() string {
+	return retrier.description
+}
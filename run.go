@@ -2,28 +2,64 @@ package main
 
 import (
 	"context"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"log"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
+// UNSUPPORTED_VERSION_DELAY is how long, in seconds, a message from a newer
+// version of sts is hidden for before it can be received again.
+const UNSUPPORTED_VERSION_DELAY = 5 * 60
+
+// POST_TIMEOUT bounds how long loading a message's media and posting it can
+// take, since a shutdown doesn't interrupt either.
+const POST_TIMEOUT = 5 * time.Minute
+
 type Service struct {
 	calibrationRate int
 	tweetRate       int64
+	deadLetters     DeadLetterQueue
+	failures        *FailureJournal
+	history         *PostHistory
+	media           *MediaLoader
+	// Which message group to post from next. A nil scheduler treats every
+	// group alike.
+	groups *GroupScheduler
+	// How long the oldest message has been waiting. If nil, calibration
+	// assumes every message has the whole retention period left.
+	queueAge QueueAge
 }
 
-func NewService(args *RunArgs) *Service {
+func NewService(args *RunArgs, deadLetters DeadLetterQueue, failures *FailureJournal, history *PostHistory, groups *GroupScheduler) *Service {
+	var queueAge QueueAge
+	if !args.skipQueueAge {
+		queueAge = NewCloudWatchQueueAge(args.sqs.queueName, args.sqs.region)
+	}
 	return &Service{
 		calibrationRate: args.calibrationRate,
 		tweetRate:       0,
+		deadLetters:     deadLetters,
+		failures:        failures,
+		history:         history,
+		media:           NewMediaLoader(args.mediaDir, args.sqs.region),
+		groups:          groups,
+		queueAge:        queueAge,
 	}
 }
 
-func (this *Service) RunForever(ctx context.Context, twitter TwitterAPI, sqsAPI SQS) error {
+// RunForever runs the calibration and tweet loops until one of them fails or
+// ctx is cancelled. Cancellation is treated as an orderly shutdown: a tweet
+// that has already been received from the queue is allowed to finish (so it is
+// either posted and deleted, or left on the queue untouched), and RunForever
+// returns nil once both loops have exited.
+func (this *Service) RunForever(ctx context.Context, publisher Publisher, sqsAPI SQS) error {
 	logger, ok := ctx.Value(STSContextKey("logger")).(*log.Logger)
 	if !ok {
 		return NoLoggerInContext()
@@ -34,44 +70,66 @@ func (this *Service) RunForever(ctx context.Context, twitter TwitterAPI, sqsAPI
 		return err
 	}
 
-	calibrationErrors := make(chan error)
-	tweetErrors := make(chan error)
-
+	// Each loop reports at most one error before exiting, so buffer enough
+	// room that neither ever blocks on a send after the other has failed.
+	errs := make(chan error, 2)
 	tweetWakeupChan := make(chan bool)
 
-	go func(calibrationErrors chan error) {
-		for true {
-			change, err := this.Calibrate(ctx, sqsAPI)
+	// Cancelled when either loop fails, so that the other one winds down too.
+	loopCtx, stopLoops := context.WithCancel(ctx)
+	defer stopLoops()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for {
+			change, err := this.Calibrate(loopCtx, sqsAPI)
 			if err != nil {
-				calibrationErrors <- err
+				errs <- err
+				return
 			}
 
-			switch change {
-			case TWEET_FASTER:
-				tweetWakeupChan <- true
-			case TWEET_SLOWER:
-			default:
+			if change == TWEET_FASTER {
+				select {
+				case tweetWakeupChan <- true:
+				case <-loopCtx.Done():
+					return
+				}
 			}
 
 			logger.Printf("Finished calibration iteration. Sleeping for %d seconds.\n", this.calibrationRate)
-			time.Sleep(time.Duration(this.calibrationRate) * time.Second)
+			select {
+			case <-time.After(time.Duration(this.calibrationRate) * time.Second):
+			case <-loopCtx.Done():
+				logger.Println("[calibration]: Shutting down.")
+				return
+			}
 		}
-	}(calibrationErrors)
+	}()
 
-	go func(tweetErrors chan error) {
-		for true {
-			tweet, err := this.Tweet(ctx, twitter, sqsAPI)
+	go func() {
+		defer wg.Done()
+		for {
+			tweet, err := this.Tweet(loopCtx, publisher, sqsAPI)
 			if err != nil {
 				if tweet != "" {
-					// TODO: log the tweet text so we don't lose it forever
+					logger.Printf("[tweet]: Failed to post: %s\n", tweet)
 				}
-				tweetErrors <- err
+				errs <- err
+				return
+			}
+			if loopCtx.Err() != nil {
+				logger.Println("[tweet]: Shutting down.")
+				return
 			}
+
 			tweetSleepTime := atomic.LoadInt64(&this.tweetRate)
 			logger.Printf("Finished tweet iteration. Sleeping for %d seconds.\n", tweetSleepTime)
 
-			var sleeper func(int64, int64)
-			sleeper = func(totalTimeElapsed, remainingTime int64) {
+			var sleeper func(int64, int64) bool
+			sleeper = func(totalTimeElapsed, remainingTime int64) bool {
 				localStart := time.Now()
 				logger.Printf("[tweet_sleep_loop]: Sleeping for up to %d seconds before tweeting again.\n", remainingTime)
 
@@ -85,32 +143,34 @@ func (this *Service) RunForever(ctx context.Context, twitter TwitterAPI, sqsAPI
 						timeElapsed,
 					)
 					if timeElapsed < newTotal {
-						sleeper(timeElapsed, newTotal-timeElapsed)
-					} else {
-						logger.Println("[tweet_sleep_loop]: sleep time already exceeds the new rate. Preparing a new tweet immediately.")
+						return sleeper(timeElapsed, newTotal-timeElapsed)
 					}
+					logger.Println("[tweet_sleep_loop]: sleep time already exceeds the new rate. Preparing a new tweet immediately.")
 				case <-time.After(time.Duration(remainingTime) * time.Second):
+				case <-loopCtx.Done():
+					return false
 				}
 
+				return true
+			}
+			if !sleeper(0, tweetSleepTime) {
+				logger.Println("[tweet]: Shutting down.")
 				return
 			}
-			sleeper(0, tweetSleepTime)
 		}
-	}(tweetErrors)
-
-	for true {
-		select {
-		case calibrationErr := <-calibrationErrors:
-			return calibrationErr
-		case tweetErr := <-tweetErrors:
-			return tweetErr
-		default:
-		}
-
-		time.Sleep(time.Second)
+	}()
+
+	select {
+	case err = <-errs:
+		logger.Printf("Stopping after error: %s\n", err)
+	case <-ctx.Done():
+		logger.Println("Shutdown requested. Waiting for in-flight work to finish.")
+		err = nil
 	}
 
-	return nil
+	stopLoops()
+	wg.Wait()
+	return err
 }
 
 type CalibrationChange int
@@ -124,15 +184,18 @@ const (
 // Compute how long we can afford to sleep between tweets such that tweets
 // don't drop off the queue from retention policy.
 // Roughly, this is "seconds of retention" / "num messages in queue".
+//
+// Calibration only reads queue attributes and metrics. It never receives a
+// message, since a message it received would be hidden from the tweet loop,
+// which would then post whatever comes after it first.
 func (this *Service) Calibrate(ctx context.Context, sqsAPI SQS) (CalibrationChange, error) {
-	numMessagesAttribute := "ApproximateNumberOfMessages"
-	retentionAttribute := "MessageRetentionPeriod"
 	resp, err := sqsAPI.GetQueueAttributes(
 		&sqs.GetQueueAttributesInput{
-			AttributeNames: []*string{
-				&numMessagesAttribute,
-				&retentionAttribute,
-			},
+			AttributeNames: aws.StringSlice([]string{
+				"ApproximateNumberOfMessages",
+				"ApproximateNumberOfMessagesNotVisible",
+				"MessageRetentionPeriod",
+			}),
 		},
 	)
 
@@ -140,57 +203,47 @@ func (this *Service) Calibrate(ctx context.Context, sqsAPI SQS) (CalibrationChan
 		return TWEET_SAME, err
 	}
 
-	backlogStr := *resp.Attributes["ApproximateNumberOfMessages"]
-	retentionStr := *resp.Attributes["MessageRetentionPeriod"]
-
-	backlog, err := strconv.Atoi(backlogStr)
+	visible, err := intAttribute(resp.Attributes, "ApproximateNumberOfMessages")
 	if err != nil {
 		return TWEET_SAME, err
 	}
-	retention, err := strconv.Atoi(retentionStr)
+	// Messages in flight or postponed still have to be posted in time.
+	notVisible, err := intAttribute(resp.Attributes, "ApproximateNumberOfMessagesNotVisible")
 	if err != nil {
 		return TWEET_SAME, err
 	}
-
-	message, err := sqsAPI.Receive(ctx)
-	remainingRetention := int64(retention)
-	lastTweetEnqueueTime := int64(-1)
-
+	retention, err := intAttribute(resp.Attributes, "MessageRetentionPeriod")
 	if err != nil {
-		// This error is either:
-		// (1) intermittent, in which case the next round of calibration will
-		// run fine
-		// OR
-		// (2) permanent, in which case it will be caught in the "tweet"
-		// goroutine, and we'll consider it crash-worthy there.
+		return TWEET_SAME, err
+	}
+	backlog := visible + notVisible
+	if backlog == 0 {
+		log.Println("[calibration]: The queue is empty. Keeping the current tweet rate.")
 		return TWEET_SAME, nil
-		log.Println("[calibration]: No messages in the queue. Using the full retention period.")
-	} else {
-		timestampMillis, err := strconv.Atoi(*message.Attributes["SentTimestamp"])
-		if err == nil {
-			// just use the full retention window; it's probably fine, and
-			// better than crashing
-			// This assignment is technically redundant, but it makes this less
-			// confusing to read.
-			remainingRetention = int64(retention)
-		} else {
-			lastTweetEnqueueTime = int64(timestampMillis / 1000)
-			elapsedSinceLastEnqueue := time.Now().Unix() - lastTweetEnqueueTime
-			log.Printf("[calibration]: last tweet was enqueued at %s. %d seconds have passed since then.\n",
-				time.Unix(lastTweetEnqueueTime, 0).String(),
-				elapsedSinceLastEnqueue,
-			)
-			remainingRetention = int64(retention) - (time.Now().Unix() - lastTweetEnqueueTime)
+	}
+
+	// Without knowing how long the oldest message has been waiting, assume
+	// it has the full retention window; it's probably fine, and better than
+	// crashing.
+	remainingRetention := retention
+	if this.queueAge != nil {
+		age, ok, err := this.queueAge.OldestMessageAge(ctx)
+		switch {
+		case err != nil:
+			log.Printf("[calibration]: Could not get the age of the oldest message. Assuming the full retention period remains: %s\n", err)
+		case ok:
+			log.Printf("[calibration]: The oldest message was enqueued %d seconds ago.\n", age)
+			remainingRetention = retention - age
+			if remainingRetention < 0 {
+				remainingRetention = 0
+			}
 		}
 	}
 
-	tweetRate := remainingRetention / int64(backlog)
+	tweetRate := remainingRetention / backlog
 
-	log.Printf("[calibration]: Found %d messages in the backlog.\n", backlog)
-	log.Printf("[calibration]: Message retention period is %d.\n", retention)
-	if lastTweetEnqueueTime > 0 {
-		log.Printf("[calibration]: Given last enqueue time of %s, %d seconds of retention remain.\n", time.Unix(lastTweetEnqueueTime, 0).String(), remainingRetention)
-	}
+	log.Printf("[calibration]: Found %d messages in the backlog (%d in flight or postponed).\n", backlog, notVisible)
+	log.Printf("[calibration]: Message retention period is %d, of which %d seconds remain.\n", retention, remainingRetention)
 	log.Printf("[calibration]: Setting tweet rate to %d.\n", tweetRate)
 
 	var change CalibrationChange
@@ -206,39 +259,241 @@ func (this *Service) Calibrate(ctx context.Context, sqsAPI SQS) (CalibrationChan
 	return change, nil
 }
 
-func (this *Service) Tweet(ctx context.Context, twitter TwitterAPI, sqsAPI SQS) (string, error) {
+// intAttribute parses a numeric queue attribute.
+func intAttribute(attributes map[string]*string, name string) (int64, error) {
+	value, ok := attributes[name]
+	if !ok || value == nil {
+		return 0, fmt.Errorf("Queue attribute %s is missing.", name)
+	}
+	return strconv.ParseInt(*value, 10, 64)
+}
+
+// queueRetention is how long the queue keeps a message before discarding it.
+func queueRetention(sqsAPI SQS) (time.Duration, error) {
+	resp, err := sqsAPI.GetQueueAttributes(
+		&sqs.GetQueueAttributesInput{
+			AttributeNames: aws.StringSlice([]string{"MessageRetentionPeriod"}),
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	retention, err := intAttribute(resp.Attributes, "MessageRetentionPeriod")
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(retention) * time.Second, nil
+}
+
+func (this *Service) Tweet(ctx context.Context, publisher Publisher, sqsAPI SQS) (string, error) {
 	logger, ok := ctx.Value(STSContextKey("logger")).(*log.Logger)
 	if !ok {
 		return "", NoLoggerInContext()
 	}
 	logger.Println("Getting a tweet from the queue.")
-	childLogger := getLogger()
-	childLogger.SetOutput(ioutil.Discard)
-	childCtx := context.WithValue(ctx, STSContextKey("logger"), childLogger)
-	msg, err := Retry(
-		func() (interface{}, error) {
-			return sqsAPI.Receive(childCtx)
-		},
-		&BasicRetrier{delayMillis: 50, maxAttempts: 500, description: "SQS ReceiveMessage()"},
-	)
-
+	message, err := sqsAPI.ReceivePicking(ctx, this.groupPicker(logger))
 	if err != nil {
+		if ctx.Err() != nil {
+			// Shutting down before anything was received; there's nothing
+			// in flight to finish.
+			return "", nil
+		}
 		return "", err
 	}
-	if msg == nil {
+	if message == nil {
+		// Either the queue is empty, or everything in it is scheduled for
+		// later. Either way, try again next iteration.
+		logger.Println("[tweet]: No messages available. Not tweeting this time.")
 		return "", nil
 	}
 
-	message := msg.(*sqs.Message)
-	if *message.Body == "" {
+	// From here on the message is ours, so finish posting and deleting it even
+	// if a shutdown is requested in the meantime. Abandoning it halfway is how
+	// tweets get double-posted.
+	//
+	// Posting (media uploads and retries included) can take longer than the
+	// visibility timeout. Don't let the message reappear for someone else to
+	// post in the meantime.
+	defer sqsAPI.KeepInFlight(message.ReceiptHandle)()
+	envelope, err := DecodeEnvelope(*message.Body)
+	var unsupported *UnsupportedVersionError
+	if errors.As(err, &unsupported) {
+		// A newer envelope isn't broken, and it isn't a failure either. Leave
+		// it for a newer daemon (during a rolling upgrade, say), without
+		// receiving it again straight away.
+		logger.Printf("[tweet]: %s Hiding it for %d seconds for a newer version of sts to post.\n", err, UNSUPPORTED_VERSION_DELAY)
+		return "", sqsAPI.ChangeVisibility(message.ReceiptHandle, UNSUPPORTED_VERSION_DELAY)
+	}
+	if err != nil {
+		return this.handleFailure(ctx, sqsAPI, message, Permanent(err))
+	}
+	if envelope.Text == "" && len(envelope.Media) == 0 {
 		log.Println("[tweet]: Got an empty message from the queue. Not tweeting that. Still going to delete it though.")
 		return "", sqsAPI.DeleteMessage(message.ReceiptHandle)
 	}
 
-	tweet, err := twitter.Tweet(*message.Body, nil)
+	now := time.Now()
+	if envelope.NotAfter != nil && now.After(*envelope.NotAfter) {
+		return "", this.expire(ctx, sqsAPI, message, envelope)
+	}
+	if envelope.NotBefore != nil && now.Before(*envelope.NotBefore) {
+		return "", this.postpone(ctx, sqsAPI, message, envelope.NotBefore.Sub(now))
+	}
+
+	// Don't let a shutdown interrupt the post itself, but don't let a hung
+	// request hold up shutdown forever either.
+	postCtx, cancel := context.WithTimeout(detach(ctx), POST_TIMEOUT)
+	defer cancel()
+	post := envelope.Post(aws.StringValue(message.MessageId))
+	if post.Account == "" && this.groups != nil {
+		post.Account = this.groups.Account(messageGroup(message))
+	}
+	if len(envelope.Media) > 0 {
+		if this.media == nil {
+			return this.handleFailure(ctx, sqsAPI, message, errors.New("Message has media attached, but no media loader is configured."))
+		}
+		post.Media, err = this.media.LoadAll(postCtx, envelope.Media)
+		if err != nil {
+			return this.handleFailure(ctx, sqsAPI, message, err)
+		}
+	}
+
+	published, err := publisher.Publish(postCtx, post)
 	if err != nil {
-		return "", err
+		return this.handleFailure(ctx, sqsAPI, message, err)
+	}
+
+	logger.Printf("[tweet]: Published to %s with id %s.\n", publisher.Name(), published.ID)
+	if this.history != nil {
+		if err := this.history.Record(post.Text, publisher.Name(), published.ID); err != nil {
+			// Only lint reads the history, so this isn't worth failing over.
+			logger.Printf("[tweet]: Could not record post in %s: %s\n", this.history.filename, err)
+		}
 	}
+	return published.Text, sqsAPI.DeleteMessage(message.ReceiptHandle)
+}
+
+// groupPicker picks which group to post from next, out of those with a
+// message already received and ready to go. It's nil, so messages are posted
+// in the order they're received, unless several groups share the queue.
+func (this *Service) groupPicker(logger *log.Logger) GroupPicker {
+	if this.groups == nil || !this.groups.Shared() {
+		return nil
+	}
+	return func(ready []string, waiting map[string]int) string {
+		group := this.groups.PickWaiting(ready, waiting)
+		if len(ready) > 1 {
+			logger.Printf("[tweet]: Groups with tweets ready: %s. Posting from %s.\n", this.groups.Describe(ready), group)
+		}
+		return group
+	}
+}
+
+// messageGroup is the message group a received message was sent to, or "" if
+// it's not known.
+func messageGroup(message *sqs.Message) string {
+	return aws.StringValue(message.Attributes["MessageGroupId"])
+}
+
+// postpone hides a message that isn't due yet until it is, rather than
+// spinning on it. SQS caps visibility timeouts at 12 hours, so messages
+// scheduled further out than that are simply postponed again the next time
+// they come around.
+//
+// Note that on a FIFO queue, a postponed message holds up everything behind it
+// in the same message group.
+func (this *Service) postpone(ctx context.Context, sqsAPI SQS, message *sqs.Message, delay time.Duration) error {
+	logger, ok := ctx.Value(STSContextKey("logger")).(*log.Logger)
+	if !ok {
+		return NoLoggerInContext()
+	}
+
+	// Round up, so we never wake up a moment too early and have to
+	// postpone again for less than a second.
+	timeout := int64((delay + time.Second - 1) / time.Second)
+	if timeout > MAX_VISIBILITY_TIMEOUT {
+		timeout = MAX_VISIBILITY_TIMEOUT
+	}
+	logger.Printf("[tweet]: Message is scheduled %s from now. Hiding it for %d seconds.\n", delay, timeout)
+	return sqsAPI.ChangeVisibility(message.ReceiptHandle, timeout)
+}
+
+// expire drops a message whose not-after time has passed, moving it to the
+// dead-letter queue if there is one.
+func (this *Service) expire(ctx context.Context, sqsAPI SQS, message *sqs.Message, envelope *Envelope) error {
+	logger, ok := ctx.Value(STSContextKey("logger")).(*log.Logger)
+	if !ok {
+		return NoLoggerInContext()
+	}
+
+	reason := fmt.Errorf("Message expired at %s without being posted.", envelope.NotAfter.Format(time.RFC3339))
+	if this.deadLetters != nil {
+		logger.Printf("[tweet]: %s Moving it to %s.\n", reason, this.deadLetters.Name())
+		if err := this.deadLetters.Put(ctx, message, reason); err != nil {
+			return err
+		}
+	} else {
+		logger.Printf("[tweet]: %s Discarding it: %s\n", reason, envelope.Text)
+	}
+	return sqsAPI.DeleteMessage(message.ReceiptHandle)
+}
+
+// handleFailure records a message that couldn't be posted in the failure
+// journal, and moves it to the dead-letter queue if it can never succeed, or
+// back to the queue if it might. The error is only returned if the message
+// might succeed later, or couldn't be dead-lettered; one that never will is
+// skipped when there's no dead-letter destination.
+func (this *Service) handleFailure(ctx context.Context, sqsAPI SQS, message *sqs.Message, err error) (string, error) {
+	logger, ok := ctx.Value(STSContextKey("logger")).(*log.Logger)
+	if !ok {
+		return "", NoLoggerInContext()
+	}
+
+	if this.failures != nil {
+		record, journalErr := this.failures.Record(message, err)
+		if journalErr != nil {
+			logger.Printf("[tweet]: Could not record failure in the journal: %s\n", journalErr)
+		} else {
+			logger.Printf("[tweet]: Recorded failure %d in the journal.\n", record.ID)
+		}
+	}
+
+	if !IsPermanent(err) {
+		// Give it back to the queue now, rather than once its visibility
+		// timeout runs out, so the retry comes first in its group.
+		if releaseErr := sqsAPI.ChangeVisibility(message.ReceiptHandle, 0); releaseErr != nil {
+			logger.Printf("[tweet]: Could not make the message visible again: %s\n", releaseErr)
+		}
+		return *message.Body, err
+	}
+	if this.deadLetters == nil {
+		// Posting it again won't go any better, and stopping the daemon would
+		// only restart it into the same message. It's in the journal if
+		// there is one, so leave it hidden until its visibility timeout runs
+		// out (or a redrive policy takes it) and carry on.
+		logger.Printf("[tweet]: Tweet was permanently rejected. Skipping it: %s\n", err)
+		return "", nil
+	}
+
+	logger.Printf("[tweet]: Tweet was permanently rejected. Moving it to %s: %s\n", this.deadLetters.Name(), err)
+	if err := this.deadLetters.Put(ctx, message, err); err != nil {
+		return *message.Body, err
+	}
+	return *message.Body, sqsAPI.DeleteMessage(message.ReceiptHandle)
+}
+
+// detachedContext carries the values of its parent, but is never cancelled
+// and has no deadline.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
 
-	return tweet, sqsAPI.DeleteMessage(message.ReceiptHandle)
+// detach returns a context with ctx's values that is immune to ctx being
+// cancelled, for work that must run to completion once started.
+func detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
 }
@@ -3,8 +3,12 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
@@ -12,8 +16,24 @@ type FakeSQS struct {
 	shouldErrorOnGetQueueAttributes bool
 	shouldErrorOnReceive            bool
 	numMessagesInQueue              string
+	numMessagesNotVisible           string
 	messageRetention                string
 	sentTimestampOnMessage          string
+	message                         *sqs.Message
+	deleted                         []string
+	sent                            map[string][]string
+	visibilityChanges               []int64
+	// Receipt handles KeepInFlight was called for.
+	inFlight []string
+	// Message body -> why SendAll should fail to enqueue it.
+	rejectSend map[string]string
+	standard   bool
+	// Handed out by Receive, one at a time, before message.
+	queue []*sqs.Message
+}
+
+func (this *FakeSQS) IsFIFO() bool {
+	return !this.standard
 }
 
 func (this *FakeSQS) GetQueueAttributes(in *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
@@ -23,8 +43,9 @@ func (this *FakeSQS) GetQueueAttributes(in *sqs.GetQueueAttributesInput) (*sqs.G
 
 	out := &sqs.GetQueueAttributesOutput{
 		Attributes: map[string]*string{
-			"ApproximateNumberOfMessages": &this.numMessagesInQueue,
-			"MessageRetentionPeriod":      &this.messageRetention,
+			"ApproximateNumberOfMessages":           &this.numMessagesInQueue,
+			"ApproximateNumberOfMessagesNotVisible": &this.numMessagesNotVisible,
+			"MessageRetentionPeriod":                &this.messageRetention,
 		},
 	}
 	return out, nil
@@ -34,23 +55,91 @@ func (this *FakeSQS) Receive(ctx context.Context) (*sqs.Message, error) {
 	if this.shouldErrorOnReceive {
 		return nil, errors.New("")
 	}
-	return nil, nil // TODO
+	if len(this.queue) > 0 {
+		message := this.queue[0]
+		this.queue = this.queue[1:]
+		return message, nil
+	}
+	return this.message, nil
+}
+
+func (this *FakeSQS) Close() {}
+
+func (this *FakeSQS) ReceiveNow(ctx context.Context) (*sqs.Message, error) {
+	return this.Receive(ctx)
+}
+
+// ReceivePicking picks from the messages in queue as if they had all been
+// received already.
+func (this *FakeSQS) ReceivePicking(ctx context.Context, pick GroupPicker) (*sqs.Message, error) {
+	if pick == nil || len(this.queue) == 0 {
+		return this.Receive(ctx)
+	}
+	heads := make(map[string]int)
+	ready := []string{}
+	waiting := make(map[string]int)
+	for i, message := range this.queue {
+		group := messageGroup(message)
+		waiting[group]++
+		if _, ok := heads[group]; !ok {
+			heads[group] = i
+			ready = append(ready, group)
+		}
+	}
+	i := heads[pick(ready, waiting)]
+	message := this.queue[i]
+	this.queue = append(this.queue[:i], this.queue[i+1:]...)
+	return message, nil
 }
 
 func (this *FakeSQS) DeleteMessage(handle *string) error {
+	this.deleted = append(this.deleted, *handle)
 	return nil
 }
 
-func (this *FakeSQS) SendAll(messages []string, user string) error {
+func (this *FakeSQS) ChangeVisibility(handle *string, timeoutSeconds int64) error {
+	this.visibilityChanges = append(this.visibilityChanges, timeoutSeconds)
 	return nil
 }
 
+func (this *FakeSQS) KeepInFlight(handle *string) func() {
+	this.inFlight = append(this.inFlight, *handle)
+	return func() {}
+}
+
+func (this *FakeSQS) SendAll(ctx context.Context, messages, dedupIDs []string, user string) (*SendResult, error) {
+	if this.sent == nil {
+		this.sent = make(map[string][]string)
+	}
+	result := newSendResult()
+	for i, message := range messages {
+		if reason, ok := this.rejectSend[message]; ok {
+			result.Failed[i] = reason
+			continue
+		}
+		this.sent[user] = append(this.sent[user], message)
+		result.Enqueued = append(result.Enqueued, i)
+	}
+	return result, nil
+}
+
+type FakeQueueAge struct {
+	age   int64
+	known bool
+	err   error
+}
+
+func (this *FakeQueueAge) OldestMessageAge(ctx context.Context) (int64, bool, error) {
+	return this.age, this.known, this.err
+}
+
 func TestCalibrate(t *testing.T) {
-	service := &Service{0, 0}
 	testTables := []struct {
 		shouldError    bool
 		expectedChange CalibrationChange
+		expectedRate   int64
 		sqs            *FakeSQS
+		queueAge       QueueAge
 	}{
 		{
 			shouldError:    true,
@@ -71,6 +160,7 @@ func TestCalibrate(t *testing.T) {
 				shouldErrorOnGetQueueAttributes: false,
 				shouldErrorOnReceive:            false,
 				numMessagesInQueue:              "abc",
+				numMessagesNotVisible:           "0",
 				messageRetention:                "",
 				sentTimestampOnMessage:          "",
 			},
@@ -83,13 +173,83 @@ func TestCalibrate(t *testing.T) {
 				shouldErrorOnGetQueueAttributes: false,
 				shouldErrorOnReceive:            false,
 				numMessagesInQueue:              "10",
+				numMessagesNotVisible:           "0",
 				messageRetention:                "abc",
 				sentTimestampOnMessage:          "",
 			},
 		},
+		{
+			// messages in flight count towards the backlog, and nothing is
+			// received to work out how old they are
+			expectedChange: TWEET_SLOWER,
+			expectedRate:   100,
+			sqs: &FakeSQS{
+				shouldErrorOnReceive:  true,
+				numMessagesInQueue:    "6",
+				numMessagesNotVisible: "4",
+				messageRetention:      "1000",
+			},
+		},
+		{
+			// same on a standard queue
+			expectedChange: TWEET_SLOWER,
+			expectedRate:   100,
+			sqs: &FakeSQS{
+				shouldErrorOnReceive:  true,
+				standard:              true,
+				numMessagesInQueue:    "6",
+				numMessagesNotVisible: "4",
+				messageRetention:      "1000",
+			},
+		},
+		{
+			// the oldest message has used up some of its retention
+			expectedChange: TWEET_SLOWER,
+			expectedRate:   60,
+			sqs: &FakeSQS{
+				shouldErrorOnReceive:  true,
+				numMessagesInQueue:    "6",
+				numMessagesNotVisible: "4",
+				messageRetention:      "1000",
+			},
+			queueAge: &FakeQueueAge{age: 400, known: true},
+		},
+		{
+			// ... or all of it
+			expectedChange: TWEET_SAME,
+			expectedRate:   0,
+			sqs: &FakeSQS{
+				numMessagesInQueue:    "10",
+				numMessagesNotVisible: "0",
+				messageRetention:      "1000",
+			},
+			queueAge: &FakeQueueAge{age: 2000, known: true},
+		},
+		{
+			// the age can't be looked up
+			expectedChange: TWEET_SLOWER,
+			expectedRate:   100,
+			sqs: &FakeSQS{
+				numMessagesInQueue:    "10",
+				numMessagesNotVisible: "0",
+				messageRetention:      "1000",
+			},
+			queueAge: &FakeQueueAge{err: errors.New("access denied")},
+		},
+		{
+			// empty queue
+			expectedChange: TWEET_SAME,
+			expectedRate:   0,
+			sqs: &FakeSQS{
+				numMessagesInQueue:    "0",
+				numMessagesNotVisible: "0",
+				messageRetention:      "1000",
+			},
+		},
 	}
 
 	for _, test := range testTables {
+		service := &Service{calibrationRate: 0, tweetRate: 0, queueAge: test.queueAge}
 		change, err := service.Calibrate(context.Background(), test.sqs)
 		if test.shouldError {
 			if err == nil {
@@ -104,5 +264,223 @@ func TestCalibrate(t *testing.T) {
 		if change != test.expectedChange {
 			t.Errorf("Expected a calibration of %d, but got %d.", test.expectedChange, change)
 		}
+		if service.tweetRate != test.expectedRate {
+			t.Errorf("Expected a tweet rate of %d, but got %d.", test.expectedRate, service.tweetRate)
+		}
+	}
+}
+
+func TestRunForeverShutsDownOnCancel(t *testing.T) {
+	service := &Service{calibrationRate: 1, tweetRate: 0}
+	// An empty queue, so the tweet loop is sleeping when the cancel comes.
+	sqsAPI := &FakeSQS{
+		numMessagesInQueue:    "10",
+		numMessagesNotVisible: "0",
+		messageRetention:      "100",
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), STSContextKey("logger"), getLogger()))
+	done := make(chan error)
+	go func() {
+		done <- service.RunForever(ctx, nil, sqsAPI)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected an orderly shutdown but got %s.", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("RunForever did not return after its context was cancelled.")
+	}
+}
+
+type FakePublisher struct {
+	err   error
+	posts []*Post
+}
+
+func (this *FakePublisher) Publish(ctx context.Context, post *Post) (*PublishedPost, error) {
+	if this.err != nil {
+		return nil, this.err
+	}
+	this.posts = append(this.posts, post)
+	return &PublishedPost{ID: fmt.Sprintf("%d", len(this.posts)), Text: post.Text}, nil
+}
+
+func (this *FakePublisher) Name() string {
+	return "fake"
+}
+
+type FakeDeadLetterQueue struct {
+	records []*DeadLetterRecord
+}
+
+func (this *FakeDeadLetterQueue) Put(ctx context.Context, message *sqs.Message, reason error) error {
+	this.records = append(this.records, newDeadLetterRecord(message, reason))
+	return nil
+}
+
+func (this *FakeDeadLetterQueue) Name() string {
+	return "fake"
+}
+
+func TestTweetDeadLettersPermanentFailures(t *testing.T) {
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+	newMessage := func(body string) *sqs.Message {
+		if body == "" {
+			body = "hello"
+		}
+		return &sqs.Message{
+			MessageId:     aws.String("id"),
+			Body:          aws.String(body),
+			ReceiptHandle: aws.String("handle"),
+		}
+	}
+
+	testTables := []struct {
+		body             string
+		publishErr       error
+		deadLetters      *FakeDeadLetterQueue
+		shouldError      bool
+		expectedDeleted  int
+		expectedRecorded int
+		// Transient failures go straight back to the queue.
+		expectedVisibility []int64
+	}{
+		{
+			// permanent failure with a dead-letter destination
+			publishErr:       Permanent(errors.New("too long")),
+			deadLetters:      &FakeDeadLetterQueue{},
+			shouldError:      false,
+			expectedDeleted:  1,
+			expectedRecorded: 1,
+		},
+		{
+			// transient failures are never dead-lettered
+			publishErr:         errors.New("timeout"),
+			deadLetters:        &FakeDeadLetterQueue{},
+			shouldError:        true,
+			expectedDeleted:    0,
+			expectedRecorded:   0,
+			expectedVisibility: []int64{0},
+		},
+		{
+			// without a dead-letter destination, the message is skipped but
+			// stays put
+			publishErr:      Permanent(errors.New("too long")),
+			deadLetters:     nil,
+			shouldError:     false,
+			expectedDeleted: 0,
+		},
+		{
+			// an envelope from a newer sts is left for a newer daemon
+			body:               `{"v": 99, "text": "hello"}`,
+			deadLetters:        &FakeDeadLetterQueue{},
+			shouldError:        false,
+			expectedDeleted:    0,
+			expectedRecorded:   0,
+			expectedVisibility: []int64{UNSUPPORTED_VERSION_DELAY},
+		},
+	}
+
+	for _, test := range testTables {
+		sqsAPI := &FakeSQS{message: newMessage(test.body)}
+		service := &Service{}
+		if test.deadLetters != nil {
+			service.deadLetters = test.deadLetters
+		}
+
+		_, err := service.Tweet(ctx, &FakePublisher{err: test.publishErr}, sqsAPI)
+		if test.shouldError && err == nil {
+			t.Errorf("Expected an error but got none.")
+		}
+		if !test.shouldError && err != nil {
+			t.Errorf("Expected no error but got %s.", err)
+		}
+		if len(sqsAPI.deleted) != test.expectedDeleted {
+			t.Errorf("Expected %d deleted messages, but got %d.", test.expectedDeleted, len(sqsAPI.deleted))
+		}
+		if test.deadLetters != nil && len(test.deadLetters.records) != test.expectedRecorded {
+			t.Errorf("Expected %d dead-lettered messages, but got %d.", test.expectedRecorded, len(test.deadLetters.records))
+		}
+		if !reflect.DeepEqual(sqsAPI.visibilityChanges, test.expectedVisibility) {
+			t.Errorf("Expected visibility changes %v but got %v.", test.expectedVisibility, sqsAPI.visibilityChanges)
+		}
+		if expected := []string{"handle"}; !reflect.DeepEqual(sqsAPI.inFlight, expected) {
+			t.Errorf("Expected %v to be kept in flight but got %v.", expected, sqsAPI.inFlight)
+		}
+	}
+}
+
+func TestTweetHonorsSchedule(t *testing.T) {
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+	past := time.Now().Add(-time.Hour)
+	soon := time.Now().Add(90 * time.Second)
+	later := time.Now().Add(48 * time.Hour)
+
+	testTables := []struct {
+		envelope           *Envelope
+		expectedPosts      int
+		expectedDeleted    int
+		expectedVisibility []int64
+	}{
+		{
+			// due now
+			envelope:        &Envelope{Version: 1, Text: "hello", NotBefore: &past, NotAfter: &later},
+			expectedPosts:   1,
+			expectedDeleted: 1,
+		},
+		{
+			// not due yet
+			envelope:           &Envelope{Version: 1, Text: "hello", NotBefore: &soon},
+			expectedVisibility: []int64{90},
+		},
+		{
+			// not due for longer than SQS will hide a message
+			envelope:           &Envelope{Version: 1, Text: "hello", NotBefore: &later},
+			expectedVisibility: []int64{MAX_VISIBILITY_TIMEOUT},
+		},
+		{
+			// expired
+			envelope:        &Envelope{Version: 1, Text: "hello", NotAfter: &past},
+			expectedDeleted: 1,
+		},
+	}
+
+	for _, test := range testTables {
+		body, err := test.envelope.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sqsAPI := &FakeSQS{message: &sqs.Message{
+			MessageId:     aws.String("id"),
+			Body:          aws.String(body),
+			ReceiptHandle: aws.String("handle"),
+		}}
+		publisher := &FakePublisher{}
+
+		if _, err := (&Service{}).Tweet(ctx, publisher, sqsAPI); err != nil {
+			t.Errorf("Expected no error but got %s.", err)
+		}
+		if len(publisher.posts) != test.expectedPosts {
+			t.Errorf("Expected %d posts but got %d.", test.expectedPosts, len(publisher.posts))
+		}
+		if len(sqsAPI.deleted) != test.expectedDeleted {
+			t.Errorf("Expected %d deleted messages but got %d.", test.expectedDeleted, len(sqsAPI.deleted))
+		}
+		if len(sqsAPI.visibilityChanges) != len(test.expectedVisibility) {
+			t.Errorf("Expected visibility changes %v but got %v.", test.expectedVisibility, sqsAPI.visibilityChanges)
+			continue
+		}
+		for i, timeout := range test.expectedVisibility {
+			// Allow for the clock moving on while the test runs.
+			if got := sqsAPI.visibilityChanges[i]; got > timeout || got < timeout-1 {
+				t.Errorf("Expected a visibility timeout of %d but got %d.", timeout, got)
+			}
+		}
 	}
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// splitText breaks text that is too long for one post into parts numbered
+// "1/n", "2/n", ..., each within limit. Parts end at a sentence boundary where
+// possible, and otherwise between words; words themselves (and so URLs and
+// mentions) are never broken up. Text that already fits is returned as is.
+func splitText(text string, limit int) ([]string, error) {
+	text = strings.TrimSpace(text)
+	if tweetLength(text) <= limit {
+		return []string{text}, nil
+	}
+
+	words, seps := splitWords(text)
+	// The space each part has left depends on how wide the numbering is,
+	// which depends on how many parts there are. Guess, and widen the guess
+	// until the split agrees with it.
+	for total := 9; ; total = total*10 + 9 {
+		parts, err := fillParts(words, seps, limit, fmt.Sprintf(" %d/%d", total, total))
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) <= total {
+			for i := range parts {
+				parts[i] = fmt.Sprintf("%s %d/%d", parts[i], i+1, len(parts))
+			}
+			return parts, nil
+		}
+	}
+}
+
+// splitWords splits text on whitespace. seps[i] is the whitespace that came
+// before words[i], so paragraph breaks survive within a part.
+func splitWords(text string) (words, seps []string) {
+	start := -1
+	sepStart := 0
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				words = append(words, text[start:i])
+				start = -1
+				sepStart = i
+			}
+			continue
+		}
+		if start < 0 {
+			seps = append(seps, text[sepStart:i])
+			start = i
+		}
+	}
+	if start >= 0 {
+		words = append(words, text[start:])
+	}
+	return words, seps
+}
+
+// endsSentence reports whether a part can end after word (followed by sep).
+func endsSentence(word, sep string) bool {
+	if strings.Contains(sep, "\n") {
+		return true
+	}
+	word = strings.TrimRight(word, `"')]`)
+	return strings.HasSuffix(word, ".") || strings.HasSuffix(word, "!") || strings.HasSuffix(word, "?")
+}
+
+func fillParts(words, seps []string, limit int, suffix string) ([]string, error) {
+	parts := []string{}
+	for start := 0; start < len(words); {
+		if tweetLength(words[start]+suffix) > limit {
+			return nil, fmt.Errorf("%q is too long to fit in a post on its own.", words[start])
+		}
+
+		// Take as many words as fit, remembering the last place a
+		// sentence ended.
+		part := words[start]
+		end := start + 1
+		sentenceEnd := -1
+		for end < len(words) {
+			if endsSentence(words[end-1], seps[end]) {
+				sentenceEnd = end
+			}
+			if tweetLength(part+seps[end]+words[end]+suffix) > limit {
+				break
+			}
+			part += seps[end] + words[end]
+			end++
+		}
+		if end < len(words) && sentenceEnd > start {
+			end = sentenceEnd
+		}
+
+		parts = append(parts, joinWords(words[start:end], seps[start:end]))
+		start = end
+	}
+	return parts, nil
+}
+
+func joinWords(words, seps []string) string {
+	var builder strings.Builder
+	for i, word := range words {
+		if i > 0 {
+			builder.WriteString(seps[i])
+		}
+		builder.WriteString(word)
+	}
+	return builder.String()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitText(t *testing.T) {
+	url := "https://example.com/a/rather/long/path/that/must/not/be/broken"
+	testTables := []struct {
+		text        string
+		limit       int
+		shouldError bool
+		expected    []string
+	}{
+		{text: "short enough", limit: 20, expected: []string{"short enough"}},
+		{
+			text:     "One two three. Four five six.",
+			limit:    20,
+			expected: []string{"One two three. 1/2", "Four five six. 2/2"},
+		},
+		{
+			// Prefers the sentence boundary even though "Three" would fit.
+			text:     "One. Two Three four five",
+			limit:    16,
+			expected: []string{"One. 1/3", "Two Three 2/3", "four five 3/3"},
+		},
+		{
+			text:     "see " + url + " @someone",
+			limit:    30,
+			expected: []string{"see 1/3", url + " 2/3", "@someone 3/3"},
+		},
+		{text: "see " + url, limit: 20, shouldError: true},
+	}
+
+	for _, test := range testTables {
+		parts, err := splitText(test.text, test.limit)
+		if test.shouldError {
+			if err == nil {
+				t.Errorf("Expected an error splitting %q but got %q.", test.text, parts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error splitting %q but got %s.", test.text, err)
+			continue
+		}
+		if strings.Join(parts, "|") != strings.Join(test.expected, "|") {
+			t.Errorf("Expected %q but got %q.", test.expected, parts)
+		}
+		for _, part := range parts {
+			if tweetLength(part) > test.limit {
+				t.Errorf("Expected %q to be at most %d long but got %d.", part, test.limit, tweetLength(part))
+			}
+		}
+	}
+}
+
+func TestSplitTweetJoinsExistingThread(t *testing.T) {
+	long := strings.Repeat("word ", MAX_TWEET_LENGTH/5) + "end."
+	envelopes := []*Envelope{NewEnvelope("first"), NewEnvelope(long), NewEnvelope("last")}
+	if err := assignThreads(envelopes, []string{"t", "t", "t"}); err != nil {
+		t.Fatal(err)
+	}
+	envelopes[1].Media = []*MediaRef{{Source: "a.png"}}
+
+	parts, err := splitTweet(envelopes[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 {
+		t.Fatalf("Expected 2 parts but got %d.", len(parts))
+	}
+	if len(parts[0].Media) != 1 || len(parts[1].Media) != 0 {
+		t.Errorf("Expected media on the first part only but got %v and %v.", parts[0].Media, parts[1].Media)
+	}
+
+	expanded := append([]*Envelope{envelopes[0]}, append(parts, envelopes[2])...)
+	renumberThreads(expanded)
+	for i, envelope := range expanded {
+		if envelope.Thread.ID != envelopes[0].Thread.ID || envelope.Thread.Index != i || envelope.Thread.Total != 4 {
+			t.Errorf("Expected part %d/4 of %s but got %+v.", i, envelopes[0].Thread.ID, envelope.Thread)
+		}
+	}
+}
@@ -2,33 +2,164 @@ package main
 
 import (
 	"context"
-	"errors"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 )
 
 type SQSConfig struct {
 	queueName, region string
+	// How long Receive waits for a message to arrive, in seconds. 0 means
+	// short polling.
+	waitTimeSeconds int64
+	// How many messages to receive at once.
+	prefetch int64
+	// How long received messages stay hidden from other receivers, in
+	// seconds. 0 means the queue's own visibility timeout.
+	visibilityTimeout int64
 }
 
+// MAX_VISIBILITY_TIMEOUT is the longest SQS lets a received message stay
+// hidden, in seconds.
+const MAX_VISIBILITY_TIMEOUT = 12 * 60 * 60
+
+// MAX_WAIT_TIME is the longest SQS will long poll for, in seconds.
+const MAX_WAIT_TIME = 20
+
+// DEFAULT_VISIBILITY_TIMEOUT is what SQS uses for queues that don't set one,
+// in seconds.
+const DEFAULT_VISIBILITY_TIMEOUT = 30
+
+// Message attributes used on standard queues, which have neither message
+// groups nor ordering of their own.
+const (
+	GROUP_ATTRIBUTE    = "sts-group"
+	SEQUENCE_ATTRIBUTE = "sts-sequence"
+)
+
+// MAX_SAMPLED_GROUPS is how many more receives ReceivePicking makes, looking
+// for other groups, before picking.
+const MAX_SAMPLED_GROUPS = 10
+
+// GroupPicker chooses which message group to hand out a message from. ready
+// lists the groups with a message ready, in the order they'd be handed out
+// otherwise. waiting counts the messages received from each group that haven't
+// been handed out yet, whether they're ready or not. That's only what's been
+// received, at most prefetch per receive, so it's a lower bound on each
+// group's backlog rather than the whole of it.
+type GroupPicker func(ready []string, waiting map[string]int) string
+
 type SQS interface {
 	GetQueueAttributes(*sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error)
+	// Receive returns the next message, waiting for one to arrive if the
+	// queue is configured to long poll. It returns nil, and no error, if the
+	// queue is empty.
 	Receive(context.Context) (*sqs.Message, error)
+	// ReceiveNow is Receive without the waiting.
+	ReceiveNow(context.Context) (*sqs.Message, error)
+	// ReceivePicking is Receive, except that pick, if it's not nil, chooses
+	// which of the message groups with a message ready to hand out that
+	// message comes from.
+	ReceivePicking(context.Context, GroupPicker) (*sqs.Message, error)
 	DeleteMessage(*string) error
-	SendAll([]string, string) error
+	ChangeVisibility(*string, int64) error
+	// KeepInFlight keeps a received message hidden from other receivers
+	// until the returned function is called, or the message is deleted or has
+	// its visibility changed, by extending its visibility timeout before it
+	// runs out.
+	KeepInFlight(*string) func()
+	// SendAll enqueues messages to a group, in order. On a FIFO queue, the
+	// second argument gives each message's deduplication ID, or is nil to
+	// leave deduplication to the queue.
+	SendAll(context.Context, []string, []string, string) (*SendResult, error)
+	// IsFIFO reports whether the queue is a FIFO queue, rather than a
+	// standard one.
+	IsFIFO() bool
+	// Close makes any messages that were received but never handed out
+	// visible again.
+	Close()
 }
 
+// SQSImpl talks to either kind of queue. FIFO queues keep each message group
+// in order by themselves. On standard queues, the group and a sequence number
+// are sent as message attributes instead, and Receive hands out the earliest
+// message of those it has. That only restores order approximately: standard
+// queues can also deliver a message more than once.
+//
+// Messages are received up to prefetch at a time, and handed out one by one.
+// As SQS itself does for FIFO queues, a FIFO message is never handed out while
+// an earlier one from its group is still being worked on (handed out, but not
+// yet deleted or made visible again). Buffered messages are released back to
+// the queue rather than held for more than half their visibility timeout, so
+// they never reappear on the queue while sts still has them.
 type SQSImpl struct {
-	sqsClient *sqs.SQS
+	sqsClient sqsiface.SQSAPI
 	queueURL  string
+	fifo      bool
+	// How to retry batch entries that fail through no fault of ours. Uses
+	// defaultSendRetrier if nil.
+	sendRetrier Retrier
+
+	waitTimeSeconds int64
+	prefetch        int64
+	// How long received messages stay hidden, in seconds.
+	visibilityTimeout int64
+	// How long a received message can be held before it's released.
+	holdTime time.Duration
+	// How often KeepInFlight extends a message's visibility timeout.
+	heartbeatInterval time.Duration
+
+	lock sync.Mutex
+	// Messages received but not handed out yet, in the order to hand them
+	// out.
+	buffer []*bufferedMessage
+	// Receipt handle -> messages handed out and not yet deleted or released.
+	outstanding map[string]*bufferedMessage
+	// Receipt handle -> the heartbeat keeping it in flight.
+	heartbeats map[string]*heartbeat
+}
+
+type bufferedMessage struct {
+	message *sqs.Message
+	group   string
+	// When the message's visibility timeout was last (re)started.
+	hiddenAt time.Time
+}
+
+type heartbeat struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+var defaultSendRetrier = &ExponentialRetrier{
+	initialDelayMillis: 200,
+	maxDelayMillis:     5000,
+	maxAttempts:        5,
+	description:        "send failed batch entries",
 }
 
 func NewSQS(conf *SQSConfig) (SQS, error) {
+	if conf.waitTimeSeconds < 0 || conf.waitTimeSeconds > MAX_WAIT_TIME {
+		return nil, fmt.Errorf("Wait time must be between 0 and %d seconds. Got %d.", MAX_WAIT_TIME, conf.waitTimeSeconds)
+	}
+	if conf.prefetch > SQS_MAX_BATCH_SIZE {
+		return nil, fmt.Errorf("Cannot prefetch more than %d messages at once. Got %d.", SQS_MAX_BATCH_SIZE, conf.prefetch)
+	}
+	if conf.visibilityTimeout < 0 || conf.visibilityTimeout > MAX_VISIBILITY_TIMEOUT {
+		return nil, fmt.Errorf("Visibility timeout must be between 0 and %d seconds. Got %d.", MAX_VISIBILITY_TIMEOUT, conf.visibilityTimeout)
+	}
+
 	sess := session.Must(session.NewSession())
 	client := sqs.New(sess, &aws.Config{Region: aws.String(conf.region)})
 
@@ -41,11 +172,85 @@ func NewSQS(conf *SQSConfig) (SQS, error) {
 	if err != nil {
 		return nil, err
 	}
-	sqsImpl := SQSImpl{
-		sqsClient: client,
-		queueURL:  *output.QueueUrl,
+
+	// Only FIFO queues have the FifoQueue attribute at all.
+	attributes, err := client.GetQueueAttributes(
+		&sqs.GetQueueAttributesInput{
+			QueueUrl:       output.QueueUrl,
+			AttributeNames: aws.StringSlice([]string{"FifoQueue", "VisibilityTimeout"}),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	fifo := aws.StringValue(attributes.Attributes["FifoQueue"]) == "true"
+	if !fifo {
+		log.Printf("Queue %s is a standard queue. Tweets will be ordered by sequence number rather than by SQS.\n", conf.queueName)
 	}
-	return &sqsImpl, nil
+
+	visibilityTimeout := conf.visibilityTimeout
+	if visibilityTimeout == 0 {
+		visibilityTimeout, err = strconv.ParseInt(aws.StringValue(attributes.Attributes["VisibilityTimeout"]), 10, 64)
+		if err != nil || visibilityTimeout == 0 {
+			visibilityTimeout = DEFAULT_VISIBILITY_TIMEOUT
+		}
+	}
+	return newSQSImpl(client, *output.QueueUrl, fifo, &SQSConfig{
+		waitTimeSeconds:   conf.waitTimeSeconds,
+		prefetch:          conf.prefetch,
+		visibilityTimeout: visibilityTimeout,
+	}), nil
+}
+
+func newSQSImpl(client sqsiface.SQSAPI, queueURL string, fifo bool, conf *SQSConfig) *SQSImpl {
+	prefetch := conf.prefetch
+	if prefetch < 1 {
+		prefetch = 1
+	}
+	if prefetch > SQS_MAX_BATCH_SIZE {
+		prefetch = SQS_MAX_BATCH_SIZE
+	}
+	visibilityTimeout := conf.visibilityTimeout
+	if visibilityTimeout < 1 {
+		visibilityTimeout = DEFAULT_VISIBILITY_TIMEOUT
+	}
+	return &SQSImpl{
+		sqsClient:         client,
+		queueURL:          queueURL,
+		fifo:              fifo,
+		waitTimeSeconds:   conf.waitTimeSeconds,
+		prefetch:          prefetch,
+		visibilityTimeout: visibilityTimeout,
+		holdTime:          time.Duration(visibilityTimeout) * time.Second / 2,
+		// A third, so that one failed extension still leaves time for
+		// another before the timeout runs out.
+		heartbeatInterval: time.Duration(visibilityTimeout) * time.Second / 3,
+		outstanding:       make(map[string]*bufferedMessage),
+		heartbeats:        make(map[string]*heartbeat),
+	}
+}
+
+func (this *SQSImpl) IsFIFO() bool {
+	return this.fifo
+}
+
+func (this *SQSImpl) Close() {
+	this.lock.Lock()
+	buffered := make([]*sqs.Message, len(this.buffer))
+	for i, message := range this.buffer {
+		buffered[i] = message.message
+	}
+	this.buffer = nil
+	handles := make([]string, 0, len(this.heartbeats))
+	for handle := range this.heartbeats {
+		handles = append(handles, handle)
+	}
+	this.lock.Unlock()
+
+	for _, handle := range handles {
+		this.stopHeartbeat(handle)
+	}
+	this.release(buffered)
 }
 
 func (this *SQSImpl) GetQueueAttributes(input *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
@@ -55,37 +260,281 @@ func (this *SQSImpl) GetQueueAttributes(input *sqs.GetQueueAttributesInput) (*sq
 }
 
 func (this *SQSImpl) Receive(ctx context.Context) (*sqs.Message, error) {
+	return this.receive(ctx, this.waitTimeSeconds, nil)
+}
+
+func (this *SQSImpl) ReceiveNow(ctx context.Context) (*sqs.Message, error) {
+	return this.receive(ctx, 0, nil)
+}
+
+// ReceivePicking first receives from as many other groups as have messages
+// waiting, up to MAX_SAMPLED_GROUPS more, so that one group with a big
+// backlog can't crowd the rest out of what pick sees. A FIFO queue hands out
+// as many messages from one group as it can, and none from a group that
+// already has messages in flight, so each receive turns up new groups until
+// there are none left. The messages that aren't picked stay in the buffer, and
+// are released if they aren't handed out within the hold time, so each
+// sampled group's next message is received about once per tweet. Leave room
+// for that in a redrive policy's maxReceiveCount.
+func (this *SQSImpl) ReceivePicking(ctx context.Context, pick GroupPicker) (*sqs.Message, error) {
+	return this.receive(ctx, this.waitTimeSeconds, pick)
+}
+
+func (this *SQSImpl) receive(ctx context.Context, waitTimeSeconds int64, pick GroupPicker) (*sqs.Message, error) {
 	logger, ok := ctx.Value(STSContextKey("logger")).(*log.Logger)
 	if !ok {
 		return nil, NoLoggerInContext()
 	}
-	var maxMessages int64 = 1
-	sentTimestampAttribute := "SentTimestamp"
-	logger.Printf("[sqs_receive]: Retrieving one message from %s.\n", this.queueURL)
-	resp, err := this.sqsClient.ReceiveMessage(
-		&sqs.ReceiveMessageInput{
-			QueueUrl:            &this.queueURL,
-			MaxNumberOfMessages: &maxMessages,
-			AttributeNames:      []*string{&sentTimestampAttribute},
-		},
-	)
 
-	if err != nil {
+	this.lock.Lock()
+	stale := this.expire()
+	var message *sqs.Message
+	if pick == nil {
+		message = this.next(nil)
+	}
+	this.lock.Unlock()
+	this.release(stale)
+	if message != nil {
+		logger.Println("[sqs_receive]: Handing out a buffered message.")
+		return message, nil
+	}
+
+	if pick != nil {
+		for i := 0; i < MAX_SAMPLED_GROUPS; i++ {
+			this.lock.Lock()
+			groups := this.bufferedGroups()
+			this.lock.Unlock()
+			received, err := this.fetch(ctx, logger, 0)
+			if err != nil {
+				return nil, err
+			}
+			this.lock.Lock()
+			more := this.bufferedGroups() > groups
+			this.lock.Unlock()
+			if received == 0 || !more {
+				break
+			}
+		}
+		this.lock.Lock()
+		message = this.next(pick)
+		this.lock.Unlock()
+		if message != nil {
+			return message, nil
+		}
+	}
+
+	if _, err := this.fetch(ctx, logger, waitTimeSeconds); err != nil {
 		return nil, err
 	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	message = this.next(pick)
+	if message == nil {
+		logger.Println("[sqs_receive]: No message available.")
+	}
+	return message, nil
+}
 
-	messages := resp.Messages
-	if len(messages) > 0 {
-		logger.Println("[sqs_receive]: Message received.")
-		message := messages[0]
-		return message, nil
+// fetch receives up to prefetch messages into the buffer, and returns how many
+// there were.
+func (this *SQSImpl) fetch(ctx context.Context, logger *log.Logger, waitTimeSeconds int64) (int, error) {
+	sentTimestampAttribute := "SentTimestamp"
+	messageGroupIDAttribute := "MessageGroupId"
+	receiveCountAttribute := "ApproximateReceiveCount"
+	input := &sqs.ReceiveMessageInput{
+		QueueUrl:            &this.queueURL,
+		MaxNumberOfMessages: aws.Int64(this.prefetch),
+		WaitTimeSeconds:     aws.Int64(waitTimeSeconds),
+		VisibilityTimeout:   aws.Int64(this.visibilityTimeout),
+		AttributeNames:      []*string{&sentTimestampAttribute, &messageGroupIDAttribute, &receiveCountAttribute},
+	}
+	if !this.fifo {
+		input.MessageAttributeNames = aws.StringSlice([]string{GROUP_ATTRIBUTE, SEQUENCE_ATTRIBUTE})
+	}
+	logger.Printf("[sqs_receive]: Retrieving up to %d messages from %s, waiting up to %d seconds.\n", this.prefetch, this.queueURL, waitTimeSeconds)
+	resp, err := this.sqsClient.ReceiveMessageWithContext(ctx, input)
+	if err != nil {
+		return 0, err
+	}
+	logger.Printf("[sqs_receive]: Received %d messages.\n", len(resp.Messages))
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.add(resp.Messages)
+	return len(resp.Messages), nil
+}
+
+// bufferedGroups counts the groups with messages in the buffer. Must be called
+// with the lock held.
+func (this *SQSImpl) bufferedGroups() int {
+	groups := make(map[string]bool)
+	for _, buffered := range this.buffer {
+		groups[buffered.group] = true
+	}
+	return len(groups)
+}
+
+// add buffers newly received messages. On a standard queue, the buffer is
+// kept sorted by sequence number. Each message's group is copied to where
+// FIFO queues put it, so the rest of sts doesn't need to care which kind of
+// queue it came from. Must be called with the lock held.
+func (this *SQSImpl) add(messages []*sqs.Message) {
+	now := time.Now()
+	for _, message := range messages {
+		if group, ok := message.MessageAttributes[GROUP_ATTRIBUTE]; ok && group.StringValue != nil {
+			if message.Attributes == nil {
+				message.Attributes = make(map[string]*string)
+			}
+			message.Attributes["MessageGroupId"] = group.StringValue
+		}
+		this.buffer = append(this.buffer, &bufferedMessage{
+			message:  message,
+			group:    messageGroup(message),
+			hiddenAt: now,
+		})
+	}
+	if !this.fifo {
+		sort.SliceStable(this.buffer, func(i, j int) bool {
+			return messageSequence(this.buffer[i].message) < messageSequence(this.buffer[j].message)
+		})
+	}
+}
+
+// next hands out the first buffered message whose group (on a FIFO queue)
+// has nothing else outstanding, or nil if there isn't one. If pick is set, it
+// chooses the group instead, and gets that group's first message. Must be
+// called with the lock held.
+func (this *SQSImpl) next(pick GroupPicker) *sqs.Message {
+	busy := make(map[string]bool, len(this.outstanding))
+	for _, outstanding := range this.outstanding {
+		if this.fifo {
+			busy[outstanding.group] = true
+		}
+	}
+	// group -> index in the buffer of its first ready message
+	heads := make(map[string]int)
+	ready := []string{}
+	waiting := make(map[string]int)
+	for i, buffered := range this.buffer {
+		waiting[buffered.group]++
+		if busy[buffered.group] {
+			continue
+		}
+		if _, ok := heads[buffered.group]; !ok {
+			heads[buffered.group] = i
+			ready = append(ready, buffered.group)
+		}
+	}
+	if len(ready) == 0 {
+		return nil
+	}
+
+	i := heads[ready[0]]
+	if pick != nil {
+		if picked, ok := heads[pick(ready, waiting)]; ok {
+			i = picked
+		}
+	}
+	buffered := this.buffer[i]
+	this.buffer = append(this.buffer[:i], this.buffer[i+1:]...)
+	this.outstanding[aws.StringValue(buffered.message.ReceiptHandle)] = buffered
+	return buffered.message
+}
+
+// expire takes the buffered messages that have been held too long out of the
+// buffer, for the caller to release, and forgets outstanding messages whose
+// visibility timeout must have run out. Must be called with the lock held.
+func (this *SQSImpl) expire() []*sqs.Message {
+	now := time.Now()
+	stale := []*sqs.Message{}
+	kept := this.buffer[:0]
+	for _, buffered := range this.buffer {
+		if now.Sub(buffered.hiddenAt) >= this.holdTime {
+			stale = append(stale, buffered.message)
+			continue
+		}
+		kept = append(kept, buffered)
+	}
+	this.buffer = kept
+
+	for handle, outstanding := range this.outstanding {
+		if now.Sub(outstanding.hiddenAt) >= 2*this.holdTime {
+			delete(this.outstanding, handle)
+		}
 	}
-	logger.Println("[sqs_receive]: No message received from queue.")
-	return nil, errors.New("No message received from queue.")
+	return stale
+}
+
+// takeGroup removes the message with receiptHandle from the outstanding ones.
+// On a FIFO queue, every buffered message from the same group is taken out of
+// the buffer too, and returned for the caller to release. Must be called with
+// the lock held.
+func (this *SQSImpl) takeGroup(receiptHandle string) []*sqs.Message {
+	outstanding, ok := this.outstanding[receiptHandle]
+	if !ok {
+		return nil
+	}
+	delete(this.outstanding, receiptHandle)
+	if !this.fifo {
+		return nil
+	}
+
+	taken := []*sqs.Message{}
+	kept := this.buffer[:0]
+	for _, buffered := range this.buffer {
+		if buffered.group == outstanding.group {
+			taken = append(taken, buffered.message)
+			continue
+		}
+		kept = append(kept, buffered)
+	}
+	this.buffer = kept
+	return taken
+}
+
+// release makes buffered messages visible to receivers again. If that fails,
+// they come back by themselves once their visibility timeout runs out.
+func (this *SQSImpl) release(messages []*sqs.Message) {
+	for i := 0; i < len(messages); i += SQS_MAX_BATCH_SIZE {
+		entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, 0, SQS_MAX_BATCH_SIZE)
+		for j := 0; j < SQS_MAX_BATCH_SIZE && i+j < len(messages); j++ {
+			entries = append(entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{
+				Id:                aws.String(strconv.Itoa(i + j)),
+				ReceiptHandle:     messages[i+j].ReceiptHandle,
+				VisibilityTimeout: aws.Int64(0),
+			})
+		}
+		_, err := this.sqsClient.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{
+			QueueUrl: &this.queueURL,
+			Entries:  entries,
+		})
+		if err != nil {
+			log.Printf("[sqs_receive]: Could not release %d buffered messages: %s\n", len(entries), err)
+		}
+	}
+}
+
+// messageSequence is the sequence number sent with a message to a standard
+// queue, or 0 if it doesn't have one.
+func messageSequence(message *sqs.Message) int64 {
+	attribute, ok := message.MessageAttributes[SEQUENCE_ATTRIBUTE]
+	if !ok || attribute.StringValue == nil {
+		return 0
+	}
+	sequence, err := strconv.ParseInt(*attribute.StringValue, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return sequence
 }
 
 func (this *SQSImpl) DeleteMessage(receiptHandle *string) error {
 	log.Println("Deleting message from queue.")
+	this.stopHeartbeat(aws.StringValue(receiptHandle))
+	this.lock.Lock()
+	delete(this.outstanding, aws.StringValue(receiptHandle))
+	this.lock.Unlock()
+
 	_, err := this.sqsClient.DeleteMessage(
 		&sqs.DeleteMessageInput{
 			QueueUrl:      &this.queueURL,
@@ -95,40 +544,327 @@ func (this *SQSImpl) DeleteMessage(receiptHandle *string) error {
 	return err
 }
 
+// ChangeVisibility hides a received message for another timeoutSeconds
+// (counted from now), or makes it visible again immediately if timeoutSeconds
+// is 0. Either way, on a FIFO queue the buffered messages from its group go
+// back to the queue with it, so that none of them overtakes it.
+func (this *SQSImpl) ChangeVisibility(receiptHandle *string, timeoutSeconds int64) error {
+	log.Printf("Changing message visibility timeout to %d seconds.\n", timeoutSeconds)
+	this.stopHeartbeat(aws.StringValue(receiptHandle))
+	this.lock.Lock()
+	behind := this.takeGroup(aws.StringValue(receiptHandle))
+	this.lock.Unlock()
+
+	_, err := this.sqsClient.ChangeMessageVisibility(
+		&sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          &this.queueURL,
+			ReceiptHandle:     receiptHandle,
+			VisibilityTimeout: &timeoutSeconds,
+		},
+	)
+	this.release(behind)
+	return err
+}
+
+func (this *SQSImpl) KeepInFlight(receiptHandle *string) func() {
+	handle := aws.StringValue(receiptHandle)
+	stop := func() { this.stopHeartbeat(handle) }
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, ok := this.heartbeats[handle]; ok {
+		return stop
+	}
+	beat := &heartbeat{stop: make(chan struct{}), done: make(chan struct{})}
+	this.heartbeats[handle] = beat
+
+	go func() {
+		defer close(beat.done)
+		ticker := time.NewTicker(this.heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-beat.stop:
+				return
+			case <-ticker.C:
+				this.extend(receiptHandle)
+			}
+		}
+	}()
+	return stop
+}
+
+// extend restarts a message's visibility timeout. If that fails, the next
+// heartbeat tries again.
+func (this *SQSImpl) extend(receiptHandle *string) {
+	_, err := this.sqsClient.ChangeMessageVisibility(
+		&sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          &this.queueURL,
+			ReceiptHandle:     receiptHandle,
+			VisibilityTimeout: aws.Int64(this.visibilityTimeout),
+		},
+	)
+	if err != nil {
+		log.Printf("[sqs_heartbeat]: Could not extend the visibility timeout of a message in flight: %s\n", err)
+		return
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if outstanding, ok := this.outstanding[aws.StringValue(receiptHandle)]; ok {
+		outstanding.hiddenAt = time.Now()
+	}
+}
+
+// stopHeartbeat stops keeping a message in flight, and waits for any
+// extension already underway to finish, so that it can't undo a visibility
+// change that comes after it.
+func (this *SQSImpl) stopHeartbeat(receiptHandle string) {
+	this.lock.Lock()
+	beat, ok := this.heartbeats[receiptHandle]
+	delete(this.heartbeats, receiptHandle)
+	this.lock.Unlock()
+	if !ok {
+		return
+	}
+	close(beat.stop)
+	<-beat.done
+}
+
 func (this *SQSImpl) SendMessageBatch(input *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
 	input.QueueUrl = &this.queueURL
 	return this.sqsClient.SendMessageBatch(input)
 }
 
-func (this *SQSImpl) SendAll(messages []string, group string) error {
-	log.Printf("[sqs_sendall]: Sending %d messages in batches of 10.\n", len(messages))
-	for i := 0; i < len(messages); i += 10 {
+// SQS_MAX_BATCH_SIZE is the most messages SendMessageBatch accepts at once.
+const SQS_MAX_BATCH_SIZE = 10
+
+// messageDeduplicationID identifies the tweet in a message body, so that
+// sending the same tweet to the same group twice only enqueues it once. The
+// whole envelope counts, media and schedule included, except for what changes
+// every time a batch is enqueued: the version and the thread ID. The text is
+// normalized, so that differences in whitespace or Unicode form don't count.
+// Bodies that aren't tweets are identified by the whole body.
+func messageDeduplicationID(body, group string) string {
+	key := body
+	if envelope, err := DecodeEnvelope(body); err == nil {
+		stable := *envelope
+		stable.Version = 0
+		stable.Text = normalizeText(envelope.Text)
+		if envelope.Thread != nil {
+			thread := *envelope.Thread
+			thread.ID = ""
+			stable.Thread = &thread
+		}
+		if encoded, err := json.Marshal(&stable); err == nil {
+			key = string(encoded)
+		}
+	}
+	hash := sha256.Sum256([]byte(group + "\x00" + key))
+	return hex.EncodeToString(hash[:])
+}
+
+// sendBatches splits messages into the SendMessageBatch requests that enqueue
+// them, in order, to group. Entry IDs are the messages' indexes. On a FIFO
+// queue, dedupIDs[i] is sent as the deduplication ID of messages[i]; if
+// dedupIDs is nil, the queue deduplicates on content by itself.
+//
+// Standard queues reject group and deduplication IDs, so for those the group
+// goes in a message attribute, along with a sequence number to order by. The
+// sequence numbers start from the current time, so that later batches sort
+// after earlier ones.
+func sendBatches(messages, dedupIDs []string, group string, fifo bool) [][]*sqs.SendMessageBatchRequestEntry {
+	sequence := time.Now().UnixNano()
+	batches := [][]*sqs.SendMessageBatchRequestEntry{}
+	for i := 0; i < len(messages); i += SQS_MAX_BATCH_SIZE {
 		entries := make([]*sqs.SendMessageBatchRequestEntry, 0)
-		for j := 0; j < 10 && i+j < len(messages); j++ {
-			id := fmt.Sprintf("%d", i+j)
+		for j := 0; j < SQS_MAX_BATCH_SIZE && i+j < len(messages); j++ {
 			entry := &sqs.SendMessageBatchRequestEntry{
-				Id:             &id,
-				MessageGroupId: &group,
-				MessageBody:    &messages[i+j],
+				Id:          aws.String(strconv.Itoa(i + j)),
+				MessageBody: aws.String(messages[i+j]),
+			}
+			if fifo {
+				entry.MessageGroupId = aws.String(group)
+				if dedupIDs != nil {
+					entry.MessageDeduplicationId = aws.String(dedupIDs[i+j])
+				}
+			} else {
+				entry.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+					SEQUENCE_ATTRIBUTE: {
+						DataType:    aws.String("Number"),
+						StringValue: aws.String(strconv.FormatInt(sequence+int64(i+j), 10)),
+					},
+				}
+				if group != "" {
+					entry.MessageAttributes[GROUP_ATTRIBUTE] = &sqs.MessageAttributeValue{
+						DataType:    aws.String("String"),
+						StringValue: aws.String(group),
+					}
+				}
 			}
 			entries = append(entries, entry)
 		}
-		log.Printf("[sqs_sendall]: Sending %d messages to SQS.\n", len(entries))
+		batches = append(batches, entries)
+	}
+	return batches
+}
+
+// SendResult says what became of each message passed to SendAll, by its
+// index in the messages.
+type SendResult struct {
+	Enqueued []int
+	// Index -> why the message was given up on.
+	Failed map[int]string
+	// Messages that only went through on a retry, after a later message in
+	// the same group had already been enqueued. On a FIFO queue, they'll be
+	// received out of order.
+	Reordered []int
+}
+
+func newSendResult() *SendResult {
+	return &SendResult{Enqueued: []int{}, Failed: make(map[int]string)}
+}
+
+// Err summarises the messages that weren't enqueued, or returns nil if they
+// all were.
+func (this *SendResult) Err() error {
+	if len(this.Failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d messages could not be enqueued.", len(this.Failed), len(this.Failed)+len(this.Enqueued))
+}
+
+// FailedIndexes returns the indexes of the messages that weren't enqueued, in
+// order.
+func (this *SendResult) FailedIndexes() []int {
+	indexes := make([]int, 0, len(this.Failed))
+	for i := range this.Failed {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// SendAll enqueues messages to group, in order. Entries that SQS rejects
+// through no fault of ours are retried with backoff before moving on to the
+// next batch, so that ordering within the group is kept as far as possible;
+// entries rejected as our fault are never retried. If a whole request fails,
+// or ctx is cancelled while waiting to retry, SendAll stops there, counts
+// everything not yet enqueued as failed, and returns the error alongside the
+// result.
+func (this *SQSImpl) SendAll(ctx context.Context, messages, dedupIDs []string, group string) (*SendResult, error) {
+	logger, ok := ctx.Value(STSContextKey("logger")).(*log.Logger)
+	if !ok {
+		return nil, NoLoggerInContext()
+	}
+	logger.Printf("[sqs_sendall]: Sending %d messages in batches of %d.\n", len(messages), SQS_MAX_BATCH_SIZE)
+	result := newSendResult()
+	batches := sendBatches(messages, dedupIDs, group, this.fifo)
+	for b, entries := range batches {
+		if err := this.sendBatch(ctx, logger, entries, result); err != nil {
+			for _, remaining := range batches[b:] {
+				for _, entry := range remaining {
+					id, _ := strconv.Atoi(*entry.Id)
+					if _, ok := result.Failed[id]; !ok && !containsInt(result.Enqueued, id) {
+						result.Failed[id] = err.Error()
+					}
+				}
+			}
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// sendBatch sends one batch, retrying the entries that fail retryably, and
+// records the outcome of each entry in result. SQS enqueues the entries after
+// a failed one regardless, and there's no taking them back, so a retried entry
+// can end up behind them. On a FIFO queue, that's recorded in
+// result.Reordered.
+func (this *SQSImpl) sendBatch(ctx context.Context, logger *log.Logger, entries []*sqs.SendMessageBatchRequestEntry, result *SendResult) error {
+	retrier := this.sendRetrier
+	if retrier == nil {
+		retrier = defaultSendRetrier
+	}
+	for attempt := 0; len(entries) > 0; attempt++ {
+		logger.Printf("[sqs_sendall]: Sending %d messages to SQS.\n", len(entries))
 		output, err := this.SendMessageBatch(&sqs.SendMessageBatchInput{
 			Entries: entries,
 		})
-		for j := 0; j < len(output.Failed); j++ {
-			batchErrorEntry := output.Failed[j]
-			id, err := strconv.Atoi(*batchErrorEntry.Id)
-			if err != nil {
-				log.Printf("[sqs_sendall_failure]: Cannot parse message id %s as int.\n", *batchErrorEntry.Id)
-				continue
-			}
-			log.Printf("[sqs_sendall]: Failed to enqueue %s\n", messages[id])
-		}
 		if err != nil {
 			return err
 		}
+
+		succeeded := make(map[string]bool, len(output.Successful))
+		for _, success := range output.Successful {
+			succeeded[aws.StringValue(success.Id)] = true
+		}
+		failures := make(map[string]*sqs.BatchResultErrorEntry, len(output.Failed))
+		for _, failure := range output.Failed {
+			failures[aws.StringValue(failure.Id)] = failure
+		}
+
+		retry := make([]*sqs.SendMessageBatchRequestEntry, 0)
+		for _, entry := range entries {
+			id, _ := strconv.Atoi(*entry.Id)
+			failure, failed := failures[*entry.Id]
+			switch {
+			case failed:
+				reason := fmt.Sprintf("%s: %s", aws.StringValue(failure.Code), aws.StringValue(failure.Message))
+				if aws.BoolValue(failure.SenderFault) {
+					logger.Printf("[sqs_sendall_failure]: Message %d was rejected (%s). Not retrying it.\n", id, reason)
+					result.Failed[id] = reason
+					continue
+				}
+				if attempt+1 >= retrier.MaxAttempts() {
+					logger.Printf("[sqs_sendall_failure]: Message %d failed %d times (%s). Giving up on it.\n", id, attempt+1, reason)
+					result.Failed[id] = reason
+					continue
+				}
+				logger.Printf("[sqs_sendall]: Message %d failed (%s). Retrying it.\n", id, reason)
+				retry = append(retry, entry)
+			case succeeded[*entry.Id]:
+				if this.fifo && attempt > 0 && enqueuedAfter(result.Enqueued, id) {
+					logger.Printf("[sqs_sendall_failure]: Message %d was enqueued after later messages in its group. It will be received out of order.\n", id)
+					result.Reordered = append(result.Reordered, id)
+				}
+				result.Enqueued = append(result.Enqueued, id)
+			default:
+				// SQS should account for every entry one way or the other,
+				// but don't lose track of any it leaves out.
+				result.Failed[id] = "SQS did not report an outcome for this message."
+			}
+		}
+
+		entries = retry
+		if len(entries) > 0 {
+			select {
+			case <-time.After(time.Duration(retrier.NextDelayMillis(attempt)) * time.Millisecond):
+			case <-ctx.Done():
+				logger.Printf("[sqs_sendall_failure]: Giving up on %d messages: %s.\n", len(entries), ctx.Err())
+				return ctx.Err()
+			}
+		}
 	}
 	return nil
 }
+
+// enqueuedAfter reports whether any message after the one at index has been
+// enqueued.
+func enqueuedAfter(enqueued []int, index int) bool {
+	for _, i := range enqueued {
+		if i > index {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
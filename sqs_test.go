@@ -0,0 +1,600 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// FakeSQSClient answers SendMessageBatch from a script: failures[body] is the
+// outcome of each successive attempt to send that body, and anything not
+// listed (or past the end of its list) succeeds.
+type FakeSQSClient struct {
+	sqsiface.SQSAPI
+	failures map[string][]*sqs.BatchResultErrorEntry
+	attempts map[string]int
+	// Fail the whole request on this call (1-based), if non-zero.
+	errorOnCall int
+	calls       int
+	// The bodies sent in each SendMessageBatch request.
+	requests [][]string
+	// Returned by every ReceiveMessage.
+	received []*sqs.Message
+	// If set, ReceiveMessage hands these out instead, as a FIFO queue would:
+	// as many as it can from the first group without messages in flight.
+	fifoQueue []*sqs.Message
+	inFlight  map[string]bool
+	// Receipt handles made visible again.
+	released []string
+	receives int
+	// The most recent ReceiveMessage request.
+	lastReceive *sqs.ReceiveMessageInput
+	// Every ChangeMessageVisibility timeout, which heartbeats set from
+	// their own goroutine.
+	lock               sync.Mutex
+	visibilityTimeouts []int64
+}
+
+func (this *FakeSQSClient) SendMessageBatch(input *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	this.calls++
+	if this.calls == this.errorOnCall {
+		return nil, errors.New("connection reset")
+	}
+	if this.attempts == nil {
+		this.attempts = make(map[string]int)
+	}
+	output := &sqs.SendMessageBatchOutput{}
+	bodies := []string{}
+	for _, entry := range input.Entries {
+		bodies = append(bodies, *entry.MessageBody)
+	}
+	this.requests = append(this.requests, bodies)
+	for _, entry := range input.Entries {
+		body := *entry.MessageBody
+		attempt := this.attempts[body]
+		this.attempts[body]++
+		if script := this.failures[body]; attempt < len(script) && script[attempt] != nil {
+			failure := *script[attempt]
+			failure.Id = entry.Id
+			output.Failed = append(output.Failed, &failure)
+			continue
+		}
+		output.Successful = append(output.Successful, &sqs.SendMessageBatchResultEntry{Id: entry.Id})
+	}
+	return output, nil
+}
+
+func TestSendAll(t *testing.T) {
+	throttled := &sqs.BatchResultErrorEntry{Code: aws.String("ServiceUnavailable"), Message: aws.String("slow down"), SenderFault: aws.Bool(false)}
+	invalid := &sqs.BatchResultErrorEntry{Code: aws.String("InvalidMessageContents"), Message: aws.String("bad"), SenderFault: aws.Bool(true)}
+
+	testTables := []struct {
+		messages         []string
+		failures         map[string][]*sqs.BatchResultErrorEntry
+		errorOnCall      int
+		expectedEnqueued []int
+		expectedFailed   []int
+		shouldError      bool
+	}{
+		{
+			[]string{"a", "b", "c"},
+			nil,
+			0,
+			[]int{0, 1, 2},
+			[]int{},
+			false,
+		},
+		{
+			// Retried until it goes through.
+			[]string{"a", "b", "c"},
+			map[string][]*sqs.BatchResultErrorEntry{"b": {throttled, throttled}},
+			0,
+			[]int{0, 1, 2},
+			[]int{},
+			false,
+		},
+		{
+			// Sender faults are never retried, and retries run out.
+			[]string{"a", "b", "c"},
+			map[string][]*sqs.BatchResultErrorEntry{"a": {invalid}, "c": {throttled, throttled, throttled}},
+			0,
+			[]int{1},
+			[]int{0, 2},
+			false,
+		},
+		{
+			// The second batch's request fails outright.
+			[]string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11"},
+			nil,
+			2,
+			[]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+			[]int{10, 11},
+			true,
+		},
+		{
+			// The request fails while retrying.
+			[]string{"a", "b"},
+			map[string][]*sqs.BatchResultErrorEntry{"b": {throttled}},
+			2,
+			[]int{0},
+			[]int{1},
+			true,
+		},
+	}
+
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+	for _, test := range testTables {
+		client := &FakeSQSClient{failures: test.failures, errorOnCall: test.errorOnCall}
+		sqsImpl := &SQSImpl{
+			sqsClient:   client,
+			sendRetrier: &ExponentialRetrier{initialDelayMillis: 0, maxDelayMillis: 0, maxAttempts: 3},
+		}
+		result, err := sqsImpl.SendAll(ctx, test.messages, nil, "me")
+		if (err != nil) != test.shouldError {
+			t.Errorf("Expected error: %v but got %v.", test.shouldError, err)
+		}
+		enqueued := append([]int{}, result.Enqueued...)
+		sort.Ints(enqueued)
+		if !reflect.DeepEqual(enqueued, test.expectedEnqueued) {
+			t.Errorf("Expected %v to be enqueued but got %v.", test.expectedEnqueued, enqueued)
+		}
+		if failed := result.FailedIndexes(); !reflect.DeepEqual(failed, test.expectedFailed) {
+			t.Errorf("Expected %v to fail but got %v.", test.expectedFailed, failed)
+		}
+		if (result.Err() != nil) != (len(test.expectedFailed) > 0) {
+			t.Errorf("Expected result error: %v but got %v.", len(test.expectedFailed) > 0, result.Err())
+		}
+	}
+}
+
+func TestSendAllReportsFIFOReordering(t *testing.T) {
+	throttled := &sqs.BatchResultErrorEntry{Code: aws.String("ServiceUnavailable"), Message: aws.String("slow down"), SenderFault: aws.Bool(false)}
+	testTables := []struct {
+		errorOnCall       int
+		shouldError       bool
+		expectedEnqueued  []int
+		expectedFailed    []int
+		expectedReordered []int
+	}{
+		// c went through ahead of b, so only b is retried.
+		{0, false, []int{0, 2, 1}, []int{}, []int{1}},
+		// a and c are on the queue even though the retry failed.
+		{2, true, []int{0, 2}, []int{1}, nil},
+	}
+
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+	for _, test := range testTables {
+		client := &FakeSQSClient{failures: map[string][]*sqs.BatchResultErrorEntry{"b": {throttled}}, errorOnCall: test.errorOnCall}
+		sqsImpl := &SQSImpl{
+			sqsClient:   client,
+			fifo:        true,
+			sendRetrier: &ExponentialRetrier{initialDelayMillis: 0, maxDelayMillis: 0, maxAttempts: 3},
+		}
+
+		result, err := sqsImpl.SendAll(ctx, []string{"a", "b", "c"}, nil, "me")
+		if (err != nil) != test.shouldError {
+			t.Errorf("Expected error: %v but got %v.", test.shouldError, err)
+		}
+		if len(client.requests) > 1 && !reflect.DeepEqual(client.requests[1], []string{"b"}) {
+			t.Errorf("Expected only b to be retried but got %v.", client.requests[1])
+		}
+		if !reflect.DeepEqual(result.Enqueued, test.expectedEnqueued) {
+			t.Errorf("Expected %v to be enqueued but got %v.", test.expectedEnqueued, result.Enqueued)
+		}
+		if failed := result.FailedIndexes(); !reflect.DeepEqual(failed, test.expectedFailed) {
+			t.Errorf("Expected %v to fail but got %v.", test.expectedFailed, failed)
+		}
+		if !reflect.DeepEqual(result.Reordered, test.expectedReordered) {
+			t.Errorf("Expected %v to be reordered but got %v.", test.expectedReordered, result.Reordered)
+		}
+	}
+}
+
+func TestSendAllStopsRetryingWhenCancelled(t *testing.T) {
+	throttled := &sqs.BatchResultErrorEntry{Code: aws.String("ServiceUnavailable"), Message: aws.String("slow down"), SenderFault: aws.Bool(false)}
+	client := &FakeSQSClient{failures: map[string][]*sqs.BatchResultErrorEntry{"b": {throttled}}}
+	sqsImpl := &SQSImpl{
+		sqsClient:   client,
+		sendRetrier: &ExponentialRetrier{initialDelayMillis: 60000, maxDelayMillis: 60000, maxAttempts: 3},
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), STSContextKey("logger"), getLogger()))
+	cancel()
+
+	result, err := sqsImpl.SendAll(ctx, []string{"a", "b", "c"}, nil, "me")
+	if err != context.Canceled {
+		t.Errorf("Expected %v but got %v.", context.Canceled, err)
+	}
+	if failed := result.FailedIndexes(); !reflect.DeepEqual(failed, []int{1}) {
+		t.Errorf("Expected [1] to fail but got %v.", failed)
+	}
+}
+
+func TestBatchUpdateFailsWhenTweetsAreDropped(t *testing.T) {
+	tweets := []*Envelope{NewEnvelope("first"), NewEnvelope("second")}
+	bodies, err := EncodeEnvelopes(tweets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeSQS := &FakeSQS{rejectSend: map[string]string{bodies[1]: "InvalidMessageContents: bad"}}
+
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+	err = BatchUpdate(ctx, fakeSQS, NewMediaLoader("", ""), &BatchUpdateArgs{user: "me", tweetSource: &FakeTweetProvider{tweets: tweets}})
+	if err == nil {
+		t.Errorf("Expected an error but got none.")
+	}
+	if len(fakeSQS.sent["me"]) != 1 {
+		t.Errorf("Expected 1 tweet to be sent but got %v.", fakeSQS.sent["me"])
+	}
+}
+
+func TestMessageDeduplicationID(t *testing.T) {
+	encode := func(envelope *Envelope) string {
+		body, err := envelope.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	withMedia := NewEnvelope("")
+	withMedia.Media = []*MediaRef{{Source: "cat.png"}}
+	later := NewEnvelope("hello world")
+	notBefore := time.Date(2030, 1, 1, 9, 0, 0, 0, time.UTC)
+	later.NotBefore = &notBefore
+	thread := func(id string) *Envelope {
+		envelope := NewEnvelope("hello world")
+		envelope.Thread = &ThreadRef{ID: id, Index: 0, Total: 2}
+		return envelope
+	}
+
+	testTables := []struct {
+		a, b       string
+		groupA     string
+		groupB     string
+		shouldBeEq bool
+	}{
+		{encode(NewEnvelope("hello  world")), encode(NewEnvelope("hello world\n")), "me", "me", true},
+		{encode(NewEnvelope("caf\u00e9")), encode(NewEnvelope("cafe\u0301")), "me", "me", true},
+		{encode(NewEnvelope("hello world")), "hello world", "me", "me", true},
+		{encode(NewEnvelope("hello world")), encode(NewEnvelope("hello world")), "me", "you", false},
+		{encode(NewEnvelope("hello world")), encode(NewEnvelope("goodbye world")), "me", "me", false},
+		{encode(withMedia), encode(NewEnvelope("")), "me", "me", false},
+		{encode(later), encode(NewEnvelope("hello world")), "me", "me", false},
+		// Thread IDs are new every time a batch is enqueued.
+		{encode(thread("launch-1")), encode(thread("launch-2")), "me", "me", true},
+		{encode(thread("launch-1")), encode(NewEnvelope("hello world")), "me", "me", false},
+	}
+
+	for _, test := range testTables {
+		a := messageDeduplicationID(test.a, test.groupA)
+		b := messageDeduplicationID(test.b, test.groupB)
+		if (a == b) != test.shouldBeEq {
+			t.Errorf("Expected equal IDs: %v for %q and %q but got %s and %s.", test.shouldBeEq, test.a, test.b, a, b)
+		}
+	}
+}
+
+func TestSendBatchesToFIFOQueue(t *testing.T) {
+	messages := []string{"a", "b"}
+	for _, dedupIDs := range [][]string{nil, {"1", "2"}} {
+		batches := sendBatches(messages, dedupIDs, "me", true)
+		for i, entry := range batches[0] {
+			if group := aws.StringValue(entry.MessageGroupId); group != "me" {
+				t.Errorf("Expected group me but got %s.", group)
+			}
+			expected := ""
+			if dedupIDs != nil {
+				expected = dedupIDs[i]
+			}
+			if dedupID := aws.StringValue(entry.MessageDeduplicationId); dedupID != expected {
+				t.Errorf("Expected deduplication ID %q but got %q.", expected, dedupID)
+			}
+		}
+	}
+}
+
+func TestSendBatchesToStandardQueue(t *testing.T) {
+	messages := []string{"a", "b", "c"}
+	batches := sendBatches(messages, nil, "me", false)
+	if len(batches) != 1 || len(batches[0]) != len(messages) {
+		t.Fatalf("Expected one batch of %d entries but got %v.", len(messages), batches)
+	}
+
+	last := int64(-1)
+	for _, entry := range batches[0] {
+		if entry.MessageGroupId != nil || entry.MessageDeduplicationId != nil {
+			t.Errorf("Expected no group or deduplication ID but got %v.", entry)
+		}
+		if group := aws.StringValue(entry.MessageAttributes[GROUP_ATTRIBUTE].StringValue); group != "me" {
+			t.Errorf("Expected group attribute me but got %s.", group)
+		}
+		sequence := messageSequence(&sqs.Message{MessageAttributes: entry.MessageAttributes})
+		if sequence <= last {
+			t.Errorf("Expected sequence numbers to increase but got %d after %d.", sequence, last)
+		}
+		last = sequence
+	}
+}
+
+// ReceiveMessageWithContext hands out everything in received, once.
+func (this *FakeSQSClient) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, options ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	this.receives++
+	this.lastReceive = input
+	if this.fifoQueue != nil {
+		if this.inFlight == nil {
+			this.inFlight = make(map[string]bool)
+		}
+		group := ""
+		messages := []*sqs.Message{}
+		kept := []*sqs.Message{}
+		for _, message := range this.fifoQueue {
+			g := messageGroup(message)
+			if len(messages) == 0 && !this.inFlight[g] {
+				group = g
+			}
+			if g == group && int64(len(messages)) < aws.Int64Value(input.MaxNumberOfMessages) {
+				messages = append(messages, message)
+				continue
+			}
+			kept = append(kept, message)
+		}
+		this.fifoQueue = kept
+		if group != "" {
+			this.inFlight[group] = true
+		}
+		return &sqs.ReceiveMessageOutput{Messages: messages}, nil
+	}
+	messages := this.received
+	this.received = nil
+	return &sqs.ReceiveMessageOutput{Messages: messages}, nil
+}
+
+func (this *FakeSQSClient) ChangeMessageVisibilityBatch(input *sqs.ChangeMessageVisibilityBatchInput) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	for _, entry := range input.Entries {
+		this.released = append(this.released, aws.StringValue(entry.ReceiptHandle))
+	}
+	return &sqs.ChangeMessageVisibilityBatchOutput{}, nil
+}
+
+func (this *FakeSQSClient) ChangeMessageVisibility(input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.visibilityTimeouts = append(this.visibilityTimeouts, aws.Int64Value(input.VisibilityTimeout))
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (this *FakeSQSClient) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func groupMessage(handle, group, sequence string) *sqs.Message {
+	message := &sqs.Message{
+		ReceiptHandle: aws.String(handle),
+		Attributes:    map[string]*string{"MessageGroupId": aws.String(group)},
+	}
+	if sequence != "" {
+		message.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+			GROUP_ATTRIBUTE:    {StringValue: aws.String(group)},
+			SEQUENCE_ATTRIBUTE: {StringValue: aws.String(sequence)},
+		}
+	}
+	return message
+}
+
+func TestReceiveFromStandardQueue(t *testing.T) {
+	client := &FakeSQSClient{received: []*sqs.Message{
+		groupMessage("b", "me", "20"),
+		groupMessage("a", "me", "10"),
+		groupMessage("c", "me", "30"),
+	}}
+	sqsImpl := newSQSImpl(client, "", false, &SQSConfig{prefetch: 10})
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+
+	// Handed out earliest first, all from the one receive.
+	for _, expected := range []string{"a", "b", "c"} {
+		received, err := sqsImpl.Receive(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received == nil {
+			t.Fatalf("Expected message %s but got nothing.", expected)
+		}
+		if handle := aws.StringValue(received.ReceiptHandle); handle != expected {
+			t.Errorf("Expected message %s but got %s.", expected, handle)
+		}
+		if group := messageGroup(received); group != "me" {
+			t.Errorf("Expected group me but got %s.", group)
+		}
+	}
+	if client.receives != 1 {
+		t.Errorf("Expected 1 receive but got %d.", client.receives)
+	}
+
+	received, err := sqsImpl.Receive(ctx)
+	if err != nil || received != nil {
+		t.Errorf("Expected nothing from an empty queue but got %v (%v).", received, err)
+	}
+}
+
+func TestReceiveFromFIFOQueueKeepsGroupsInOrder(t *testing.T) {
+	client := &FakeSQSClient{received: []*sqs.Message{
+		groupMessage("a1", "a", ""),
+		groupMessage("a2", "a", ""),
+		groupMessage("a3", "a", ""),
+		groupMessage("b1", "b", ""),
+	}}
+	sqsImpl := newSQSImpl(client, "", true, &SQSConfig{prefetch: 10})
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+
+	receive := func() string {
+		received, err := sqsImpl.ReceiveNow(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received == nil {
+			return ""
+		}
+		return aws.StringValue(received.ReceiptHandle)
+	}
+
+	// Nothing more from group a until a1 is done with.
+	if handle := receive(); handle != "a1" {
+		t.Errorf("Expected a1 but got %s.", handle)
+	}
+	if handle := receive(); handle != "b1" {
+		t.Errorf("Expected b1 but got %s.", handle)
+	}
+	if handle := receive(); handle != "" {
+		t.Errorf("Expected nothing but got %s.", handle)
+	}
+	if err := sqsImpl.DeleteMessage(aws.String("a1")); err != nil {
+		t.Fatal(err)
+	}
+	if handle := receive(); handle != "a2" {
+		t.Errorf("Expected a2 but got %s.", handle)
+	}
+
+	// Putting a2 back puts a3 back with it.
+	if err := sqsImpl.ChangeVisibility(aws.String("a2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a3"}; !reflect.DeepEqual(client.released, expected) {
+		t.Errorf("Expected %v to be released but got %v.", expected, client.released)
+	}
+}
+
+func TestReceivePickingChoosesFromTheBuffer(t *testing.T) {
+	client := &FakeSQSClient{received: []*sqs.Message{
+		groupMessage("a1", "a", ""),
+		groupMessage("a2", "a", ""),
+		groupMessage("b1", "b", ""),
+	}}
+	sqsImpl := newSQSImpl(client, "", true, &SQSConfig{prefetch: 10})
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+
+	var gotReady []string
+	var gotWaiting map[string]int
+	received, err := sqsImpl.ReceivePicking(ctx, func(ready []string, waiting map[string]int) string {
+		gotReady, gotWaiting = ready, waiting
+		return "b"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handle := aws.StringValue(received.ReceiptHandle); handle != "b1" {
+		t.Errorf("Expected b1 but got %s.", handle)
+	}
+	if expected := []string{"a", "b"}; !reflect.DeepEqual(gotReady, expected) {
+		t.Errorf("Expected ready groups %v but got %v.", expected, gotReady)
+	}
+	if expected := map[string]int{"a": 2, "b": 1}; !reflect.DeepEqual(gotWaiting, expected) {
+		t.Errorf("Expected waiting %v but got %v.", expected, gotWaiting)
+	}
+	// The second receive turns up no other groups.
+	if client.receives != 2 || len(client.released) != 0 {
+		t.Errorf("Expected 2 receives and nothing released but got %d and %v.", client.receives, client.released)
+	}
+
+	// The rest are still buffered, in order.
+	if received, err := sqsImpl.ReceiveNow(ctx); err != nil || aws.StringValue(received.ReceiptHandle) != "a1" {
+		t.Errorf("Expected a1 but got %v (%v).", received, err)
+	}
+}
+
+func TestReceivePickingLooksPastABigGroup(t *testing.T) {
+	queue := []*sqs.Message{}
+	for i := 0; i < 15; i++ {
+		queue = append(queue, groupMessage(fmt.Sprintf("a%d", i), "a", ""))
+	}
+	queue = append(queue, groupMessage("b0", "b", ""), groupMessage("c0", "c", ""))
+	client := &FakeSQSClient{fifoQueue: queue}
+	sqsImpl := newSQSImpl(client, "", true, &SQSConfig{prefetch: 10})
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+
+	scheduler := NewGroupScheduler([]*GroupConfig{{Group: "a"}, {Group: "b"}, {Group: "c"}})
+	// a has already had a turn.
+	scheduler.Pick([]string{"a"})
+	var gotReady []string
+	received, err := sqsImpl.ReceivePicking(ctx, func(ready []string, waiting map[string]int) string {
+		gotReady = ready
+		return scheduler.PickWaiting(ready, waiting)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a", "b", "c"}; !reflect.DeepEqual(gotReady, expected) {
+		t.Errorf("Expected ready groups %v but got %v.", expected, gotReady)
+	}
+	if handle := aws.StringValue(received.ReceiptHandle); handle != "b0" {
+		t.Errorf("Expected b0 but got %s.", handle)
+	}
+	if describe := scheduler.Describe([]string{"a"}); describe != "a (weight 1, 10 waiting, posted 1)" {
+		t.Errorf("Expected a to have 10 waiting but got %s.", describe)
+	}
+}
+
+func TestReceiveReleasesStaleMessages(t *testing.T) {
+	client := &FakeSQSClient{received: []*sqs.Message{groupMessage("a1", "a", ""), groupMessage("b1", "b", "")}}
+	sqsImpl := newSQSImpl(client, "", true, &SQSConfig{prefetch: 10})
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+
+	if _, err := sqsImpl.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sqsImpl.holdTime = 0
+	if received, err := sqsImpl.Receive(ctx); err != nil || received != nil {
+		t.Errorf("Expected nothing but got %v (%v).", received, err)
+	}
+	if expected := []string{"b1"}; !reflect.DeepEqual(client.released, expected) {
+		t.Errorf("Expected %v to be released but got %v.", expected, client.released)
+	}
+}
+
+func TestKeepInFlight(t *testing.T) {
+	client := &FakeSQSClient{received: []*sqs.Message{groupMessage("a1", "a", "")}}
+	sqsImpl := newSQSImpl(client, "", true, &SQSConfig{prefetch: 10, visibilityTimeout: 60})
+	sqsImpl.heartbeatInterval = 10 * time.Millisecond
+	ctx := context.WithValue(context.Background(), STSContextKey("logger"), getLogger())
+
+	received, err := sqsImpl.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeout := aws.Int64Value(client.lastReceive.VisibilityTimeout); timeout != 60 {
+		t.Errorf("Expected to receive with a visibility timeout of 60 but got %d.", timeout)
+	}
+
+	stop := sqsImpl.KeepInFlight(received.ReceiptHandle)
+	time.Sleep(100 * time.Millisecond)
+	// Releasing the message ends the heartbeat before anything else.
+	if err := sqsImpl.ChangeVisibility(received.ReceiptHandle, 0); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	time.Sleep(50 * time.Millisecond)
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	timeouts := client.visibilityTimeouts
+	if len(timeouts) < 2 {
+		t.Fatalf("Expected the visibility timeout to be extended, but got %v.", timeouts)
+	}
+	for _, timeout := range timeouts[:len(timeouts)-1] {
+		if timeout != 60 {
+			t.Errorf("Expected extensions to 60 seconds but got %v.", timeouts)
+			break
+		}
+	}
+	if last := timeouts[len(timeouts)-1]; last != 0 {
+		t.Errorf("Expected the release to come last but got %v.", timeouts)
+	}
+}
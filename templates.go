@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// templateFuncs are the helpers available to batch templates, on top of text/
+// template's builtins.
+var templateFuncs = template.FuncMap{
+	// {{date "Jan 2" .when}} reformats a time, given as RFC 3339 or as a
+	// plain date (2006-01-02).
+	"date": templateDate,
+	"now":  time.Now,
+	// {{hashtag "new release"}} is "#NewRelease".
+	"hashtag": hashtag,
+	// {{hashtags "a, b c"}} is "#a #bC".
+	"hashtags": hashtags,
+	// {{truncate 100 .summary}} shortens text to a weighted length of at
+	// most 100, ending it with an ellipsis if it had to be cut.
+	"truncate": truncateTweet,
+	"lower":    strings.ToLower,
+	"upper":    strings.ToUpper,
+	"trim":     strings.TrimSpace,
+}
+
+func templateDate(layout string, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(layout), nil
+	case string:
+		for _, inputLayout := range []string{time.RFC3339, "2006-01-02"} {
+			if t, err := time.Parse(inputLayout, strings.TrimSpace(v)); err == nil {
+				return t.Format(layout), nil
+			}
+		}
+		return "", fmt.Errorf("%q is not an RFC 3339 time or a 2006-01-02 date.", v)
+	default:
+		return "", fmt.Errorf("Cannot format %v (%T) as a date.", value, value)
+	}
+}
+
+func hashtag(text string) string {
+	var tag strings.Builder
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}) {
+		runes := []rune(word)
+		if tag.Len() > 0 {
+			runes[0] = unicode.ToUpper(runes[0])
+		}
+		tag.WriteString(string(runes))
+	}
+	if tag.Len() == 0 {
+		return ""
+	}
+	return "#" + tag.String()
+}
+
+func hashtags(text string) string {
+	tags := []string{}
+	for _, item := range strings.Split(text, ",") {
+		if tag := hashtag(item); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return strings.Join(tags, " ")
+}
+
+// loadTemplateData reads the rows a batch is rendered with: a CSV file with a
+// header row, or a JSON file holding a list of objects.
+func loadTemplateData(filename string) ([]map[string]interface{}, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rows := []map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		reader := csv.NewReader(file)
+		header, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		for {
+			values, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", filename, err)
+			}
+			row := make(map[string]interface{}, len(header))
+			for i, column := range header {
+				row[strings.TrimSpace(column)] = values[i]
+			}
+			rows = append(rows, row)
+		}
+	case ".json":
+		if err := json.NewDecoder(file).Decode(&rows); err != nil {
+			return nil, fmt.Errorf("%s: expected a list of objects: %s", filename, err)
+		}
+	default:
+		return nil, fmt.Errorf("%s: template data must be a .csv or .json file.", filename)
+	}
+	return rows, nil
+}
+
+// renderTemplate renders one entry (or one field of one entry) of a batch
+// template with a row of data. Referring to a field the row doesn't have is an
+// error.
+func renderTemplate(text string, row map[string]interface{}) (string, error) {
+	tmpl, err := template.New("tweet").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, row); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
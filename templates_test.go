@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	row := map[string]interface{}{
+		"name":    "Ada Lovelace",
+		"when":    "2020-02-03",
+		"topics":  "math, analytical engine",
+		"summary": strings.Repeat("word ", 20),
+	}
+	testTables := []struct {
+		text        string
+		shouldError bool
+		expected    string
+	}{
+		{text: "no template here", expected: "no template here"},
+		{text: "Hello {{.name}}!", expected: "Hello Ada Lovelace!"},
+		{text: `On {{date "Jan 2" .when}}`, expected: "On Feb 3"},
+		{text: "{{hashtag .name}} {{hashtags .topics}}", expected: "#AdaLovelace #math #analyticalEngine"},
+		{text: "{{truncate 12 .summary}}", expected: "word word…"},
+		{text: "{{.missing}}", shouldError: true},
+		{text: `{{date "Jan 2" .name}}`, shouldError: true},
+		{text: "{{.name", shouldError: true},
+	}
+
+	for _, test := range testTables {
+		rendered, err := renderTemplate(test.text, row)
+		if test.shouldError {
+			if err == nil {
+				t.Errorf("Expected an error rendering %q but got %q.", test.text, rendered)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error rendering %q but got %s.", test.text, err)
+			continue
+		}
+		if rendered != test.expected {
+			t.Errorf("Expected %q but got %q.", test.expected, rendered)
+		}
+	}
+}
+
+func TestParseRendersEachRow(t *testing.T) {
+	format, err := NewTweetFormat(FORMAT_DELIMITED, "tweets.txt", "---\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	format.templateData = []map[string]interface{}{
+		{"n": "1", "when": "2030-01-01T09:00:00Z"},
+		{"n": "2", "when": "2030-01-02T09:00:00Z"},
+	}
+	input := "@thread t\n@not-before {{.when}}\n{{.n}} a\n---\n@thread t\n{{.n}} b\n"
+
+	tweets, err := format.Parse(strings.NewReader(input), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts := []string{}
+	for _, tweet := range tweets {
+		texts = append(texts, tweet.Text)
+	}
+	if strings.Join(texts, "|") != "1 a|1 b|2 a|2 b" {
+		t.Fatalf("Expected 1 a|1 b|2 a|2 b but got %s.", strings.Join(texts, "|"))
+	}
+	if tweets[0].NotBefore == nil || tweets[2].NotBefore == nil || !tweets[2].NotBefore.After(*tweets[0].NotBefore) {
+		t.Errorf("Expected each row to render its own not-before but got %v and %v.", tweets[0].NotBefore, tweets[2].NotBefore)
+	}
+	if tweets[0].Thread.ID != tweets[1].Thread.ID || tweets[0].Thread.ID == tweets[2].Thread.ID {
+		t.Errorf("Expected each row to get its own thread but got %s, %s, %s.", tweets[0].Thread.ID, tweets[1].Thread.ID, tweets[2].Thread.ID)
+	}
+}
+
+func TestLoadTemplateData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sts-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"data.csv":  "name,when\nAda,2020-02-03\nGrace,2020-02-04\n",
+		"data.json": `[{"name": "Ada"}, {"name": "Grace"}]`,
+	}
+	for name, contents := range files {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := loadTemplateData(filename)
+		if err != nil {
+			t.Errorf("Expected no error loading %s but got %s.", name, err)
+			continue
+		}
+		if len(rows) != 2 || rows[1]["name"] != "Grace" {
+			t.Errorf("Expected 2 rows from %s but got %v.", name, rows)
+		}
+	}
+
+	if _, err := loadTemplateData(filepath.Join(dir, "data.txt")); err == nil {
+		t.Errorf("Expected an error loading a .txt file but got none.")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ThreadRef marks a post as one part of a thread. Parts of a thread are
+// enqueued in order to the same message group, and each is posted as a reply
+// to the one before it.
+type ThreadRef struct {
+	ID    string `json:"id"`
+	Index int    `json:"index"`
+	Total int    `json:"total"`
+}
+
+// assignThreads fills in the ThreadRef for every envelope that belongs to a
+// thread. names[i] is the thread name envelopes[i] was marked with, or "" if
+// it isn't part of one. The entries of a thread must be contiguous.
+//
+// Every call starts new threads: enqueueing the same thread twice posts it
+// twice, rather than the second copy being taken for parts that were already
+// posted. Re-running a batch with a ledger is the exception: the parts still
+// to be enqueued get the ID recorded for the rest of their thread.
+func assignThreads(envelopes []*Envelope, names []string) error {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	finished := make(map[string]bool)
+	for start := 0; start < len(envelopes); {
+		name := names[start]
+		end := start + 1
+		for end < len(envelopes) && names[end] == name {
+			end++
+		}
+		if name == "" {
+			start = end
+			continue
+		}
+		if finished[name] {
+			return fmt.Errorf("The entries of thread %q must be next to each other.", name)
+		}
+		finished[name] = true
+
+		id := name + "-" + hex.EncodeToString(nonce)
+
+		for i, envelope := range envelopes[start:end] {
+			envelope.Thread = &ThreadRef{ID: id, Index: i, Total: end - start}
+		}
+		start = end
+	}
+	return nil
+}
+
+type threadProgress struct {
+	// Index and ID of the last part posted.
+	Index    int       `json:"index"`
+	ID       string    `json:"id"`
+	PostedAt time.Time `json:"posted_at"`
+}
+
+// ThreadState remembers how far each thread has got on each destination, so
+// that a restart mid-thread continues the thread instead of starting a new
+// one. It is persisted to a JSON file after every change.
+//
+// Threads that nothing has been posted to for longer than the queue's
+// retention period are forgotten. The parts of a thread are enqueued
+// together, so by then none of its messages can still be on the queue.
+type ThreadState struct {
+	filename string
+	lock     sync.Mutex
+	// thread ID -> destination name -> progress
+	threads map[string]map[string]*threadProgress
+	// How long the queue keeps messages. 0 keeps every thread.
+	retention time.Duration
+}
+
+func NewThreadState(filename string) (*ThreadState, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+
+	state := &ThreadState{
+		filename: filename,
+		threads:  make(map[string]map[string]*threadProgress),
+	}
+	bytes, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, &state.threads); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	// Progress recorded before posts were timestamped is kept for a full
+	// retention period from now.
+	now := time.Now().UTC()
+	for _, destinations := range state.threads {
+		for _, progress := range destinations {
+			if progress.PostedAt.IsZero() {
+				progress.PostedAt = now
+			}
+		}
+	}
+	return state, nil
+}
+
+// Prune forgets the threads that nothing has been posted to for longer than
+// retention, now and whenever progress is recorded from here on.
+func (this *ThreadState) Prune(retention time.Duration) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.retention = retention
+	if !this.prune() {
+		return nil
+	}
+	return this.save()
+}
+
+// prune reports whether it forgot any threads. Must be called with the lock
+// held.
+func (this *ThreadState) prune() bool {
+	if this.retention <= 0 {
+		return false
+	}
+	cutoff := time.Now().Add(-this.retention)
+	pruned := false
+	for thread, destinations := range this.threads {
+		stale := true
+		for _, progress := range destinations {
+			if progress.PostedAt.After(cutoff) {
+				stale = false
+			}
+		}
+		if stale {
+			delete(this.threads, thread)
+			pruned = true
+		}
+	}
+	return pruned
+}
+
+// save writes the state out. Must be called with the lock held.
+func (this *ThreadState) save() error {
+	bytes, err := json.Marshal(this.threads)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(this.filename, bytes)
+}
+
+func (this *ThreadState) progress(thread, destination string) (*threadProgress, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	progress, ok := this.threads[thread][destination]
+	return progress, ok
+}
+
+func (this *ThreadState) advance(ref *ThreadRef, destination, id string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	// Finished threads are kept too (until they're pruned), so that if the
+	// last part's message is redelivered we recognize it rather than posting
+	// it again.
+	if _, ok := this.threads[ref.ID]; !ok {
+		this.threads[ref.ID] = make(map[string]*threadProgress)
+	}
+	this.threads[ref.ID][destination] = &threadProgress{Index: ref.Index, ID: id, PostedAt: time.Now().UTC()}
+	this.prune()
+	return this.save()
+}
+
+// Threader wraps a Publisher so that each part of a thread is posted as a
+// reply to the previous part on that same destination.
+type Threader struct {
+	publisher   Publisher
+	destination string
+	state       *ThreadState
+}
+
+func NewThreader(publisher Publisher, destination string, state *ThreadState) *Threader {
+	return &Threader{publisher: publisher, destination: destination, state: state}
+}
+
+func (this *Threader) Publish(ctx context.Context, post *Post) (*PublishedPost, error) {
+	if post.Thread == nil {
+		return this.publisher.Publish(ctx, post)
+	}
+
+	ref := post.Thread
+	progress, ok := this.state.progress(ref.ID, this.destination)
+	switch {
+	case ok && progress.Index >= ref.Index:
+		// We posted this part already, but didn't get to delete the
+		// message before stopping.
+		log.Printf("[thread]: Part %d/%d of %s was already posted to %s as %s.\n", ref.Index+1, ref.Total, ref.ID, this.destination, progress.ID)
+		return &PublishedPost{ID: progress.ID, Text: post.Text}, nil
+	case ok:
+		if progress.Index != ref.Index-1 {
+			log.Printf("[thread]: Part %d of %s is missing on %s. Replying to part %d instead.\n", ref.Index, ref.ID, this.destination, progress.Index+1)
+		}
+		reply := *post
+		reply.InReplyTo = progress.ID
+		post = &reply
+	case ref.Index > 0:
+		log.Printf("[thread]: No earlier parts of %s were posted to %s. Posting part %d/%d on its own.\n", ref.ID, this.destination, ref.Index+1, ref.Total)
+	}
+
+	published, err := this.publisher.Publish(ctx, post)
+	if err != nil {
+		return nil, err
+	}
+	if err := this.state.advance(ref, this.destination, published.ID); err != nil {
+		// The part went out; losing track of it only means the next part
+		// won't be attached as a reply.
+		log.Printf("[thread]: Could not record progress of %s on %s: %s\n", ref.ID, this.destination, err)
+	}
+	return published, nil
+}
+
+func (this *Threader) Name() string {
+	return this.publisher.Name()
+}
+
+// renumberThreads recomputes Index and Total for every thread, after parts
+// have been added to or removed from envelopes.
+func renumberThreads(envelopes []*Envelope) {
+	totals := make(map[string]int)
+	for _, envelope := range envelopes {
+		if envelope.Thread != nil {
+			totals[envelope.Thread.ID]++
+		}
+	}
+	indexes := make(map[string]int)
+	for _, envelope := range envelopes {
+		if envelope.Thread == nil {
+			continue
+		}
+		id := envelope.Thread.ID
+		envelope.Thread = &ThreadRef{ID: id, Index: indexes[id], Total: totals[id]}
+		indexes[id]++
+	}
+}
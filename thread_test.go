@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAssignThreads(t *testing.T) {
+	envelopes := []*Envelope{NewEnvelope("solo"), NewEnvelope("one"), NewEnvelope("two"), NewEnvelope("other")}
+	if err := assignThreads(envelopes, []string{"", "launch", "launch", ""}); err != nil {
+		t.Fatalf("Expected no error but got %s.", err)
+	}
+	if envelopes[0].Thread != nil || envelopes[3].Thread != nil {
+		t.Errorf("Expected entries outside a thread to have no thread.")
+	}
+	first, second := envelopes[1].Thread, envelopes[2].Thread
+	if first == nil || second == nil || first.ID != second.ID || first.Index != 0 || second.Index != 1 || second.Total != 2 {
+		t.Errorf("Unexpected thread refs: %+v, %+v", first, second)
+	}
+
+	again := []*Envelope{NewEnvelope("one"), NewEnvelope("two")}
+	assignThreads(again, []string{"launch", "launch"})
+	if again[0].Thread.ID == first.ID {
+		t.Errorf("Expected enqueueing the same thread again to start a new thread.")
+	}
+
+	split := []*Envelope{NewEnvelope("one"), NewEnvelope("interruption"), NewEnvelope("two")}
+	if err := assignThreads(split, []string{"launch", "", "launch"}); err == nil {
+		t.Errorf("Expected an error for a thread whose entries aren't contiguous.")
+	}
+}
+
+func TestThreaderContinuesAcrossRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sts-threads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "threads.json")
+
+	parts := []*Envelope{NewEnvelope("one"), NewEnvelope("two"), NewEnvelope("three")}
+	assignThreads(parts, []string{"t", "t", "t"})
+
+	publisher := &FakePublisher{}
+	newThreader := func() *Threader {
+		state, err := NewThreadState(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewThreader(publisher, "fake", state)
+	}
+
+	threader := newThreader()
+	if _, err := threader.Publish(context.Background(), parts[0].Post("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart, then get the second part twice, as if we'd crashed before
+	// deleting its message.
+	threader = newThreader()
+	for i := 0; i < 2; i++ {
+		published, err := threader.Publish(context.Background(), parts[1].Post("2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if published.ID != "2" {
+			t.Errorf("Expected part two to be posted as 2, but got %s.", published.ID)
+		}
+	}
+	if _, err := threader.Publish(context.Background(), parts[2].Post("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(publisher.posts) != 3 {
+		t.Fatalf("Expected 3 posts but got %d.", len(publisher.posts))
+	}
+	expectedReplies := []string{"", "1", "2"}
+	for i, post := range publisher.posts {
+		if post.InReplyTo != expectedReplies[i] {
+			t.Errorf("Expected part %d to reply to %q, but it replied to %q.", i+1, expectedReplies[i], post.InReplyTo)
+		}
+	}
+}
+
+func TestThreadStatePrunesStaleThreads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sts-threads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "threads.json")
+
+	state, err := NewThreadState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.advance(&ThreadRef{ID: "old", Index: 0, Total: 1}, "fake", "1"); err != nil {
+		t.Fatal(err)
+	}
+	state.threads["old"]["fake"].PostedAt = time.Now().Add(-2 * time.Hour)
+	if err := state.advance(&ThreadRef{ID: "new", Index: 0, Total: 2}, "fake", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := state.Prune(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewThreadState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.progress("old", "fake"); ok {
+		t.Errorf("Expected the stale thread to be forgotten.")
+	}
+	if _, ok := reloaded.progress("new", "fake"); !ok {
+		t.Errorf("Expected the recent thread to be kept.")
+	}
+}
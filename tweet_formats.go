@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	FORMAT_AUTO      = "auto"
+	FORMAT_DELIMITED = "delimited"
+	FORMAT_CSV       = "csv"
+	FORMAT_JSONL     = "jsonl"
+	FORMAT_YAML      = "yaml"
+	FORMAT_MARKDOWN  = "markdown"
+
+	MARKDOWN_SECTION_BREAK = "---"
+)
+
+// Formats auto-detected from the file extension. Anything else is assumed to
+// be delimited.
+var formatExtensions = map[string]string{
+	".csv":      FORMAT_CSV,
+	".jsonl":    FORMAT_JSONL,
+	".ndjson":   FORMAT_JSONL,
+	".yaml":     FORMAT_YAML,
+	".yml":      FORMAT_YAML,
+	".md":       FORMAT_MARKDOWN,
+	".markdown": FORMAT_MARKDOWN,
+}
+
+// TweetFormat describes how a batch of tweets is laid out, and parses it.
+type TweetFormat struct {
+	name string
+	// Only used by the delimited format. Markdown always uses "---".
+	delimiter string
+	// Only used by the CSV format. Maps each field of a tweet to the header
+	// of the column it's read from.
+	columns map[string]string
+	// Rows to render each entry with, if the batch is a template. Every
+	// entry is rendered once per row before its directives (or fields) are
+	// parsed, so those can be templated too. The entries for each row come
+	// out together and in order, and each row gets its own threads.
+	templateData []map[string]interface{}
+	// Where every empty entry Parse has found so far ended, as name:line.
+	// Only the delimited and Markdown formats can have them; the others
+	// have no way to write one.
+	emptyEntries []string
+}
+
+// NewTweetFormat returns the format with the given name, or the one matching
+// filename's extension if the name is FORMAT_AUTO.
+func NewTweetFormat(name, filename, delimiter string, columns map[string]string) (*TweetFormat, error) {
+	if name == "" || name == FORMAT_AUTO {
+		name = FORMAT_DELIMITED
+		if detected, ok := formatExtensions[strings.ToLower(filepath.Ext(filename))]; ok {
+			name = detected
+		}
+	}
+
+	format := &TweetFormat{name: name}
+	switch name {
+	case FORMAT_DELIMITED:
+		format.delimiter = delimiter
+	case FORMAT_CSV:
+		format.columns = make(map[string]string)
+		for field, column := range columns {
+			if !csvFields[field] {
+				return nil, fmt.Errorf("Unknown CSV field %q. Expected one of: %s.", field, strings.Join(csvFieldNames(), ", "))
+			}
+			format.columns[field] = column
+		}
+	case FORMAT_MARKDOWN:
+		format.delimiter = MARKDOWN_SECTION_BREAK
+	case FORMAT_JSONL, FORMAT_YAML:
+	default:
+		return nil, fmt.Errorf("Unknown format %q.", name)
+	}
+	if len(columns) > 0 && name != FORMAT_CSV {
+		return nil, fmt.Errorf("Column mappings only apply to the %s format, not %s.", FORMAT_CSV, name)
+	}
+	return format, nil
+}
+
+// Parse reads every tweet from reader. name identifies the source in error
+// messages.
+func (this *TweetFormat) Parse(reader io.Reader, name string) ([]*Envelope, error) {
+	switch this.name {
+	case FORMAT_CSV:
+		return readCSV(reader, name, this.columns, this.templateData)
+	case FORMAT_JSONL:
+		return readJSONL(reader, name, this.templateData)
+	case FORMAT_YAML:
+		return readYAML(reader, name, this.templateData)
+	case FORMAT_MARKDOWN:
+		tweets, empty, err := readMarkdown(reader, name, this.templateData)
+		this.emptyEntries = append(this.emptyEntries, empty...)
+		return tweets, err
+	default:
+		tweets, empty, err := readEntries(reader, name, this.delimiter, this.templateData)
+		this.emptyEntries = append(this.emptyEntries, empty...)
+		return tweets, err
+	}
+}
+
+// EmptyEntries returns where every empty entry Parse has found so far ended,
+// as name:line. They're skipped, but usually mean a tweet went missing.
+func (this *TweetFormat) EmptyEntries() []string {
+	return this.emptyEntries
+}
+
+// tweetRecord is a tweet in one of the structured formats. It can be given as
+// just a string, which is the text.
+type tweetRecord struct {
+	Text      string         `json:"text" yaml:"text"`
+	NotBefore string         `json:"not_before" yaml:"not_before"`
+	NotAfter  string         `json:"not_after" yaml:"not_after"`
+	Media     []*recordMedia `json:"media" yaml:"media"`
+	Thread    string         `json:"thread" yaml:"thread"`
+	ReplyTo   string         `json:"reply_to" yaml:"reply_to"`
+	Account   string         `json:"account" yaml:"account"`
+	Tags      []string       `json:"tags" yaml:"tags"`
+}
+
+func (this *tweetRecord) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &this.Text); err == nil {
+		return nil
+	}
+	type plain tweetRecord
+	return json.Unmarshal(data, (*plain)(this))
+}
+
+func (this *tweetRecord) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&this.Text); err == nil {
+		return nil
+	}
+	type plain tweetRecord
+	return unmarshal((*plain)(this))
+}
+
+// recordMedia is a MediaRef in one of the structured formats. It can be given
+// as just a string, which is the source.
+type recordMedia struct {
+	Source  string `json:"source" yaml:"source"`
+	AltText string `json:"alt_text" yaml:"alt_text"`
+}
+
+func (this *recordMedia) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &this.Source); err == nil {
+		return nil
+	}
+	type plain recordMedia
+	return json.Unmarshal(data, (*plain)(this))
+}
+
+func (this *recordMedia) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&this.Source); err == nil {
+		return nil
+	}
+	type plain recordMedia
+	return unmarshal((*plain)(this))
+}
+
+// render renders every field of the record as a template, with row.
+func (this *tweetRecord) render(row map[string]interface{}) (*tweetRecord, error) {
+	out := &tweetRecord{}
+	for _, field := range []struct {
+		value string
+		dest  *string
+	}{
+		{this.Text, &out.Text},
+		{this.NotBefore, &out.NotBefore},
+		{this.NotAfter, &out.NotAfter},
+		{this.Thread, &out.Thread},
+		{this.ReplyTo, &out.ReplyTo},
+		{this.Account, &out.Account},
+	} {
+		rendered, err := renderTemplate(field.value, row)
+		if err != nil {
+			return nil, err
+		}
+		*field.dest = strings.TrimSpace(rendered)
+	}
+	for _, tag := range this.Tags {
+		rendered, err := renderTemplate(tag, row)
+		if err != nil {
+			return nil, err
+		}
+		out.Tags = append(out.Tags, strings.TrimSpace(rendered))
+	}
+	for _, media := range this.Media {
+		source, err := renderTemplate(media.Source, row)
+		if err != nil {
+			return nil, err
+		}
+		altText, err := renderTemplate(media.AltText, row)
+		if err != nil {
+			return nil, err
+		}
+		out.Media = append(out.Media, &recordMedia{Source: strings.TrimSpace(source), AltText: strings.TrimSpace(altText)})
+	}
+	return out, nil
+}
+
+func (this *tweetRecord) envelope() (*Envelope, error) {
+	envelope := NewEnvelope(strings.TrimSpace(this.Text))
+	envelope.ReplyTo = this.ReplyTo
+	envelope.Account = this.Account
+	envelope.Tags = this.Tags
+	for _, media := range this.Media {
+		if media.Source == "" {
+			return nil, fmt.Errorf("Media needs a path or s3:// URL.")
+		}
+		envelope.Media = append(envelope.Media, &MediaRef{Source: media.Source, AltText: media.AltText})
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  **time.Time
+	}{
+		{"not_before", this.NotBefore, &envelope.NotBefore},
+		{"not_after", this.NotAfter, &envelope.NotAfter},
+	} {
+		if field.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, field.value)
+		if err != nil {
+			return nil, fmt.Errorf("Bad time for %s: %s", field.name, err)
+		}
+		*field.dest = &t
+	}
+	return envelope, validateSchedule(envelope)
+}
+
+// collectRecords converts records to envelopes and links up their threads,
+// rendering them once per row of data first if there is any. locations[i]
+// says where records[i] came from, for error messages.
+func collectRecords(records []*tweetRecord, locations []string, name string, data []map[string]interface{}) ([]*Envelope, error) {
+	if data == nil {
+		return collectRow(records, locations, name, nil, "")
+	}
+	tweets := []*Envelope{}
+	for row := range data {
+		rowTweets, err := collectRow(records, locations, name, data[row], fmt.Sprintf(", row %d", row))
+		if err != nil {
+			return nil, err
+		}
+		tweets = append(tweets, rowTweets...)
+	}
+	return tweets, nil
+}
+
+// collectRow is collectRecords for a single row of data, or for none if row
+// is nil. rowLabel is added to error messages.
+func collectRow(records []*tweetRecord, locations []string, name string, row map[string]interface{}, rowLabel string) ([]*Envelope, error) {
+	tweets := make([]*Envelope, 0, len(records))
+	threads := make([]string, 0, len(records))
+	for i, record := range records {
+		if row != nil {
+			rendered, err := record.render(row)
+			if err != nil {
+				return nil, fmt.Errorf("%s: tweet %d%s: %s", locations[i], len(tweets), rowLabel, err)
+			}
+			record = rendered
+		}
+		tweet, err := record.envelope()
+		if err != nil {
+			return nil, fmt.Errorf("%s: tweet %d%s: %s", locations[i], len(tweets), rowLabel, err)
+		}
+		if tweet.Text == "" && len(tweet.Media) == 0 {
+			continue
+		}
+		tweets = append(tweets, tweet)
+		threads = append(threads, record.Thread)
+	}
+	if err := assignThreads(tweets, threads); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return tweets, nil
+}
+
+// readJSONL reads one tweet per line. Blank lines are skipped.
+func readJSONL(reader io.Reader, name string, data []map[string]interface{}) ([]*Envelope, error) {
+	records := []*tweetRecord{}
+	locations := []string{}
+	lines := newLineReader(reader, name)
+	for {
+		line, ok, err := lines.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		record := &tweetRecord{}
+		if err := json.Unmarshal([]byte(line), record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", name, lines.number, err)
+		}
+		records = append(records, record)
+		locations = append(locations, fmt.Sprintf("%s:%d", name, lines.number))
+	}
+	return collectRecords(records, locations, name, data)
+}
+
+// readYAML reads a YAML list of tweets.
+func readYAML(reader io.Reader, name string, data []map[string]interface{}) ([]*Envelope, error) {
+	records := []*tweetRecord{}
+	if err := yaml.NewDecoder(reader).Decode(&records); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	locations := make([]string, len(records))
+	for i := range records {
+		locations[i] = fmt.Sprintf("%s: item %d", name, i)
+	}
+	return collectRecords(records, locations, name, data)
+}
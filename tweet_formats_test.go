@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTweetFormats(t *testing.T) {
+	testTables := []struct {
+		format        string
+		columns       map[string]string
+		input         string
+		expectedTexts []string
+		expectedError string
+	}{
+		{
+			format:        FORMAT_CSV,
+			input:         "text,not_before\nhello,\n\"with, comma\",2030-01-01T09:00:00Z\n,\n",
+			expectedTexts: []string{"hello", "with, comma"},
+		},
+		{
+			format:        FORMAT_CSV,
+			columns:       map[string]string{"text": "Copy"},
+			input:         "\uFEFFCopy,Notes\nhello,ignored\n",
+			expectedTexts: []string{"hello"},
+		},
+		{
+			format:        FORMAT_CSV,
+			input:         "Copy\nhello\n",
+			expectedError: "no text column",
+		},
+		{
+			format:        FORMAT_CSV,
+			input:         "text,not_before\nhello,tomorrow\n",
+			expectedError: "test: row 2: tweet 0: Bad time for not_before",
+		},
+		{
+			format:        FORMAT_JSONL,
+			input:         "\"hello\"\n\n{\"text\": \"there\", \"media\": [\"a.png\"]}\r\n",
+			expectedTexts: []string{"hello", "there"},
+		},
+		{
+			format:        FORMAT_JSONL,
+			input:         "\"hello\"\n{\"text\": \n",
+			expectedError: "test:2:",
+		},
+		{
+			format:        FORMAT_YAML,
+			input:         "- hello\n- text: there\n  not_before: 2030-01-01T09:00:00Z\n  media:\n    - source: a.png\n      alt_text: A\n",
+			expectedTexts: []string{"hello", "there"},
+		},
+		{
+			format:        FORMAT_YAML,
+			input:         "",
+			expectedTexts: []string{},
+		},
+		{
+			format:        FORMAT_MARKDOWN,
+			input:         "# Launch\n\nFirst tweet\nstill first\n---\n## More\nSecond tweet\n",
+			expectedTexts: []string{"First tweet\nstill first", "Second tweet"},
+		},
+		{
+			format:        FORMAT_MARKDOWN,
+			input:         "# Launch\n\n- First tweet\n  still first\n\n* Second tweet\n1. #hashtag third\n",
+			expectedTexts: []string{"First tweet\nstill first", "Second tweet", "#hashtag third"},
+		},
+		{
+			format:        FORMAT_MARKDOWN,
+			input:         "# Launch\n\n- First tweet\n\nA stray paragraph.\n",
+			expectedError: "test:5: text outside of a list item",
+		},
+	}
+
+	for _, test := range testTables {
+		format, err := NewTweetFormat(test.format, "", "", test.columns)
+		if err != nil {
+			t.Errorf("Expected no error creating format %s but got %s.", test.format, err)
+			continue
+		}
+		envelopes, err := format.Parse(strings.NewReader(test.input), "test")
+		if test.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("Expected an error containing %q parsing %q but got %v.", test.expectedError, test.input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error parsing %q but got %s.", test.input, err)
+			continue
+		}
+		texts := []string{}
+		for _, envelope := range envelopes {
+			texts = append(texts, envelope.Text)
+		}
+		if strings.Join(texts, "|") != strings.Join(test.expectedTexts, "|") {
+			t.Errorf("Expected %q but got %q.", test.expectedTexts, texts)
+		}
+	}
+}
+
+func TestNewTweetFormatDetectsExtension(t *testing.T) {
+	testTables := []struct {
+		filename string
+		expected string
+	}{
+		{"tweets.txt", FORMAT_DELIMITED},
+		{"tweets", FORMAT_DELIMITED},
+		{"tweets.CSV", FORMAT_CSV},
+		{"tweets.jsonl", FORMAT_JSONL},
+		{"tweets.yml", FORMAT_YAML},
+		{"tweets.md", FORMAT_MARKDOWN},
+	}
+
+	for _, test := range testTables {
+		format, err := NewTweetFormat(FORMAT_AUTO, test.filename, "---\n", nil)
+		if err != nil {
+			t.Errorf("Expected no error for %s but got %s.", test.filename, err)
+			continue
+		}
+		if format.name != test.expected {
+			t.Errorf("Expected %s to be %s but got %s.", test.filename, test.expected, format.name)
+		}
+	}
+}
@@ -1,36 +1,305 @@
 package main
 
 import (
-	"io/ioutil"
+	"bufio"
+	"fmt"
+	"io"
 	"log"
+	"os"
 	"strings"
+	"time"
 )
 
 type TweetProvider interface {
-	All() ([]string, error)
+	All() ([]*Envelope, error)
 	Name() string
 }
 
+// Entries in a tweet file may start with directive lines, which set options
+// for that entry rather than being part of its text:
+//
+//	@not-before 2020-02-03T09:00:00-05:00
+//	@not-after 2020-02-04T00:00:00Z
+//	@media images/cat.png A cat, asleep on a keyboard
+//	@thread launch-announcement
+//
+// Times are in RFC 3339 format. @media may be repeated, and takes a local path
+// or s3:// URL, optionally followed by alt text. Consecutive entries with the
+// same @thread name are posted as a thread, in file order.
+const (
+	DIRECTIVE_NOT_BEFORE = "@not-before"
+	DIRECTIVE_NOT_AFTER  = "@not-after"
+	DIRECTIVE_MEDIA      = "@media"
+	DIRECTIVE_THREAD     = "@thread"
+)
+
+// FileTweetProvider reads tweets from a file in any of the supported formats.
+// The delimited format separates tweets with lines consisting of just the
+// delimiter. It's read a line at a time, so the file's size doesn't matter.
+// Windows line endings and a leading byte order mark are ignored, and entries
+// that are empty (including after a trailing delimiter) are skipped.
 type FileTweetProvider struct {
-	filename  string
-	delimiter string
+	filename string
+	format   *TweetFormat
 }
 
-func (this *FileTweetProvider) All() ([]string, error) {
-	log.Printf("Scanning %s for tweets.\n", this.filename)
-	bytes, err := ioutil.ReadFile(this.filename)
+func (this *FileTweetProvider) All() ([]*Envelope, error) {
+	log.Printf("Scanning %s for tweets (format: %s).\n", this.filename, this.format.name)
+	file, err := os.Open(this.filename)
 	if err != nil {
-		return []string{}, nil
+		return nil, err
+	}
+	defer file.Close()
+	return this.format.Parse(file, this.filename)
+}
+
+func (this *FileTweetProvider) Name() string {
+	return this.filename
+}
+
+// readEntries parses delimited entries from reader. name identifies the
+// source in error messages, which also give the line the entry started on. If
+// there's any data, the entries are rendered with each row of it in turn. It
+// also returns where each empty entry ended, as name:line.
+func readEntries(reader io.Reader, name, delimiter string, data []map[string]interface{}) ([]*Envelope, []string, error) {
+	delimiter = strings.TrimRight(delimiter, "\r\n")
+	if delimiter == "" || strings.ContainsAny(delimiter, "\r\n") {
+		return nil, nil, fmt.Errorf("The delimiter must be a single, non-empty line. Got %q.", delimiter)
+	}
+
+	lines := newLineReader(reader, name)
+	entries := newEntryCollector(name, data)
+	for {
+		line, ok, err := lines.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			break
+		}
+		if line == delimiter {
+			if err := entries.Delimit(lines.number); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		entries.Add(line, lines.number)
+	}
+	tweets, err := entries.Result()
+	return tweets, entries.empty, err
+}
+
+// lineReader reads a line at a time, without line endings (Unix or Windows)
+// or a leading byte order mark.
+type lineReader struct {
+	reader *bufio.Reader
+	name   string
+	// The number of the line last returned.
+	number int
+	done   bool
+}
+
+func newLineReader(reader io.Reader, name string) *lineReader {
+	return &lineReader{reader: bufio.NewReader(reader), name: name}
+}
+
+// Next returns the next line, or false once there are none left.
+func (this *lineReader) Next() (string, bool, error) {
+	if this.done {
+		return "", false, nil
+	}
+	line, err := this.reader.ReadString('\n')
+	if err == io.EOF {
+		this.done = true
+		if line == "" {
+			return "", false, nil
+		}
+	} else if err != nil {
+		return "", false, fmt.Errorf("%s:%d: %s", this.name, this.number+1, err)
+	}
+
+	this.number++
+	if this.number == 1 {
+		line = strings.TrimPrefix(line, "\uFEFF")
+	}
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	return line, true, nil
+}
+
+// entryCollector gathers the lines of each entry in turn, and parses them all
+// once they're complete. Blank entries are skipped.
+type entryCollector struct {
+	name string
+	// Rows to render each entry with, if the batch is a template.
+	data    []map[string]interface{}
+	entries []*rawEntry
+	lines   []string
+	// The line number the current entry starts on.
+	start int
+	// Whether a delimiter has been seen yet, and where each empty entry
+	// between two delimiters ended, as name:line.
+	delimited bool
+	empty     []string
+}
+
+type rawEntry struct {
+	text  string
+	start int
+}
+
+func newEntryCollector(name string, data []map[string]interface{}) *entryCollector {
+	return &entryCollector{name: name, data: data}
+}
+
+func (this *entryCollector) Add(line string, number int) {
+	if len(this.lines) == 0 && strings.TrimSpace(line) == "" {
+		return
+	}
+	if len(this.lines) == 0 {
+		this.start = number
+	}
+	this.lines = append(this.lines, line)
+}
+
+func (this *entryCollector) Finish() error {
+	entry := strings.TrimSpace(strings.Join(this.lines, "\n"))
+	this.lines = this.lines[:0]
+	if entry == "" {
+		return nil
+	}
+	this.entries = append(this.entries, &rawEntry{text: entry, start: this.start})
+	return nil
+}
+
+// Delimit finishes the current entry at the delimiter on line number, and
+// notes it if the entry was empty. Only entries between two delimiters count:
+// nothing before the first delimiter or after the last is how a file usually
+// starts or ends, not a missing tweet.
+func (this *entryCollector) Delimit(number int) error {
+	if this.delimited && len(this.lines) == 0 {
+		this.empty = append(this.empty, fmt.Sprintf("%s:%d", this.name, number))
 	}
+	this.delimited = true
+	return this.Finish()
+}
 
-	splitTweets := strings.Split(string(bytes), this.delimiter)
-	tweets := make([]string, len(splitTweets))
-	for i, rawTweet := range splitTweets {
-		tweets[i] = rawTweet[:len(rawTweet)-1]
+// Result finishes the last entry, and parses them all, once per row of data
+// if there is any.
+func (this *entryCollector) Result() ([]*Envelope, error) {
+	if err := this.Finish(); err != nil {
+		return nil, err
+	}
+	if this.data == nil {
+		return this.parse(nil, "")
+	}
+	tweets := []*Envelope{}
+	for row := range this.data {
+		rowTweets, err := this.parse(this.data[row], fmt.Sprintf(", row %d", row))
+		if err != nil {
+			return nil, err
+		}
+		tweets = append(tweets, rowTweets...)
 	}
 	return tweets, nil
 }
 
-func (this *FileTweetProvider) Name() string {
-	return this.filename
+// parse renders every entry with row (unless it's nil), then parses it. Entries
+// that render to nothing are skipped. rowLabel is added to error messages.
+func (this *entryCollector) parse(row map[string]interface{}, rowLabel string) ([]*Envelope, error) {
+	tweets := []*Envelope{}
+	threads := []string{}
+	for _, entry := range this.entries {
+		text := entry.text
+		if row != nil {
+			rendered, err := renderTemplate(text, row)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: tweet %d%s: %s", this.name, entry.start, len(tweets), rowLabel, err)
+			}
+			text = strings.TrimSpace(rendered)
+			if text == "" {
+				continue
+			}
+		}
+
+		tweet, thread, err := parseEntry(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: tweet %d%s: %s", this.name, entry.start, len(tweets), rowLabel, err)
+		}
+		tweets = append(tweets, tweet)
+		threads = append(threads, thread)
+	}
+	if err := assignThreads(tweets, threads); err != nil {
+		return nil, fmt.Errorf("%s: %s", this.name, err)
+	}
+	return tweets, nil
+}
+
+// parseEntry strips any leading directive lines from a raw entry, and returns
+// the envelope they describe, along with the name of the thread it belongs to
+// (if any).
+func parseEntry(entry string) (*Envelope, string, error) {
+	envelope := NewEnvelope("")
+	thread := ""
+	for strings.HasPrefix(entry, "@") {
+		line := entry
+		rest := ""
+		if newline := strings.Index(entry, "\n"); newline >= 0 {
+			line, rest = entry[:newline], entry[newline+1:]
+		}
+
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case DIRECTIVE_NOT_BEFORE, DIRECTIVE_NOT_AFTER:
+			if len(fields) != 2 {
+				return nil, "", fmt.Errorf("%s takes exactly one time.", fields[0])
+			}
+			t, err := time.Parse(time.RFC3339, fields[1])
+			if err != nil {
+				return nil, "", fmt.Errorf("Bad time for %s: %s", fields[0], err)
+			}
+			if fields[0] == DIRECTIVE_NOT_BEFORE {
+				envelope.NotBefore = &t
+			} else {
+				envelope.NotAfter = &t
+			}
+		case DIRECTIVE_MEDIA:
+			if len(fields) < 2 {
+				return nil, "", fmt.Errorf("%s needs a path or s3:// URL.", fields[0])
+			}
+			ref := &MediaRef{Source: fields[1]}
+			if len(fields) > 2 {
+				ref.AltText = strings.Join(fields[2:], " ")
+			}
+			envelope.Media = append(envelope.Media, ref)
+		case DIRECTIVE_THREAD:
+			if len(fields) != 2 {
+				return nil, "", fmt.Errorf("%s takes exactly one name.", fields[0])
+			}
+			thread = fields[1]
+		default:
+			// Not a directive, just a tweet that starts with a mention.
+			envelope.Text = entry
+			return envelope, thread, validateSchedule(envelope)
+		}
+		entry = rest
+	}
+
+	envelope.Text = entry
+	if envelope.Text == "" && len(envelope.Media) == 0 {
+		// Directives with nothing to post. Probably the text ended up in the
+		// next entry by mistake.
+		return nil, "", fmt.Errorf("Entry has directives but no text or media.")
+	}
+	return envelope, thread, validateSchedule(envelope)
+}
+
+func validateSchedule(envelope *Envelope) error {
+	if envelope.NotBefore != nil && envelope.NotAfter != nil && !envelope.NotAfter.After(*envelope.NotBefore) {
+		return fmt.Errorf("%s must be after %s.", DIRECTIVE_NOT_AFTER, DIRECTIVE_NOT_BEFORE)
+	}
+	if envelope.NotAfter != nil && envelope.NotAfter.Before(time.Now()) {
+		return fmt.Errorf("%s %s is already in the past.", DIRECTIVE_NOT_AFTER, envelope.NotAfter.Format(time.RFC3339))
+	}
+	return nil
 }
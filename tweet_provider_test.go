@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEntry(t *testing.T) {
+	testTables := []struct {
+		entry             string
+		shouldError       bool
+		expectedText      string
+		expectedNotBefore string
+		expectedNotAfter  string
+	}{
+		{entry: "just text", expectedText: "just text"},
+		{entry: "@someone hello", expectedText: "@someone hello"},
+		{
+			entry:             "@not-before 2030-01-01T09:00:00Z\nhappy new year",
+			expectedText:      "happy new year",
+			expectedNotBefore: "2030-01-01T09:00:00Z",
+		},
+		{
+			entry:             "@not-before 2030-01-01T09:00:00Z\n@not-after 2030-01-02T00:00:00Z\n@someone hi",
+			expectedText:      "@someone hi",
+			expectedNotBefore: "2030-01-01T09:00:00Z",
+			expectedNotAfter:  "2030-01-02T00:00:00Z",
+		},
+		{entry: "@not-before tomorrow\nhi", shouldError: true},
+		{entry: "@not-before 2030-01-02T00:00:00Z\n@not-after 2030-01-01T00:00:00Z\nhi", shouldError: true},
+		{entry: "@not-after 2001-01-01T00:00:00Z\nhi", shouldError: true},
+		{entry: "@thread launch\n@not-before 2030-01-01T09:00:00Z", shouldError: true},
+	}
+
+	for _, test := range testTables {
+		envelope, _, err := parseEntry(test.entry)
+		if test.shouldError {
+			if err == nil {
+				t.Errorf("Expected an error parsing %q but got none.", test.entry)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error parsing %q but got %s.", test.entry, err)
+			continue
+		}
+		if envelope.Text != test.expectedText {
+			t.Errorf("Expected text %q but got %q.", test.expectedText, envelope.Text)
+		}
+		if formatTime(envelope.NotBefore) != test.expectedNotBefore {
+			t.Errorf("Expected not-before %q but got %q.", test.expectedNotBefore, formatTime(envelope.NotBefore))
+		}
+		if formatTime(envelope.NotAfter) != test.expectedNotAfter {
+			t.Errorf("Expected not-after %q but got %q.", test.expectedNotAfter, formatTime(envelope.NotAfter))
+		}
+	}
+}
+
+func TestReadEntries(t *testing.T) {
+	testTables := []struct {
+		input         string
+		expectedTexts []string
+		expectedEmpty []string
+		expectedError string
+	}{
+		{input: "", expectedTexts: []string{}},
+		{input: "one\n---\ntwo\n", expectedTexts: []string{"one", "two"}},
+		{input: "one\n---\ntwo", expectedTexts: []string{"one", "two"}},
+		{input: "one\n---\ntwo\n---\n", expectedTexts: []string{"one", "two"}},
+		{input: "one\r\nstill one\r\n---\r\ntwo\r\n", expectedTexts: []string{"one\nstill one", "two"}},
+		{input: "\uFEFFone\n---\ntwo\n", expectedTexts: []string{"one", "two"}},
+		{input: "---\none\n---\n\n---\n---\ntwo\n", expectedTexts: []string{"one", "two"}, expectedEmpty: []string{"test:5", "test:6"}},
+		{input: "one\n\n---\n\n\ntwo\n\n", expectedTexts: []string{"one", "two"}},
+		{input: "a --- in the middle\n---\n", expectedTexts: []string{"a --- in the middle"}},
+		{input: "one\n---\n\n@not-before soon\ntwo\n", expectedError: "test:4: tweet 1:"},
+	}
+
+	for _, test := range testTables {
+		envelopes, empty, err := readEntries(strings.NewReader(test.input), "test", "---\n", nil)
+		if test.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("Expected an error containing %q reading %q but got %v.", test.expectedError, test.input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error reading %q but got %s.", test.input, err)
+			continue
+		}
+		texts := []string{}
+		for _, envelope := range envelopes {
+			texts = append(texts, envelope.Text)
+		}
+		if strings.Join(texts, "|") != strings.Join(test.expectedTexts, "|") {
+			t.Errorf("Expected %q but got %q.", test.expectedTexts, texts)
+		}
+		if strings.Join(empty, ",") != strings.Join(test.expectedEmpty, ",") {
+			t.Errorf("Expected empty entries at %v reading %q but got %v.", test.expectedEmpty, test.input, empty)
+		}
+	}
+}
+
+func TestFileTweetProviderReportsMissingFile(t *testing.T) {
+	provider := &FileTweetProvider{filename: "does-not-exist.txt", format: &TweetFormat{name: FORMAT_DELIMITED, delimiter: "---\n"}}
+	if _, err := provider.All(); err == nil {
+		t.Errorf("Expected an error reading a missing file but got none.")
+	}
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// STDIN_SOURCE is the source name that reads tweets from standard input.
+const STDIN_SOURCE = "-"
+
+// NewTweetProvider returns a provider for source, which is a local path,
+// STDIN_SOURCE, an s3://bucket/key URL, or an http(s):// URL. Local files are
+// checked up front, so that a typo fails before anything else is set up.
+func NewTweetProvider(source string, format *TweetFormat, region string) (TweetProvider, error) {
+	if source == STDIN_SOURCE {
+		return &ReaderTweetProvider{reader: os.Stdin, name: "stdin", format: format}, nil
+	}
+	if bucket, key, ok := parseS3Source(source); ok {
+		sess := session.Must(session.NewSession())
+		client := s3.New(sess, &aws.Config{Region: aws.String(region)})
+		return &S3TweetProvider{s3: client, bucket: bucket, key: key, format: format}, nil
+	}
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		if _, err := url.Parse(source); err != nil {
+			return nil, err
+		}
+		return &HTTPTweetProvider{httpClient: newHTTPClient(), url: source, format: format}, nil
+	}
+	if strings.Contains(source, "://") {
+		return nil, fmt.Errorf("%s: tweets must come from a local path, stdin (%s), an s3:// URL, or an http(s):// URL.", source, STDIN_SOURCE)
+	}
+
+	file, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	return &FileTweetProvider{filename: source, format: format}, nil
+}
+
+// tweetSourcePath returns the part of source that its format can be detected
+// from.
+func tweetSourcePath(source string) string {
+	if strings.Contains(source, "://") {
+		if u, err := url.Parse(source); err == nil {
+			return u.Path
+		}
+	}
+	return source
+}
+
+// ReaderTweetProvider reads tweets from an already open stream, such as stdin.
+// It can only be read once.
+type ReaderTweetProvider struct {
+	reader io.Reader
+	name   string
+	format *TweetFormat
+}
+
+func (this *ReaderTweetProvider) All() ([]*Envelope, error) {
+	log.Printf("Reading tweets from %s (format: %s).\n", this.name, this.format.name)
+	return this.format.Parse(this.reader, this.name)
+}
+
+func (this *ReaderTweetProvider) Name() string {
+	return this.name
+}
+
+// S3TweetProvider reads tweets from an S3 object.
+type S3TweetProvider struct {
+	s3     s3iface.S3API
+	bucket string
+	key    string
+	format *TweetFormat
+}
+
+func (this *S3TweetProvider) All() ([]*Envelope, error) {
+	log.Printf("Downloading tweets from %s (format: %s).\n", this.Name(), this.format.name)
+	obj, err := this.s3.GetObject(&s3.GetObjectInput{Bucket: &this.bucket, Key: &this.key})
+	if err != nil {
+		if awsErr, ok := err.(awserr.RequestFailure); ok && awsErr.StatusCode() == 404 {
+			return nil, fmt.Errorf("%s does not exist.", this.Name())
+		}
+		return nil, err
+	}
+	defer obj.Body.Close()
+	return this.format.Parse(obj.Body, this.Name())
+}
+
+func (this *S3TweetProvider) Name() string {
+	return "s3://" + this.bucket + "/" + this.key
+}
+
+// HTTPTweetProvider reads tweets from an HTTP(S) URL.
+type HTTPTweetProvider struct {
+	httpClient *http.Client
+	url        string
+	format     *TweetFormat
+}
+
+func (this *HTTPTweetProvider) All() ([]*Envelope, error) {
+	log.Printf("Downloading tweets from %s (format: %s).\n", this.url, this.format.name)
+	resp, err := this.httpClient.Get(this.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, fmt.Errorf("%s: %s", this.url, err)
+	}
+	return this.format.Parse(resp.Body, this.url)
+}
+
+func (this *HTTPTweetProvider) Name() string {
+	return this.url
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+type FakeS3 struct {
+	s3iface.S3API
+	objects map[string]string
+}
+
+func (this *FakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	body, ok := this.objects[*input.Bucket+"/"+*input.Key]
+	if !ok {
+		return nil, awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchKey, "not found", nil), 404, "")
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+}
+
+func TestTweetSources(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tweets.jsonl" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, `"from http"`)
+	}))
+	defer server.Close()
+
+	delimited := &TweetFormat{name: FORMAT_DELIMITED, delimiter: "---\n"}
+	jsonl := &TweetFormat{name: FORMAT_JSONL}
+	fakeS3 := &FakeS3{objects: map[string]string{"bucket/tweets.txt": "from s3\n---\n"}}
+
+	testTables := []struct {
+		provider      TweetProvider
+		expectedTexts []string
+		shouldError   bool
+	}{
+		{
+			provider:      &ReaderTweetProvider{reader: strings.NewReader("from stdin\n"), name: "stdin", format: delimited},
+			expectedTexts: []string{"from stdin"},
+		},
+		{
+			provider:      &S3TweetProvider{s3: fakeS3, bucket: "bucket", key: "tweets.txt", format: delimited},
+			expectedTexts: []string{"from s3"},
+		},
+		{
+			provider:    &S3TweetProvider{s3: fakeS3, bucket: "bucket", key: "missing.txt", format: delimited},
+			shouldError: true,
+		},
+		{
+			provider:      &HTTPTweetProvider{httpClient: server.Client(), url: server.URL + "/tweets.jsonl", format: jsonl},
+			expectedTexts: []string{"from http"},
+		},
+		{
+			provider:    &HTTPTweetProvider{httpClient: server.Client(), url: server.URL + "/missing.jsonl", format: jsonl},
+			shouldError: true,
+		},
+	}
+
+	for _, test := range testTables {
+		envelopes, err := test.provider.All()
+		if test.shouldError {
+			if err == nil {
+				t.Errorf("Expected an error reading %s but got none.", test.provider.Name())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error reading %s but got %s.", test.provider.Name(), err)
+			continue
+		}
+		texts := []string{}
+		for _, envelope := range envelopes {
+			texts = append(texts, envelope.Text)
+		}
+		if strings.Join(texts, "|") != strings.Join(test.expectedTexts, "|") {
+			t.Errorf("Expected %q from %s but got %q.", test.expectedTexts, test.provider.Name(), texts)
+		}
+	}
+}
+
+func TestNewTweetProvider(t *testing.T) {
+	format := &TweetFormat{name: FORMAT_DELIMITED, delimiter: "---\n"}
+	testTables := []struct {
+		source       string
+		expectedType string
+		shouldError  bool
+	}{
+		{source: "-", expectedType: "*main.ReaderTweetProvider"},
+		{source: "s3://bucket/tweets.csv", expectedType: "*main.S3TweetProvider"},
+		{source: "https://example.com/tweets.md", expectedType: "*main.HTTPTweetProvider"},
+		{source: "tweet_sources_test.go", expectedType: "*main.FileTweetProvider"},
+		{source: "does-not-exist.txt", shouldError: true},
+		{source: "ftp://example.com/tweets.txt", shouldError: true},
+	}
+
+	for _, test := range testTables {
+		provider, err := NewTweetProvider(test.source, format, "us-east-1")
+		if test.shouldError {
+			if err == nil {
+				t.Errorf("Expected an error for %s but got none.", test.source)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error for %s but got %s.", test.source, err)
+			continue
+		}
+		if fmt.Sprintf("%T", provider) != test.expectedType {
+			t.Errorf("Expected %s for %s but got %T.", test.expectedType, test.source, provider)
+		}
+	}
+	if path := tweetSourcePath("s3://bucket/dir/tweets.csv"); path != "/dir/tweets.csv" {
+		t.Errorf("Expected /dir/tweets.csv but got %s.", path)
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/dghubble/go-twitter/twitter"
 	"github.com/dghubble/oauth1"
@@ -26,13 +29,16 @@ type TwitterAPI interface {
 
 type Twitter struct {
 	*twitter.Client
+	// httpClient is the OAuth1-signing client underneath Client, for the
+	// endpoints go-twitter doesn't wrap.
+	httpClient *http.Client
 }
 
 func (t *Twitter) GetStatusService() StatusService {
 	return t.Statuses
 }
 
-func NewTwitter(creds *TwitterCreds) TwitterAPI {
+func NewTwitter(creds *TwitterCreds) *Twitter {
 	config := oauth1.NewConfig(
 		creds.consumerKey,
 		creds.consumerSecret,
@@ -42,26 +48,75 @@ func NewTwitter(creds *TwitterCreds) TwitterAPI {
 		creds.accessSecret,
 	)
 
+	// The signing client has no timeout of its own, unlike the other
+	// backends' clients.
 	httpClient := config.Client(oauth1.NoContext, token)
-	return &Twitter{twitter.NewClient(httpClient)}
+	httpClient.Timeout = newHTTPClient().Timeout
+	return &Twitter{Client: twitter.NewClient(httpClient), httpClient: httpClient}
+}
+
+// Error codes returned by the Twitter API that mean the tweet will never be
+// accepted as-is, no matter how many times we retry it.
+// See https://developer.twitter.com/en/docs/basics/response-codes.
+var permanentTwitterErrorCodes = map[int]string{
+	170: "MISSING_STATUS",
+	186: "TWEET_TOO_LONG",
+	187: "DUPLICATE",
+	324: "INVALID_MEDIA",
+	385: "REPLY_TO_UNAVAILABLE_TWEET",
 }
 
 func (t *Twitter) Tweet(text string, params *twitter.StatusUpdateParams) (string, error) {
+	tweet, err := t.update(text, params)
+	if err != nil {
+		return "", err
+	}
+	return tweet.FullText, nil
+}
+
+func (t *Twitter) Publish(ctx context.Context, post *Post) (*PublishedPost, error) {
+	params := &twitter.StatusUpdateParams{}
+	if post.InReplyTo != "" {
+		id, err := strconv.ParseInt(post.InReplyTo, 10, 64)
+		if err != nil {
+			return nil, Permanent(fmt.Errorf("Cannot reply to %q: not a tweet ID.", post.InReplyTo))
+		}
+		params.InReplyToStatusID = id
+	}
+	for _, media := range post.Media {
+		mediaID, err := t.uploadMedia(ctx, media)
+		if err != nil {
+			return nil, err
+		}
+		params.MediaIds = append(params.MediaIds, mediaID)
+	}
+
+	tweet, err := t.update(post.Text, params)
+	if err != nil {
+		return nil, err
+	}
+	return &PublishedPost{ID: tweet.IDStr, Text: tweet.FullText}, nil
+}
+
+func (t *Twitter) Name() string {
+	return BACKEND_TWITTER
+}
+
+func (t *Twitter) update(text string, params *twitter.StatusUpdateParams) (*twitter.Tweet, error) {
 	log.Printf("[tweet]: Sending tweet: %s\n", text)
-	tweet, resp, err := t.GetStatusService().Update(text, params)
+	tweet, _, err := t.GetStatusService().Update(text, params)
 	if err != nil {
 		log.Printf("%T\n", err)
+		if apiErr, ok := err.(twitter.APIError); ok {
+			for _, detail := range apiErr.Errors {
+				if name, ok := permanentTwitterErrorCodes[detail.Code]; ok {
+					log.Printf("[tweet]: %s: %s\n", name, text)
+					return nil, Permanent(err)
+				}
+			}
+		}
+		return nil, err
 	}
-	switch resp.StatusCode {
-	case 186: // tweet too long
-		log.Printf("[tweet]: TWEET_TOO_LONG: %s\n", text)
-		return "", err
-	case 187:
-		// Twitter thinks this was a dupe.
-		// Log it and continue working through the queue.
-		log.Printf("[tweet]: DUPE FOUND -- %s\n", text)
-		return text, err
-	default:
-		return tweet.FullText, err
-	}
+
+	return tweet, nil
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// go-twitter doesn't cover media uploads, so these talk to the upload API
+// directly, through the same OAuth1-signing HTTP client.
+const (
+	TWITTER_MEDIA_UPLOAD_URL   = "https://upload.twitter.com/1.1/media/upload.json"
+	TWITTER_MEDIA_METADATA_URL = "https://upload.twitter.com/1.1/media/metadata/create.json"
+
+	// Twitter accepts APPEND segments of up to 5MB.
+	TWITTER_MEDIA_CHUNK_SIZE = 4 * 1024 * 1024
+
+	// How long to wait for Twitter to finish processing an upload (mostly
+	// relevant for video) before giving up.
+	TWITTER_MEDIA_PROCESSING_TIMEOUT = 10 * time.Minute
+)
+
+var twitterMediaCategories = map[string]string{
+	MEDIA_CATEGORY_IMAGE: "tweet_image",
+	MEDIA_CATEGORY_GIF:   "tweet_gif",
+	MEDIA_CATEGORY_VIDEO: "tweet_video",
+}
+
+type twitterMediaResponse struct {
+	MediaIDString  string `json:"media_id_string"`
+	ProcessingInfo *struct {
+		State          string `json:"state"`
+		CheckAfterSecs int    `json:"check_after_secs"`
+		Error          *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"processing_info"`
+}
+
+func (t *Twitter) mediaRequest(req *http.Request, out interface{}) error {
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (t *Twitter) mediaCommand(ctx context.Context, method string, params url.Values, out interface{}) error {
+	var req *http.Request
+	var err error
+	if method == http.MethodGet {
+		req, err = http.NewRequest(method, TWITTER_MEDIA_UPLOAD_URL+"?"+params.Encode(), nil)
+	} else {
+		req, err = http.NewRequest(method, TWITTER_MEDIA_UPLOAD_URL, strings.NewReader(params.Encode()))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return Permanent(err)
+	}
+	return t.mediaRequest(req.WithContext(ctx), out)
+}
+
+func (t *Twitter) appendMediaChunk(ctx context.Context, mediaID string, segment int, chunk []byte) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("command", "APPEND")
+	writer.WriteField("media_id", mediaID)
+	writer.WriteField("segment_index", strconv.Itoa(segment))
+	part, err := writer.CreateFormFile("media", "chunk")
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(chunk); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, TWITTER_MEDIA_UPLOAD_URL, &body)
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return t.mediaRequest(req.WithContext(ctx), nil)
+}
+
+// uploadMedia runs the chunked INIT/APPEND/FINALIZE upload, waits for any
+// processing to finish, sets the alt text, and returns the media ID.
+func (t *Twitter) uploadMedia(ctx context.Context, media *Media) (int64, error) {
+	log.Printf("[tweet]: Uploading %s (%d bytes).\n", media.Source, media.Size)
+
+	initResp := &twitterMediaResponse{}
+	err := t.mediaCommand(ctx, http.MethodPost, url.Values{
+		"command":        {"INIT"},
+		"total_bytes":    {strconv.FormatInt(media.Size, 10)},
+		"media_type":     {media.MimeType},
+		"media_category": {twitterMediaCategories[media.Category]},
+	}, initResp)
+	if err != nil {
+		return 0, err
+	}
+	mediaID := initResp.MediaIDString
+
+	reader, err := media.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	chunk := make([]byte, TWITTER_MEDIA_CHUNK_SIZE)
+	for segment := 0; ; segment++ {
+		n, err := io.ReadFull(reader, chunk)
+		if n > 0 {
+			if err := t.appendMediaChunk(ctx, mediaID, segment, chunk[:n]); err != nil {
+				return 0, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	status := &twitterMediaResponse{}
+	err = t.mediaCommand(ctx, http.MethodPost, url.Values{"command": {"FINALIZE"}, "media_id": {mediaID}}, status)
+	if err != nil {
+		return 0, err
+	}
+
+	deadline := time.Now().Add(TWITTER_MEDIA_PROCESSING_TIMEOUT)
+	for status.ProcessingInfo != nil {
+		switch status.ProcessingInfo.State {
+		case "succeeded":
+			status.ProcessingInfo = nil
+			continue
+		case "failed":
+			reason := "unknown error"
+			if status.ProcessingInfo.Error != nil {
+				reason = status.ProcessingInfo.Error.Message
+			}
+			return 0, Permanent(fmt.Errorf("Twitter could not process %s: %s", media.Source, reason))
+		}
+
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("Timed out waiting for Twitter to process %s.", media.Source)
+		}
+		wait := time.Duration(status.ProcessingInfo.CheckAfterSecs) * time.Second
+		if wait <= 0 {
+			wait = time.Second
+		}
+		log.Printf("[tweet]: Twitter is processing %s. Checking again in %s.\n", media.Source, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+
+		status = &twitterMediaResponse{}
+		err = t.mediaCommand(ctx, http.MethodGet, url.Values{"command": {"STATUS"}, "media_id": {mediaID}}, status)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if media.AltText != "" {
+		metadata, err := json.Marshal(map[string]interface{}{
+			"media_id": mediaID,
+			"alt_text": map[string]string{"text": media.AltText},
+		})
+		if err != nil {
+			return 0, Permanent(err)
+		}
+		req, err := http.NewRequest(http.MethodPost, TWITTER_MEDIA_METADATA_URL, bytes.NewReader(metadata))
+		if err != nil {
+			return 0, Permanent(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if err := t.mediaRequest(req.WithContext(ctx), nil); err != nil {
+			return 0, err
+		}
+	}
+
+	return strconv.ParseInt(mediaID, 10, 64)
+}
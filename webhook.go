@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+type WebhookConfig struct {
+	url string
+}
+
+// Webhook publishes posts by POSTing them as JSON to an arbitrary URL. Any
+// 2xx response counts as success; if the response body is a JSON object with
+// an "id" field, that is used as the post's ID.
+type Webhook struct {
+	url        string
+	httpClient *http.Client
+}
+
+func NewWebhook(conf *WebhookConfig) (*Webhook, error) {
+	if conf == nil || conf.url == "" {
+		return nil, errors.New("The webhook backend requires a URL.")
+	}
+	return &Webhook{
+		url:        conf.url,
+		httpClient: newHTTPClient(),
+	}, nil
+}
+
+type webhookPayload struct {
+	Key     string          `json:"key,omitempty"`
+	Text    string          `json:"text"`
+	ReplyTo string          `json:"reply_to,omitempty"`
+	Tags    []string        `json:"tags,omitempty"`
+	Media   []*webhookMedia `json:"media,omitempty"`
+}
+
+// Webhooks are sent references to media rather than the media itself.
+type webhookMedia struct {
+	Source   string `json:"source"`
+	AltText  string `json:"alt_text,omitempty"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+}
+
+type webhookResponse struct {
+	ID string `json:"id"`
+}
+
+func (this *Webhook) Publish(ctx context.Context, post *Post) (*PublishedPost, error) {
+	log.Printf("[webhook]: Posting to %s: %s\n", this.url, post.Text)
+	media := make([]*webhookMedia, len(post.Media))
+	for i, m := range post.Media {
+		media[i] = &webhookMedia{Source: m.Source, AltText: m.AltText, MimeType: m.MimeType, Size: m.Size}
+	}
+	payload, err := json.Marshal(&webhookPayload{
+		Key:     post.Key,
+		Text:    post.Text,
+		ReplyTo: post.InReplyTo,
+		Tags:    post.Tags,
+		Media:   media,
+	})
+	if err != nil {
+		return nil, Permanent(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, this.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := this.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	// The post has been accepted at this point, so a body we can't make sense
+	// of is not an error; we just don't learn an ID.
+	published := &PublishedPost{Text: post.Text}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	webhookResp := &webhookResponse{}
+	if json.Unmarshal(body, webhookResp) == nil {
+		published.ID = webhookResp.ID
+	}
+	return published, nil
+}
+
+func (this *Webhook) Name() string {
+	return BACKEND_WEBHOOK
+}